@@ -0,0 +1,878 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"llm-balancer/openai"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// anthropicVersion is the version of the Messages API the client speaks.
+const anthropicVersion = "2023-06-01"
+
+// anthropicDefaultMaxTokens is sent when the request sets no limit, the
+// Messages API requires max_tokens.
+const anthropicDefaultMaxTokens = 4096
+
+type (
+	AnthropicClient struct {
+		BaseURL string
+		APIKey  string
+	}
+
+	// AnthropicRequest represents a request to the Messages API.
+	AnthropicRequest struct {
+		Model         string               `json:"model"`
+		System        any                  `json:"system,omitempty"` // string or text blocks
+		Messages      []AnthropicMessage   `json:"messages"`
+		MaxTokens     int                  `json:"max_tokens"`
+		StopSequences []string             `json:"stop_sequences,omitempty"`
+		Temperature   *float64             `json:"temperature,omitempty"`
+		TopP          *float64             `json:"top_p,omitempty"`
+		Tools         []AnthropicTool      `json:"tools,omitempty"`
+		ToolChoice    *AnthropicToolChoice `json:"tool_choice,omitempty"`
+		Stream        bool                 `json:"stream,omitempty"`
+	}
+
+	AnthropicMessage struct {
+		Role    string             `json:"role"` // user or assistant
+		Content []AnthropicContent `json:"content"`
+	}
+
+	// AnthropicContent is a content block: text, image, document, tool_use or tool_result.
+	AnthropicContent struct {
+		Type      string           `json:"type"`
+		Text      string           `json:"text,omitempty"`
+		Source    *AnthropicSource `json:"source,omitempty"`      // image, document
+		ID        string           `json:"id,omitempty"`          // tool_use
+		Name      string           `json:"name,omitempty"`        // tool_use
+		Input     json.RawMessage  `json:"input,omitempty"`       // tool_use
+		ToolUseID string           `json:"tool_use_id,omitempty"` // tool_result
+		Content   any              `json:"content,omitempty"`     // tool_result, string or text blocks
+		IsError   bool             `json:"is_error,omitempty"`    // tool_result
+	}
+
+	AnthropicSource struct {
+		Type      string `json:"type"` // base64 or url
+		MediaType string `json:"media_type,omitempty"`
+		Data      string `json:"data,omitempty"`
+		URL       string `json:"url,omitempty"`
+	}
+
+	AnthropicTool struct {
+		Type        string         `json:"type,omitempty"` // empty or custom, others are server tools
+		Name        string         `json:"name"`
+		Description string         `json:"description,omitempty"`
+		InputSchema map[string]any `json:"input_schema"`
+	}
+
+	AnthropicToolChoice struct {
+		Type                   string `json:"type"` // auto, any, tool or none
+		Name                   string `json:"name,omitempty"`
+		DisableParallelToolUse bool   `json:"disable_parallel_tool_use,omitempty"`
+	}
+
+	// AnthropicResponse represents a Messages API response, it is also the
+	// message of the message_start stream event.
+	AnthropicResponse struct {
+		ID           string             `json:"id"`
+		Type         string             `json:"type"`
+		Role         string             `json:"role"`
+		Model        string             `json:"model"`
+		Content      []AnthropicContent `json:"content"`
+		StopReason   string             `json:"stop_reason"`
+		StopSequence *string            `json:"stop_sequence"`
+		Usage        AnthropicUsage     `json:"usage"`
+		Error        *AnthropicError    `json:"error,omitempty"`
+	}
+
+	AnthropicUsage struct {
+		InputTokens              int `json:"input_tokens"`
+		OutputTokens             int `json:"output_tokens"`
+		CacheCreationInputTokens int `json:"cache_creation_input_tokens,omitempty"`
+		CacheReadInputTokens     int `json:"cache_read_input_tokens,omitempty"`
+	}
+
+	AnthropicError struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	}
+
+	// AnthropicEvent is a Messages API stream event, the fields set depend on its type.
+	AnthropicEvent struct {
+		Type         string             `json:"type"`
+		Message      *AnthropicResponse `json:"message,omitempty"`       // message_start
+		Index        int                `json:"index"`                   // content_block_*
+		ContentBlock *AnthropicContent  `json:"content_block,omitempty"` // content_block_start
+		Delta        *AnthropicDelta    `json:"delta,omitempty"`         // content_block_delta, message_delta
+		Usage        *AnthropicUsage    `json:"usage,omitempty"`         // message_delta
+		Error        *AnthropicError    `json:"error,omitempty"`         // error
+	}
+
+	AnthropicDelta struct {
+		Type         string  `json:"type,omitempty"` // text_delta or input_json_delta
+		Text         string  `json:"text,omitempty"`
+		PartialJSON  string  `json:"partial_json,omitempty"`
+		StopReason   string  `json:"stop_reason,omitempty"`
+		StopSequence *string `json:"stop_sequence,omitempty"`
+	}
+)
+
+// NewAnthropicClient creates a new Anthropic API client.
+func NewAnthropicClient(baseURL string, apiKey string) *AnthropicClient {
+	return &AnthropicClient{BaseURL: baseURL, APIKey: apiKey}
+}
+
+// POSTChatCompletion sends a chat completion request to the Anthropic Messages API.
+func (c *AnthropicClient) POSTChatCompletion(ctx context.Context, request *Request, model string) (*Response, error) {
+	url := fmt.Sprintf("%s/messages", c.BaseURL)
+	stream := request.Request.Stream != nil && *request.Request.Stream
+
+	anthropicRequest, err := anthropicRequestFromOpenAIRequest(request.Request)
+	if err != nil {
+		return nil, fmt.Errorf("error converting OpenAI request to Anthropic request: %w", err)
+	}
+	anthropicRequest.Model = model
+	anthropicRequest.Stream = stream
+
+	jsonBody, err := json.Marshal(anthropicRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", c.APIKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if stream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making Anthropic request: %w", err)
+	}
+
+	// hand the open body to the caller, it is closed through Stream.Close
+	rateLimit := ParseRateLimit(resp.Header)
+	if stream && resp.StatusCode == http.StatusOK {
+		return &Response{Stream: newAnthropicStream(resp.Body), RateLimit: rateLimit}, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Anthropic response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Provider: "anthropic", StatusCode: resp.StatusCode, Body: string(body), RateLimit: rateLimit}
+	}
+
+	log.Trace().Str("provider", "anthropic").Bytes("body", body).Msg("Upstream response")
+
+	var anthropicResp AnthropicResponse
+	if err := json.Unmarshal(body, &anthropicResp); err != nil {
+		return nil, fmt.Errorf("error unmarshaling Anthropic response: %w", err)
+	}
+	if anthropicResp.Error != nil {
+		return nil, fmt.Errorf("anthropic API returned error: %s", anthropicResp.Error.Message)
+	}
+	return &Response{Response: openAIResponseFromAnthropicResponse(&anthropicResp), RateLimit: rateLimit}, nil
+}
+
+// ListModels returns the ids of the models available to the API key. The
+// list holds dated ids only, not aliases such as claude-sonnet-4-0.
+func (c *AnthropicClient) ListModels(ctx context.Context) ([]string, error) {
+	var models []string
+	afterID := ""
+	for {
+		query := url.Values{"limit": {"1000"}}
+		if afterID != "" {
+			query.Set("after_id", afterID)
+		}
+		var list struct {
+			Data []struct {
+				ID string `json:"id"`
+			} `json:"data"`
+			HasMore bool   `json:"has_more"`
+			LastID  string `json:"last_id"`
+		}
+		if err := c.get(ctx, "/models?"+query.Encode(), &list); err != nil {
+			return nil, err
+		}
+		for _, m := range list.Data {
+			models = append(models, m.ID)
+		}
+		if !list.HasMore || list.LastID == "" {
+			return models, nil
+		}
+		afterID = list.LastID
+	}
+}
+
+// CheckModel looks the model up by its id or alias, a model the API key
+// cannot use is a 404 StatusError.
+func (c *AnthropicClient) CheckModel(ctx context.Context, model string) error {
+	var info struct {
+		ID string `json:"id"`
+	}
+	return c.get(ctx, "/models/"+url.PathEscape(model), &info)
+}
+
+// get sends a GET request to the path under the base URL and decodes the
+// JSON response into out.
+func (c *AnthropicClient) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-api-key", c.APIKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error making Anthropic request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("error reading Anthropic response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{Provider: "anthropic", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("error unmarshaling Anthropic response: %w", err)
+	}
+	return nil
+}
+
+// anthropicRequestFromOpenAIRequest converts an OpenAI request into a
+// Messages API request. System and developer messages become the system
+// prompt, tool results become tool_result blocks of a user message and
+// consecutive messages of the same role are merged as the API expects.
+func anthropicRequestFromOpenAIRequest(request *openai.ChatCompletionRequest) (*AnthropicRequest, error) {
+	if request == nil {
+		return nil, fmt.Errorf("request is nil")
+	}
+
+	var system []string
+	var messages []AnthropicMessage
+	for i, message := range request.Messages {
+		var role string
+		var blocks []AnthropicContent
+		switch message.Role {
+		case "system", "developer":
+			text, err := messageText(message)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			system = append(system, text)
+			continue
+		case "user":
+			role = "user"
+			parts, err := message.ContentParts()
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			for _, part := range parts {
+				block, err := anthropicContentFromPart(part)
+				if err != nil {
+					return nil, fmt.Errorf("message %d: %w", i, err)
+				}
+				blocks = append(blocks, block)
+			}
+		case "assistant":
+			role = "assistant"
+			text, err := messageText(message)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			if text != "" {
+				blocks = append(blocks, AnthropicContent{Type: "text", Text: text})
+			}
+			for _, call := range message.ToolCalls {
+				blocks = append(blocks, AnthropicContent{
+					Type:  "tool_use",
+					ID:    call.ID,
+					Name:  call.Function.Name,
+					Input: toolInput(call.Function.Arguments),
+				})
+			}
+		case "tool":
+			role = "user"
+			text, err := messageText(message)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			blocks = append(blocks, AnthropicContent{Type: "tool_result", ToolUseID: message.ToolCallID, Content: text})
+		default:
+			return nil, fmt.Errorf("message %d: unsupported role %q", i, message.Role)
+		}
+
+		// the API rejects messages without content
+		if len(blocks) == 0 {
+			continue
+		}
+		if n := len(messages); n > 0 && messages[n-1].Role == role {
+			messages[n-1].Content = append(messages[n-1].Content, blocks...)
+			continue
+		}
+		messages = append(messages, AnthropicMessage{Role: role, Content: blocks})
+	}
+
+	stops, err := stopSequences(request.Stop)
+	if err != nil {
+		return nil, err
+	}
+
+	anthropicReq := &AnthropicRequest{
+		Messages:      messages,
+		MaxTokens:     anthropicDefaultMaxTokens,
+		StopSequences: stops,
+		Temperature:   request.Temperature,
+		TopP:          request.TopP,
+	}
+	if len(system) > 0 {
+		anthropicReq.System = strings.Join(system, "\n\n")
+	}
+	if maxTokens := request.MaxOutputTokens(); maxTokens != nil {
+		anthropicReq.MaxTokens = *maxTokens
+	}
+
+	if len(request.Tools) > 0 {
+		for _, tool := range request.Tools {
+			schema := tool.Function.Parameters
+			if schema == nil {
+				schema = map[string]any{"type": "object", "properties": map[string]any{}}
+			}
+			anthropicReq.Tools = append(anthropicReq.Tools, AnthropicTool{
+				Name:        tool.Function.Name,
+				Description: tool.Function.Description,
+				InputSchema: schema,
+			})
+		}
+		choice, err := anthropicToolChoice(request.ToolChoice)
+		if err != nil {
+			return nil, err
+		}
+		if request.ParallelToolCalls != nil && !*request.ParallelToolCalls {
+			if choice == nil {
+				choice = &AnthropicToolChoice{Type: "auto"}
+			}
+			choice.DisableParallelToolUse = true
+		}
+		anthropicReq.ToolChoice = choice
+	}
+
+	return anthropicReq, nil
+}
+
+// anthropicContentFromPart converts a content part of a user message.
+func anthropicContentFromPart(part openai.ContentPart) (AnthropicContent, error) {
+	switch part.Type {
+	case "text":
+		return AnthropicContent{Type: "text", Text: part.Text}, nil
+	case "image_url":
+		if part.ImageURL == nil || part.ImageURL.URL == "" {
+			return AnthropicContent{}, fmt.Errorf("image_url part without a url")
+		}
+		if mediaType, data, ok := parseDataURL(part.ImageURL.URL); ok {
+			return AnthropicContent{Type: "image", Source: &AnthropicSource{Type: "base64", MediaType: mediaType, Data: data}}, nil
+		}
+		return AnthropicContent{Type: "image", Source: &AnthropicSource{Type: "url", URL: part.ImageURL.URL}}, nil
+	case "file":
+		mediaType, data, err := fileData(part.File)
+		if err != nil {
+			return AnthropicContent{}, err
+		}
+		return AnthropicContent{Type: "document", Source: &AnthropicSource{Type: "base64", MediaType: mediaType, Data: data}}, nil
+	}
+	return AnthropicContent{}, fmt.Errorf("unsupported content part type %q", part.Type)
+}
+
+// anthropicToolChoice maps the OpenAI tool_choice, "auto", "none",
+// "required" or a named function, onto the Anthropic one.
+func anthropicToolChoice(toolChoice any) (*AnthropicToolChoice, error) {
+	switch v := toolChoice.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		switch v {
+		case "auto", "none":
+			return &AnthropicToolChoice{Type: v}, nil
+		case "required":
+			return &AnthropicToolChoice{Type: "any"}, nil
+		}
+	case map[string]any:
+		if function, ok := v["function"].(map[string]any); ok {
+			if name, ok := function["name"].(string); ok && name != "" {
+				return &AnthropicToolChoice{Type: "tool", Name: name}, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("unsupported tool_choice: %v", toolChoice)
+}
+
+func openAIResponseFromAnthropicResponse(anthropicResp *AnthropicResponse) *openai.ChatCompletionResponse {
+	message := openai.CompletionMessage{Role: "assistant"}
+	var text strings.Builder
+	for _, block := range anthropicResp.Content {
+		switch block.Type {
+		case "text":
+			text.WriteString(block.Text)
+		case "tool_use":
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:   block.ID,
+				Type: "function",
+				Function: openai.FunctionCall{
+					Name:      block.Name,
+					Arguments: string(toolInput(block.Input)),
+				},
+			})
+		}
+	}
+	if text.Len() > 0 || len(message.ToolCalls) == 0 {
+		content := text.String()
+		message.Content = &content
+	}
+
+	return &openai.ChatCompletionResponse{
+		ID:                anthropicResp.ID,
+		Created:           int(time.Now().Unix()),
+		Model:             anthropicResp.Model,
+		Object:            "chat.completion",
+		SystemFingerprint: anthropicResp.Model,
+		Usage:             openAIUsageFromAnthropicUsage(anthropicResp.Usage),
+		Choices: []openai.Choice{{
+			FinishReason: openAIFinishReasonFromAnthropic(anthropicResp.StopReason),
+			Message:      message,
+		}},
+	}
+}
+
+// openAIUsageFromAnthropicUsage counts cached prompt tokens as prompt
+// tokens, Anthropic reports them apart from input_tokens.
+func openAIUsageFromAnthropicUsage(usage AnthropicUsage) openai.Usage {
+	prompt := usage.InputTokens + usage.CacheCreationInputTokens + usage.CacheReadInputTokens
+	out := openai.Usage{
+		PromptTokens:     prompt,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      prompt + usage.OutputTokens,
+	}
+	if usage.CacheReadInputTokens > 0 {
+		out.PromptTokensDetails = &openai.TokenDetails{CachedTokens: usage.CacheReadInputTokens}
+	}
+	return out
+}
+
+// openAIFinishReasonFromAnthropic maps an Anthropic stop_reason onto the OpenAI vocabulary.
+func openAIFinishReasonFromAnthropic(reason string) string {
+	switch reason {
+	case "":
+		return ""
+	case "max_tokens":
+		return "length"
+	case "tool_use":
+		return "tool_calls"
+	case "refusal":
+		return "content_filter"
+	}
+	return "stop"
+}
+
+// anthropicStream translates a Messages API SSE body into OpenAI
+// chat.completion.chunk events. Usage is reported by message_start and
+// message_delta, it is emitted as a final usage chunk on message_stop.
+type anthropicStream struct {
+	body    io.ReadCloser
+	sse     *sseReader
+	id      string
+	created int
+	model   string
+	usage   AnthropicUsage
+	pending []*openai.ChatCompletionChunk
+	done    bool
+
+	toolCalls map[int]int // tool call index per content block index
+}
+
+func newAnthropicStream(body io.ReadCloser) *anthropicStream {
+	return &anthropicStream{
+		body:      body,
+		sse:       newSSEReader(body),
+		created:   int(time.Now().Unix()),
+		toolCalls: make(map[int]int),
+	}
+}
+
+func (s *anthropicStream) Recv() (*openai.ChatCompletionChunk, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return nil, io.EOF
+		}
+
+		_, data, err := s.sse.Next()
+		if err == io.EOF {
+			// the upstream closed without a message_stop
+			s.done = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var event AnthropicEvent
+		if err := json.Unmarshal(data, &event); err != nil {
+			return nil, fmt.Errorf("error unmarshaling Anthropic stream event: %w", err)
+		}
+		if err := s.handle(&event); err != nil {
+			return nil, err
+		}
+	}
+
+	chunk := s.pending[0]
+	s.pending = s.pending[1:]
+	return chunk, nil
+}
+
+func (s *anthropicStream) Close() error {
+	return s.body.Close()
+}
+
+// handle queues the chunks of one stream event.
+func (s *anthropicStream) handle(event *AnthropicEvent) error {
+	switch event.Type {
+	case "message_start":
+		if event.Message != nil {
+			s.id, s.model, s.usage = event.Message.ID, event.Message.Model, event.Message.Usage
+		}
+		content := ""
+		s.push(openai.Delta{Role: "assistant", Content: &content}, nil)
+	case "content_block_start":
+		if event.ContentBlock == nil {
+			return nil
+		}
+		switch event.ContentBlock.Type {
+		case "text":
+			if event.ContentBlock.Text != "" {
+				s.push(openai.Delta{Content: &event.ContentBlock.Text}, nil)
+			}
+		case "tool_use":
+			index := len(s.toolCalls)
+			s.toolCalls[event.Index] = index
+			s.push(openai.Delta{ToolCalls: []openai.ToolCallDelta{{
+				Index:    index,
+				ID:       event.ContentBlock.ID,
+				Type:     "function",
+				Function: openai.FunctionCallDelta{Name: event.ContentBlock.Name},
+			}}}, nil)
+		}
+	case "content_block_delta":
+		if event.Delta == nil {
+			return nil
+		}
+		switch event.Delta.Type {
+		case "text_delta":
+			s.push(openai.Delta{Content: &event.Delta.Text}, nil)
+		case "input_json_delta":
+			index, ok := s.toolCalls[event.Index]
+			if !ok || event.Delta.PartialJSON == "" {
+				return nil
+			}
+			s.push(openai.Delta{ToolCalls: []openai.ToolCallDelta{{
+				Index:    index,
+				Function: openai.FunctionCallDelta{Arguments: event.Delta.PartialJSON},
+			}}}, nil)
+		}
+	case "message_delta":
+		if event.Usage != nil {
+			if event.Usage.InputTokens > 0 {
+				s.usage.InputTokens = event.Usage.InputTokens
+			}
+			s.usage.OutputTokens = event.Usage.OutputTokens
+		}
+		if event.Delta != nil && event.Delta.StopReason != "" {
+			reason := openAIFinishReasonFromAnthropic(event.Delta.StopReason)
+			s.push(openai.Delta{}, &reason)
+		}
+	case "message_stop":
+		usage := openAIUsageFromAnthropicUsage(s.usage)
+		chunk := s.newChunk()
+		chunk.Choices = []openai.ChunkChoice{}
+		chunk.Usage = &usage
+		s.pending = append(s.pending, chunk)
+		s.done = true
+	case "error":
+		if event.Error != nil {
+			return fmt.Errorf("anthropic API returned error: %s", event.Error.Message)
+		}
+		return fmt.Errorf("anthropic API returned an error event")
+	}
+	// ping and content_block_stop carry nothing to forward
+	return nil
+}
+
+// push queues a chunk with a single choice.
+func (s *anthropicStream) push(delta openai.Delta, finishReason *string) {
+	chunk := s.newChunk()
+	chunk.Choices = []openai.ChunkChoice{{Delta: delta, FinishReason: finishReason}}
+	s.pending = append(s.pending, chunk)
+}
+
+func (s *anthropicStream) newChunk() *openai.ChatCompletionChunk {
+	return &openai.ChatCompletionChunk{
+		ID:                s.id,
+		Created:           s.created,
+		Model:             s.model,
+		Object:            "chat.completion.chunk",
+		SystemFingerprint: s.model,
+	}
+}
+
+// UnmarshalJSON accepts the shorthand of a string content for a single text block.
+func (m *AnthropicMessage) UnmarshalJSON(data []byte) error {
+	var aux struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	m.Role, m.Content = aux.Role, nil
+	var text string
+	if err := json.Unmarshal(aux.Content, &text); err == nil {
+		m.Content = []AnthropicContent{{Type: "text", Text: text}}
+		return nil
+	}
+	return json.Unmarshal(aux.Content, &m.Content)
+}
+
+// OpenAIRequestFromAnthropicRequest converts a Messages API request into an
+// OpenAI request, the reverse of anthropicRequestFromOpenAIRequest. Each
+// tool_result block becomes a tool message ahead of the rest of its user
+// message.
+func OpenAIRequestFromAnthropicRequest(request *AnthropicRequest) (*openai.ChatCompletionRequest, error) {
+	if request == nil {
+		return nil, fmt.Errorf("request is nil")
+	}
+
+	var messages []openai.Message
+	system, err := anthropicText(request.System)
+	if err != nil {
+		return nil, fmt.Errorf("system: %w", err)
+	}
+	if system != "" {
+		messages = append(messages, openai.Message{Role: "system", Content: system})
+	}
+
+	for i, message := range request.Messages {
+		switch message.Role {
+		case "user":
+			var parts []openai.ContentPart
+			for _, block := range message.Content {
+				switch block.Type {
+				case "text":
+					parts = append(parts, openai.ContentPart{Type: "text", Text: block.Text})
+				case "image":
+					url, err := imageURLFromAnthropicSource(block.Source)
+					if err != nil {
+						return nil, fmt.Errorf("message %d: %w", i, err)
+					}
+					parts = append(parts, openai.ContentPart{Type: "image_url", ImageURL: &openai.ImageURL{URL: url}})
+				case "document":
+					if block.Source == nil || block.Source.Type != "base64" {
+						return nil, fmt.Errorf("message %d: only base64 documents are supported", i)
+					}
+					url := fmt.Sprintf("data:%s;base64,%s", block.Source.MediaType, block.Source.Data)
+					parts = append(parts, openai.ContentPart{Type: "file", File: &openai.File{FileData: url}})
+				case "tool_result":
+					text, err := anthropicText(block.Content)
+					if err != nil {
+						return nil, fmt.Errorf("message %d: tool_result: %w", i, err)
+					}
+					messages = append(messages, openai.Message{Role: "tool", ToolCallID: block.ToolUseID, Content: text})
+				default:
+					return nil, fmt.Errorf("message %d: unsupported content block type %q", i, block.Type)
+				}
+			}
+			if len(parts) > 0 {
+				messages = append(messages, openai.Message{Role: "user", Content: parts})
+			}
+		case "assistant":
+			out := openai.Message{Role: "assistant"}
+			var text strings.Builder
+			for _, block := range message.Content {
+				switch block.Type {
+				case "text":
+					text.WriteString(block.Text)
+				case "tool_use":
+					out.ToolCalls = append(out.ToolCalls, openai.ToolCall{
+						ID:       block.ID,
+						Type:     "function",
+						Function: openai.FunctionCall{Name: block.Name, Arguments: string(toolInput(block.Input))},
+					})
+				case "thinking", "redacted_thinking":
+					// only meaningful to the model that produced them
+				default:
+					return nil, fmt.Errorf("message %d: unsupported content block type %q", i, block.Type)
+				}
+			}
+			if text.Len() > 0 {
+				out.Content = text.String()
+			}
+			messages = append(messages, out)
+		default:
+			return nil, fmt.Errorf("message %d: unsupported role %q", i, message.Role)
+		}
+	}
+
+	openAIReq := &openai.ChatCompletionRequest{
+		Model:               request.Model,
+		Messages:            messages,
+		MaxCompletionTokens: &request.MaxTokens,
+		Temperature:         request.Temperature,
+		TopP:                request.TopP,
+	}
+	if request.MaxTokens == 0 {
+		openAIReq.MaxCompletionTokens = nil
+	}
+	if len(request.StopSequences) > 0 {
+		openAIReq.Stop = request.StopSequences
+	}
+	if request.Stream {
+		stream := true
+		openAIReq.Stream = &stream
+	}
+
+	for _, tool := range request.Tools {
+		if tool.Type != "" && tool.Type != "custom" {
+			return nil, fmt.Errorf("unsupported tool type %q", tool.Type)
+		}
+		openAIReq.Tools = append(openAIReq.Tools, openai.Tool{
+			Type:     "function",
+			Function: openai.Function{Name: tool.Name, Description: tool.Description, Parameters: tool.InputSchema},
+		})
+	}
+	if choice := request.ToolChoice; choice != nil {
+		switch choice.Type {
+		case "auto", "none":
+			openAIReq.ToolChoice = choice.Type
+		case "any":
+			openAIReq.ToolChoice = "required"
+		case "tool":
+			openAIReq.ToolChoice = map[string]any{"type": "function", "function": map[string]any{"name": choice.Name}}
+		default:
+			return nil, fmt.Errorf("unsupported tool_choice type %q", choice.Type)
+		}
+		if choice.DisableParallelToolUse {
+			parallel := false
+			openAIReq.ParallelToolCalls = &parallel
+		}
+	}
+
+	return openAIReq, nil
+}
+
+// AnthropicResponseFromOpenAIResponse converts the first choice of an OpenAI
+// response into a Messages API response.
+func AnthropicResponseFromOpenAIResponse(resp *openai.ChatCompletionResponse) *AnthropicResponse {
+	out := &AnthropicResponse{
+		ID:      resp.ID,
+		Type:    "message",
+		Role:    "assistant",
+		Model:   resp.Model,
+		Content: []AnthropicContent{},
+		Usage: AnthropicUsage{
+			InputTokens:  resp.Usage.PromptTokens,
+			OutputTokens: resp.Usage.CompletionTokens,
+		},
+	}
+	if len(resp.Choices) == 0 {
+		return out
+	}
+
+	choice := resp.Choices[0]
+	if choice.Message.Content != nil && *choice.Message.Content != "" {
+		out.Content = append(out.Content, AnthropicContent{Type: "text", Text: *choice.Message.Content})
+	}
+	for _, call := range choice.Message.ToolCalls {
+		out.Content = append(out.Content, AnthropicContent{
+			Type:  "tool_use",
+			ID:    call.ID,
+			Name:  call.Function.Name,
+			Input: toolInput(call.Function.Arguments),
+		})
+	}
+	out.StopReason = AnthropicStopReason(choice.FinishReason)
+	return out
+}
+
+// AnthropicStopReason maps an OpenAI finish_reason onto the Anthropic vocabulary.
+func AnthropicStopReason(reason string) string {
+	switch reason {
+	case "":
+		return ""
+	case "length":
+		return "max_tokens"
+	case "tool_calls", "function_call":
+		return "tool_use"
+	case "content_filter":
+		return "refusal"
+	}
+	return "end_turn"
+}
+
+// anthropicText joins the text of a system prompt or tool_result content,
+// a string or a list of text blocks.
+func anthropicText(content any) (string, error) {
+	switch v := content.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	data, err := json.Marshal(content)
+	if err != nil {
+		return "", err
+	}
+	var blocks []AnthropicContent
+	if err := json.Unmarshal(data, &blocks); err != nil {
+		return "", fmt.Errorf("content must be a string or an array of content blocks: %w", err)
+	}
+	var text strings.Builder
+	for _, block := range blocks {
+		if block.Type != "text" {
+			return "", fmt.Errorf("unsupported content block type %q", block.Type)
+		}
+		text.WriteString(block.Text)
+	}
+	return text.String(), nil
+}
+
+// imageURLFromAnthropicSource returns a remote URL or a data URL for an image source.
+func imageURLFromAnthropicSource(source *AnthropicSource) (string, error) {
+	if source == nil {
+		return "", fmt.Errorf("image block without a source")
+	}
+	switch source.Type {
+	case "base64":
+		return fmt.Sprintf("data:%s;base64,%s", source.MediaType, source.Data), nil
+	case "url":
+		return source.URL, nil
+	}
+	return "", fmt.Errorf("unsupported image source type %q", source.Type)
+}
@@ -0,0 +1,192 @@
+package api_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"llm-balancer/api"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+const anthropicStream = `event: message_start
+data: {"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","model":"claude-test","content":[],"usage":{"input_tokens":4,"output_tokens":1}}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hel"}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"lookup","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"q\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"x\"}"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"},"usage":{"output_tokens":3}}
+
+event: message_stop
+data: {"type":"message_stop"}
+
+`
+
+var _ = Describe("AnthropicClient", func() {
+	var (
+		server *ghttp.Server
+		client *api.AnthropicClient
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		client = api.NewAnthropicClient(server.URL(), "test-key")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("translates the request and response of the Messages API", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/messages"),
+			ghttp.VerifyHeaderKV("x-api-key", "test-key"),
+			ghttp.VerifyHeaderKV("anthropic-version", "2023-06-01"),
+			ghttp.VerifyJSONRepresenting(map[string]any{
+				"model":          "claude-test",
+				"system":         "Be brief.",
+				"max_tokens":     100,
+				"stop_sequences": []string{"END"},
+				"messages": []map[string]any{
+					{"role": "user", "content": []map[string]any{
+						{"type": "text", "text": "What is in the image?"},
+						{"type": "image", "source": map[string]any{"type": "base64", "media_type": "image/png", "data": "aGk="}},
+					}},
+					{"role": "assistant", "content": []map[string]any{
+						{"type": "tool_use", "id": "toolu_0", "name": "lookup", "input": map[string]any{"q": "image"}},
+					}},
+					{"role": "user", "content": []map[string]any{
+						{"type": "tool_result", "tool_use_id": "toolu_0", "content": "a cat"},
+					}},
+				},
+				"tools": []map[string]any{{
+					"name":         "lookup",
+					"input_schema": map[string]any{"type": "object"},
+				}},
+				"tool_choice": map[string]any{"type": "any"},
+			}),
+			ghttp.RespondWith(http.StatusOK, `{
+				"id": "msg_1", "type": "message", "role": "assistant", "model": "claude-test",
+				"content": [
+					{"type": "text", "text": "Let me check."},
+					{"type": "tool_use", "id": "toolu_1", "name": "lookup", "input": {"q": "cat"}}
+				],
+				"stop_reason": "tool_use",
+				"usage": {"input_tokens": 20, "output_tokens": 8}
+			}`),
+		))
+
+		body := `{"max_completion_tokens":100,"stop":["END"],"tool_choice":"required",
+			"tools":[{"type":"function","function":{"name":"lookup","parameters":{"type":"object"}}}],
+			"messages":[
+				{"role":"system","content":"Be brief."},
+				{"role":"user","content":[{"type":"text","text":"What is in the image?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,aGk="}}]},
+				{"role":"assistant","content":null,"tool_calls":[{"id":"toolu_0","type":"function","function":{"name":"lookup","arguments":"{\"q\":\"image\"}"}}]},
+				{"role":"tool","tool_call_id":"toolu_0","content":"a cat"}
+			]}`
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "claude-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Response.ID).To(Equal("msg_1"))
+		Expect(resp.Response.Choices).To(HaveLen(1))
+		choice := resp.Response.Choices[0]
+		Expect(choice.FinishReason).To(Equal("tool_calls"))
+		Expect(choice.Message.Content).To(HaveValue(Equal("Let me check.")))
+		Expect(choice.Message.ToolCalls).To(HaveLen(1))
+		call := choice.Message.ToolCalls[0]
+		Expect(call.ID).To(Equal("toolu_1"))
+		Expect(call.Function.Name).To(Equal("lookup"))
+		Expect(call.Function.Arguments).To(MatchJSON(`{"q":"cat"}`))
+		Expect(resp.Response.Usage.TotalTokens).To(Equal(28))
+	})
+
+	It("sends the legacy max_tokens when max_completion_tokens is not set", func() {
+		respond := ghttp.RespondWith(http.StatusOK, `{"id":"msg_1","type":"message","role":"assistant","model":"claude-test",
+			"content":[{"type":"text","text":"hi"}],"stop_reason":"end_turn","usage":{"input_tokens":1,"output_tokens":1}}`)
+		expect := func(maxTokens int) http.HandlerFunc {
+			return ghttp.CombineHandlers(ghttp.VerifyJSONRepresenting(map[string]any{
+				"model":      "claude-test",
+				"max_tokens": maxTokens,
+				"messages":   []map[string]any{{"role": "user", "content": []map[string]any{{"type": "text", "text": "hi"}}}},
+			}), respond)
+		}
+		server.AppendHandlers(expect(64), expect(32))
+
+		_, err := client.POSTChatCompletion(context.Background(), chatRequest(`{"max_tokens":64,"messages":[{"role":"user","content":"hi"}]}`), "claude-test")
+		Expect(err).NotTo(HaveOccurred())
+		_, err = client.POSTChatCompletion(context.Background(), chatRequest(`{"max_tokens":64,"max_completion_tokens":32,"messages":[{"role":"user","content":"hi"}]}`), "claude-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("translates stream events into chat.completion.chunk deltas", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/messages"),
+			ghttp.VerifyJSONRepresenting(map[string]any{
+				"model":      "claude-test",
+				"max_tokens": 4096,
+				"stream":     true,
+				"messages":   []map[string]any{{"role": "user", "content": []map[string]any{{"type": "text", "text": "hi"}}}},
+			}),
+			ghttp.RespondWith(http.StatusOK, anthropicStream, http.Header{"Content-Type": {"text/event-stream"}}),
+		))
+
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(`{"stream":true,"messages":[{"role":"user","content":"hi"}]}`), "claude-test")
+		Expect(err).NotTo(HaveOccurred())
+		out := drain(resp.Stream)
+		Expect(out).To(ContainSubstring(`"id":"msg_1"`))
+		Expect(out).To(ContainSubstring(`"delta":{"content":"Hel"}`))
+		Expect(out).To(ContainSubstring(`"id":"toolu_1","index":0,"type":"function"`))
+		Expect(out).To(ContainSubstring(`"function":{"arguments":"\"x\"}"}`))
+		Expect(out).To(ContainSubstring(`"finish_reason":"tool_calls"`))
+		Expect(out).To(ContainSubstring(`"usage":{"completion_tokens":3,"prompt_tokens":4,"total_tokens":7}`))
+	})
+
+	It("lists the models page by page", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/models", "limit=1000"),
+				ghttp.VerifyHeaderKV("x-api-key", "test-key"),
+				ghttp.VerifyHeaderKV("anthropic-version", "2023-06-01"),
+				ghttp.RespondWith(http.StatusOK, `{"data":[{"id":"claude-a"}],"has_more":true,"last_id":"claude-a"}`),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/models", "after_id=claude-a&limit=1000"),
+				ghttp.RespondWith(http.StatusOK, `{"data":[{"id":"claude-b"}],"has_more":false,"last_id":"claude-b"}`),
+			),
+		)
+
+		models, err := client.ListModels(context.Background())
+		Expect(err).NotTo(HaveOccurred())
+		Expect(models).To(Equal([]string{"claude-a", "claude-b"}))
+	})
+
+	It("looks a model up by its alias", func() {
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/models/claude-sonnet-4-0"),
+				ghttp.RespondWith(http.StatusOK, `{"type":"model","id":"claude-sonnet-4-20250514"}`),
+			),
+			ghttp.RespondWith(http.StatusNotFound, `{"type":"error","error":{"type":"not_found_error","message":"model: gone"}}`),
+		)
+
+		Expect(client.CheckModel(context.Background(), "claude-sonnet-4-0")).To(Succeed())
+		var statusErr *api.StatusError
+		Expect(errors.As(client.CheckModel(context.Background(), "gone"), &statusErr)).To(BeTrue())
+		Expect(statusErr.StatusCode).To(Equal(http.StatusNotFound))
+	})
+})
@@ -2,7 +2,12 @@ package api
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"llm-balancer/openai"
+	"net/http"
+	"net/url"
+	"time"
 )
 
 /*
@@ -17,14 +22,82 @@ type Client interface {
 	POSTChatCompletion(ctx context.Context, request *Request, model string) (*Response, error)
 }
 
+// ModelLister is implemented by clients whose provider lists the models
+// available to the API key, a cheap way to check both are valid.
+type ModelLister interface {
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// ModelChecker is implemented by clients whose provider looks up a single
+// model, aliases included, which a listing may leave out.
+type ModelChecker interface {
+	CheckModel(ctx context.Context, model string) error
+}
+
 type Request struct {
 	Request      *openai.ChatCompletionRequest
 	TokensNeeded int
+	// AllowedModels restricts the models picked for a request that names
+	// neither a model nor a group, nil allows every model.
+	AllowedModels []string
+	// NoCache skips looking up the response cache, e.g. for a client
+	// sending Cache-Control: no-cache. The fresh response is still stored.
+	NoCache bool
+
+	// images holds the remote images downloaded for Gemini by URL, attempts
+	// of a request run one after another and share them.
+	images map[string]inlineImage
+}
+
+// inlineImage is the outcome of downloading a remote image.
+type inlineImage struct {
+	inline *GeminiPartInline
+	err    error
 }
 
 type Response struct {
-	Response *openai.ChatCompletionResponse
-	Error    error
+	Response  *openai.ChatCompletionResponse
+	Stream    Stream        // set instead of Response when the request asked to stream
+	RateLimit *RateLimit    // nil when the provider sent no rate limit headers
+	QueueTime time.Duration // time the balancer waited for cooldowns and rate limiters before sending
+	Cache     string        // HIT, MISS or BYPASS when the response cache is enabled
+	Error     error
+}
+
+// StatusError is returned by clients when the provider answers with a non-200 status.
+type StatusError struct {
+	Provider   string
+	StatusCode int
+	Body       string
+	RateLimit  *RateLimit
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s API request failed with status code %d: %s", e.Provider, e.StatusCode, e.Body)
+}
+
+// IsRetryable reports whether a failed call may succeed on another attempt:
+// rate limits, server side errors and transport failures are retryable,
+// cancelled requests and malformed requests or responses are not.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway,
+			http.StatusServiceUnavailable, http.StatusGatewayTimeout,
+			529: // Anthropic's overloaded_error
+			return true
+		}
+		return false
+	}
+
+	var urlErr *url.Error
+	return errors.As(err, &urlErr)
 }
 
 /*
@@ -0,0 +1,47 @@
+package api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"llm-balancer/api"
+	"llm-balancer/openai"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+func TestAPI(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "API Suite")
+}
+
+// chatRequest decodes a chat completion request body the way the handler
+// does.
+func chatRequest(body string) *api.Request {
+	var req openai.ChatCompletionRequest
+	Expect(json.Unmarshal([]byte(body), &req)).To(Succeed())
+	return &api.Request{Request: &req}
+}
+
+// drain reads a stream to its end and returns its chunks as JSON, one per
+// line.
+func drain(stream api.Stream) string {
+	defer func() { _ = stream.Close() }()
+
+	var out strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			return out.String()
+		}
+		Expect(err).NotTo(HaveOccurred())
+		data, err := json.Marshal(chunk)
+		Expect(err).NotTo(HaveOccurred())
+		out.Write(data)
+		out.WriteByte('\n')
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"llm-balancer/openai"
+	"mime"
+	"path/filepath"
+	"strings"
+)
+
+// Helpers shared by the clients translating OpenAI requests into the format
+// of their provider.
+
+// messageText joins the text parts of a message.
+func messageText(message openai.Message) (string, error) {
+	parts, err := message.ContentParts()
+	if err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	for _, part := range parts {
+		switch part.Type {
+		case "text":
+			text.WriteString(part.Text)
+		case "refusal":
+			text.WriteString(part.Refusal)
+		default:
+			return "", fmt.Errorf("unsupported content part type %q for a %s message", part.Type, message.Role)
+		}
+	}
+	return text.String(), nil
+}
+
+// toolInput returns the arguments of a tool call as a JSON object, they are
+// usually a JSON encoded string.
+func toolInput(arguments any) json.RawMessage {
+	if raw, ok := arguments.(json.RawMessage); ok {
+		arguments = string(raw)
+	}
+	if s, ok := arguments.(string); ok {
+		if strings.TrimSpace(s) == "" || !json.Valid([]byte(s)) {
+			return json.RawMessage("{}")
+		}
+		return json.RawMessage(s)
+	}
+	if arguments == nil {
+		return json.RawMessage("{}")
+	}
+	data, err := json.Marshal(arguments)
+	if err != nil {
+		return json.RawMessage("{}")
+	}
+	return data
+}
+
+// stopSequences reads the stop field, a string or a list of strings.
+func stopSequences(stop any) ([]string, error) {
+	switch v := stop.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []string:
+		return v, nil
+	case []any:
+		stops := make([]string, 0, len(v))
+		for _, s := range v {
+			str, ok := s.(string)
+			if !ok {
+				return nil, fmt.Errorf("unsupported stop type: %T", s)
+			}
+			stops = append(stops, str)
+		}
+		return stops, nil
+	}
+	return nil, fmt.Errorf("unsupported stop type: %T", stop)
+}
+
+// parseDataURL splits a base64 data URL into its media type and data.
+func parseDataURL(url string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(url, "data:")
+	if !ok {
+		return "", "", false
+	}
+	meta, data, ok := strings.Cut(rest, ",")
+	if !ok {
+		return "", "", false
+	}
+	mediaType, ok := strings.CutSuffix(meta, ";base64")
+	if !ok {
+		return "", "", false
+	}
+	return mediaType, data, true
+}
+
+// fileData returns the media type and base64 data of a file part. The data
+// is usually a data URL, the type of plain base64 data is guessed from the
+// file name.
+func fileData(file *openai.File) (string, string, error) {
+	if file == nil {
+		return "", "", fmt.Errorf("file part without a file")
+	}
+	if file.FileData == "" {
+		if file.FileID != "" {
+			return "", "", fmt.Errorf("file ids are only known to the provider they were uploaded to, send file_data instead")
+		}
+		return "", "", fmt.Errorf("file part without file_data")
+	}
+	if mediaType, data, ok := parseDataURL(file.FileData); ok {
+		return mediaType, data, nil
+	}
+	mediaType := mime.TypeByExtension(filepath.Ext(file.Filename))
+	if mediaType == "" {
+		return "", "", fmt.Errorf("file_data must be a data URL or come with a filename that tells its type")
+	}
+	mediaType, _, _ = strings.Cut(mediaType, ";")
+	return mediaType, file.FileData, nil
+}
+
+// audioMediaType returns the media type of an input_audio format.
+func audioMediaType(format string) string {
+	switch format {
+	case "mp3":
+		return "audio/mp3"
+	case "":
+		return "audio/wav"
+	}
+	return "audio/" + format
+}
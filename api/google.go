@@ -3,28 +3,38 @@ package api
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"llm-balancer/openai"
+	"net"
 	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
 )
 
 type (
 	GoogleClient struct {
 		BaseURL string
 		APIKey  string
+		// ImageClient downloads the remote images of a request, nil uses a
+		// client that refuses loopback, link-local and private addresses.
+		ImageClient *http.Client
 	}
 
 	// Request represents a request to the Google API.
 	GeminiRequest struct {
-		SystemInstructions GeminiSystemInstruction `json:"system_instruction"`
-		Contents           []GeminiMessage         `json:"contents"`
-		Tools              []GeminiTool            `json:"tools,omitempty"`
-		GenerationConfig   *GenerationConfig       `json:"generationConfig,omitempty"`
+		SystemInstructions *GeminiSystemInstruction `json:"system_instruction,omitempty"`
+		Contents           []GeminiMessage          `json:"contents"`
+		Tools              []GeminiTool             `json:"tools,omitempty"`
+		GenerationConfig   *GenerationConfig        `json:"generationConfig,omitempty"`
 	}
 
 	GeminiMessage struct {
@@ -37,10 +47,11 @@ type (
 	}
 
 	GeminiPart struct {
-		Text         string              `json:"text,omitempty"`
-		InlineData   *GeminiPartInline   `json:"inline_data,omitempty"`
-		FunctionCall *GeminiFunctionCall `json:"functionCall,omitempty"`
-		Thought      string              `json:"thought,omitempty"`
+		Text             string                  `json:"text,omitempty"`
+		InlineData       *GeminiPartInline       `json:"inline_data,omitempty"`
+		FunctionCall     *GeminiFunctionCall     `json:"functionCall,omitempty"`
+		FunctionResponse *GeminiFunctionResponse `json:"functionResponse,omitempty"`
+		Thought          string                  `json:"thought,omitempty"`
 	}
 	GeminiPartInline struct {
 		MimeType string `json:"mime_type"`
@@ -49,14 +60,14 @@ type (
 
 	// GenerationConfig represents the generation configuration for the Google API.
 	GenerationConfig struct {
-		ResponseMimeType string           `json:"responseMimeType,omitempty"`
-		ResponseSchema   GeminiJSONSchema `json:"responseSchema,omitempty"`
-		ThinkingConfig   *ThinkingConfig  `json:"thinkingConfig,omitempty"`
-		StopSequences    []string         `json:"stopSequences,omitempty"`
-		Temperature      *float64         `json:"temperature,omitempty"`
-		MaxOutputTokens  *int             `json:"maxOutputTokens,omitempty"`
-		TopP             *float64         `json:"topP,omitempty"`
-		TopK             *int             `json:"topK,omitempty"`
+		ResponseMimeType string            `json:"responseMimeType,omitempty"`
+		ResponseSchema   *GeminiJSONSchema `json:"responseSchema,omitempty"`
+		ThinkingConfig   *ThinkingConfig   `json:"thinkingConfig,omitempty"`
+		StopSequences    []string          `json:"stopSequences,omitempty"`
+		Temperature      *float64          `json:"temperature,omitempty"`
+		MaxOutputTokens  *int              `json:"maxOutputTokens,omitempty"`
+		TopP             *float64          `json:"topP,omitempty"`
+		TopK             *int              `json:"topK,omitempty"`
 	}
 
 	// ThinkingConfig represents the thinking configuration for the Google API.
@@ -90,7 +101,9 @@ type (
 	}
 
 	GeminiCandidate struct {
-		Content GeminiContent `json:"content"`
+		Content      GeminiContent `json:"content"`
+		FinishReason string        `json:"finishReason,omitempty"`
+		Index        int           `json:"index"`
 	}
 
 	GeminiFunctionCall struct {
@@ -98,6 +111,12 @@ type (
 		Args map[string]interface{} `json:"args"`
 	}
 
+	// GeminiFunctionResponse is the result of a function call sent back to the model.
+	GeminiFunctionResponse struct {
+		Name     string         `json:"name"`
+		Response map[string]any `json:"response"`
+	}
+
 	GeminiUsageMetadata struct {
 		CandidatesTokenCount int `json:"candidatesTokenCount"`
 		PromptTokenCount     int `json:"promptTokenCount"`
@@ -124,9 +143,14 @@ func NewGoogleClient(baseURL string, apiKey string) *GoogleClient {
 // POSTChatCompletion sends a chat completion request to the Google API.
 func (c *GoogleClient) POSTChatCompletion(ctx context.Context, request *Request, model string) (*Response, error) {
 	// Prepare the request URL
+	stream := request.Request.Stream != nil && *request.Request.Stream
 	url := fmt.Sprintf("%s/models/%s:generateContent", c.BaseURL, model)
+	if stream {
+		url = fmt.Sprintf("%s/models/%s:streamGenerateContent", c.BaseURL, model)
+	}
 
-	geminiRequest, err := geminiRequestFromOpenAIRequest(request.Request)
+	images := func(url string) (*GeminiPartInline, error) { return c.inlineImage(ctx, request, url) }
+	geminiRequest, err := geminiRequestFromOpenAIRequest(request.Request, images)
 	if err != nil {
 		return nil, fmt.Errorf("error converting OpenAI request to Gemini request: %v", err)
 	}
@@ -148,6 +172,9 @@ func (c *GoogleClient) POSTChatCompletion(ctx context.Context, request *Request,
 	// For Gemini, the API key is usually included as a query parameter
 	q := req.URL.Query()
 	q.Add("key", c.APIKey)
+	if stream {
+		q.Add("alt", "sse")
+	}
 	req.URL.RawQuery = q.Encode()
 	req = req.WithContext(ctx)
 
@@ -157,6 +184,12 @@ func (c *GoogleClient) POSTChatCompletion(ctx context.Context, request *Request,
 	if err != nil {
 		return nil, fmt.Errorf("error making Gemini request: %w", err)
 	}
+
+	// hand the open body to the caller, it is closed through Stream.Close
+	rateLimit := ParseRateLimit(resp.Header)
+	if stream && resp.StatusCode == http.StatusOK {
+		return &Response{Stream: newGeminiStream(resp.Body), RateLimit: rateLimit}, nil
+	}
 	defer func() { _ = resp.Body.Close() }()
 
 	// Read the response body
@@ -167,10 +200,10 @@ func (c *GoogleClient) POSTChatCompletion(ctx context.Context, request *Request,
 
 	// Check if the response is successful
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("gemini API request failed with status %d: %s", resp.StatusCode, string(body))
+		return nil, &StatusError{Provider: "gemini", StatusCode: resp.StatusCode, Body: string(body), RateLimit: rateLimit}
 	}
 
-	fmt.Println("Gemini response: ", string(body))
+	log.Trace().Str("provider", "gemini").Bytes("body", body).Msg("Upstream response")
 
 	// Parse the response
 	var geminiResp GeminiResponse
@@ -183,51 +216,153 @@ func (c *GoogleClient) POSTChatCompletion(ctx context.Context, request *Request,
 		return nil, fmt.Errorf("gemini API returned error: %s", geminiResp.Error.Message)
 	}
 
-	b, err := json.MarshalIndent(geminiResp, "", "  ")
-	if err != nil {
-		return nil, fmt.Errorf("error marshalling Gemini response: %w", err)
-	}
-	fmt.Println("Gemini response: ", string(b))
-
 	// Check if we have candidates
 	if len(geminiResp.Candidates) == 0 {
 		return nil, fmt.Errorf("gemini API returned no candidates")
 	}
 
-	fmt.Println("Gemini response: ", geminiResp.Candidates)
-
 	// Convert the Gemini response to OpenAI response
 	response, err := openAIResponseFromGeminiResponse(&geminiResp)
 	if err != nil {
 		return nil, fmt.Errorf("error converting Gemini response to OpenAI response: %v", err)
 	}
-	return &Response{Response: response, Error: nil}, nil
+	return &Response{Response: response, RateLimit: rateLimit, Error: nil}, nil
+}
+
+// ListModels returns the names of the models available to the API key,
+// without the "models/" prefix the API puts in front of them.
+func (c *GoogleClient) ListModels(ctx context.Context) ([]string, error) {
+	var models []string
+	pageToken := ""
+	for {
+		req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/models", nil)
+		if err != nil {
+			return nil, err
+		}
+		q := req.URL.Query()
+		q.Add("key", c.APIKey)
+		q.Add("pageSize", "1000")
+		if pageToken != "" {
+			q.Add("pageToken", pageToken)
+		}
+		req.URL.RawQuery = q.Encode()
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error listing Gemini models: %w", err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading Gemini model list: %w", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, &StatusError{Provider: "gemini", StatusCode: resp.StatusCode, Body: string(body)}
+		}
+
+		var list struct {
+			Models []struct {
+				Name string `json:"name"`
+			} `json:"models"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(body, &list); err != nil {
+			return nil, fmt.Errorf("error unmarshaling Gemini model list: %w", err)
+		}
+		for _, m := range list.Models {
+			models = append(models, strings.TrimPrefix(m.Name, "models/"))
+		}
+		if list.NextPageToken == "" {
+			return models, nil
+		}
+		pageToken = list.NextPageToken
+	}
 }
 
-// Convert OpenAI request to Gemini request
-func geminiRequestFromOpenAIRequest(request *openai.ChatCompletionRequest) (*GeminiRequest, error) {
+// Convert OpenAI request to Gemini request. System and developer messages
+// are joined into the system instruction, assistant messages become model
+// turns with functionCall parts and tool results functionResponse parts,
+// named after the call they answer. Consecutive turns of the same role are
+// merged, Gemini expects the responses to parallel calls in a single turn.
+func geminiRequestFromOpenAIRequest(request *openai.ChatCompletionRequest, images func(url string) (*GeminiPartInline, error)) (*GeminiRequest, error) {
 	if request == nil {
 		return nil, fmt.Errorf("request is nil")
 	}
 
 	// Iterate through messages and convert them to Gemini format
-	var systemInstructions GeminiPart
+	var system []string
 	var contents []GeminiMessage
 	var tools []GeminiTool
-
-	for _, message := range request.Messages {
-		if message.Role == "system" {
-			if content, ok := message.Content.(string); ok {
-				systemInstructions = GeminiPart{Text: content}
+	toolNames := make(map[string]string)
+
+	for i, message := range request.Messages {
+		var role string
+		var parts []GeminiPart
+		switch message.Role {
+		case "system", "developer":
+			text, err := messageText(message)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
 			}
-		} else {
-			if content, ok := message.Content.(string); ok {
-				contents = append(contents, GeminiMessage{
-					Role:  message.Role,
-					Parts: []GeminiPart{{Text: content}},
-				})
+			system = append(system, text)
+			continue
+		case "user":
+			role = "user"
+			contentParts, err := message.ContentParts()
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			for _, part := range contentParts {
+				geminiPart, err := geminiPartFromContentPart(part, images)
+				if err != nil {
+					return nil, fmt.Errorf("message %d: %w", i, err)
+				}
+				parts = append(parts, geminiPart)
+			}
+		case "assistant":
+			role = "model"
+			text, err := messageText(message)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			if text != "" {
+				parts = append(parts, GeminiPart{Text: text})
+			}
+			for _, call := range message.ToolCalls {
+				var args map[string]any
+				if err := json.Unmarshal(toolInput(call.Function.Arguments), &args); err != nil {
+					return nil, fmt.Errorf("message %d: arguments of %s: %w", i, call.Function.Name, err)
+				}
+				toolNames[call.ID] = call.Function.Name
+				parts = append(parts, GeminiPart{FunctionCall: &GeminiFunctionCall{Name: call.Function.Name, Args: args}})
 			}
+		case "tool":
+			role = "user"
+			name, ok := toolNames[message.ToolCallID]
+			if !ok {
+				name = message.Name
+			}
+			if name == "" {
+				return nil, fmt.Errorf("message %d: no tool call with id %q", i, message.ToolCallID)
+			}
+			text, err := messageText(message)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: %w", i, err)
+			}
+			parts = append(parts, GeminiPart{FunctionResponse: &GeminiFunctionResponse{Name: name, Response: functionResponse(text)}})
+		default:
+			return nil, fmt.Errorf("message %d: unsupported role %q", i, message.Role)
 		}
+
+		// Gemini rejects turns without parts
+		if len(parts) == 0 {
+			continue
+		}
+		if n := len(contents); n > 0 && contents[n-1].Role == role {
+			contents[n-1].Parts = append(contents[n-1].Parts, parts...)
+			continue
+		}
+		contents = append(contents, GeminiMessage{Role: role, Parts: parts})
 	}
 
 	if request.Tools != nil {
@@ -235,22 +370,15 @@ func geminiRequestFromOpenAIRequest(request *openai.ChatCompletionRequest) (*Gem
 	}
 
 	// Set the generation config if provided
-	stops := make([]string, 0)
-	if request.Stop != nil {
-		switch v := request.Stop.(type) {
-		case string:
-			stops = append(stops, v)
-		case []string:
-			stops = append(stops, v...)
-		default:
-			return nil, fmt.Errorf("unsupported stop type: %T", v)
-		}
+	stops, err := stopSequences(request.Stop)
+	if err != nil {
+		return nil, err
 	}
 
 	config := &GenerationConfig{
 		StopSequences:   stops,
 		Temperature:     request.Temperature,
-		MaxOutputTokens: request.MaxCompletionTokens,
+		MaxOutputTokens: request.MaxOutputTokens(),
 		TopP:            request.TopP,
 	}
 
@@ -260,23 +388,161 @@ func geminiRequestFromOpenAIRequest(request *openai.ChatCompletionRequest) (*Gem
 		if schema != nil {
 			// delete(schema, "additionalProperties")
 			config.ResponseMimeType = "application/json"
-			geminiSchema := NewGeminiJSONSchema(schema)
-			if geminiSchema != nil {
-				config.ResponseSchema = *geminiSchema
-			}
+			config.ResponseSchema = NewGeminiJSONSchema(schema)
 		}
 	}
 
 	geminiReq := &GeminiRequest{
-		SystemInstructions: GeminiSystemInstruction{Parts: []GeminiPart{systemInstructions}},
-		Contents:           contents,
-		GenerationConfig:   config,
-		Tools:              tools,
+		Contents:         contents,
+		GenerationConfig: config,
+		Tools:            tools,
+	}
+	if len(system) > 0 {
+		geminiReq.SystemInstructions = &GeminiSystemInstruction{Parts: []GeminiPart{{Text: strings.Join(system, "\n\n")}}}
 	}
 
 	return geminiReq, nil
 }
 
+// geminiPartFromContentPart converts a content part of a user message. Images,
+// audio and files are sent as inline data, remote images are resolved by
+// images.
+func geminiPartFromContentPart(part openai.ContentPart, images func(url string) (*GeminiPartInline, error)) (GeminiPart, error) {
+	switch part.Type {
+	case "text":
+		return GeminiPart{Text: part.Text}, nil
+	case "image_url":
+		if part.ImageURL == nil || part.ImageURL.URL == "" {
+			return GeminiPart{}, fmt.Errorf("image_url part without a url")
+		}
+		if mediaType, data, ok := parseDataURL(part.ImageURL.URL); ok {
+			return GeminiPart{InlineData: &GeminiPartInline{MimeType: mediaType, Data: data}}, nil
+		}
+		inline, err := images(part.ImageURL.URL)
+		if err != nil {
+			return GeminiPart{}, err
+		}
+		return GeminiPart{InlineData: inline}, nil
+	case "input_audio":
+		if part.InputAudio == nil || part.InputAudio.Data == "" {
+			return GeminiPart{}, fmt.Errorf("input_audio part without data")
+		}
+		return GeminiPart{InlineData: &GeminiPartInline{MimeType: audioMediaType(part.InputAudio.Format), Data: part.InputAudio.Data}}, nil
+	case "file":
+		mediaType, data, err := fileData(part.File)
+		if err != nil {
+			return GeminiPart{}, err
+		}
+		return GeminiPart{InlineData: &GeminiPartInline{MimeType: mediaType, Data: data}}, nil
+	}
+	return GeminiPart{}, fmt.Errorf("unsupported content part type %q", part.Type)
+}
+
+// maxInlineBytes bounds the size of a downloaded image, Gemini rejects
+// requests over 20MB anyway.
+const maxInlineBytes = 20 << 20
+
+// imageClient downloads remote images unless a GoogleClient has its own. The
+// URLs come from clients, so it only dials public addresses: a request must
+// not reach the services next to the balancer. It ignores proxies, which
+// would dial for it.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext:         (&net.Dialer{Timeout: 10 * time.Second, Control: refusePrivateAddress}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+}
+
+// sharedAddressSpace is 100.64.0.0/10, the carrier-grade NAT range some
+// clouds route internal services through. netip.Addr.IsPrivate leaves it out.
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// refusePrivateAddress is a net.Dialer Control refusing loopback, link-local,
+// private, shared and unspecified addresses. It runs after name resolution,
+// for every address dialed, redirects included.
+func refusePrivateAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() || sharedAddressSpace.Contains(ip) {
+		return fmt.Errorf("address %s is not public", ip)
+	}
+	return nil
+}
+
+// inlineImage returns the remote image at url as inline data. The result is
+// kept on the request, so retries on other Gemini models don't download it
+// again.
+func (c *GoogleClient) inlineImage(ctx context.Context, request *Request, url string) (*GeminiPartInline, error) {
+	if image, ok := request.images[url]; ok {
+		return image.inline, image.err
+	}
+	client := c.ImageClient
+	if client == nil {
+		client = imageClient
+	}
+	inline, err := fetchInline(ctx, client, url)
+	if request.images == nil {
+		request.images = make(map[string]inlineImage)
+	}
+	request.images[url] = inlineImage{inline: inline, err: err}
+	return inline, err
+}
+
+// fetchInline downloads a remote image for Gemini, which only accepts the
+// URIs of its own file storage.
+func fetchInline(ctx context.Context, client *http.Client, imageURL string) (*GeminiPartInline, error) {
+	u, err := url.Parse(imageURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid image url: scheme %q is not http or https", u.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image url: %w", err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error downloading image: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading image %s: status code %d", imageURL, resp.StatusCode)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxInlineBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error downloading image: %w", err)
+	}
+	if len(data) > maxInlineBytes {
+		return nil, fmt.Errorf("image %s is larger than %d bytes", imageURL, maxInlineBytes)
+	}
+	mediaType, _, _ := strings.Cut(resp.Header.Get("Content-Type"), ";")
+	if mediaType == "" || mediaType == "application/octet-stream" {
+		mediaType = http.DetectContentType(data)
+	}
+	return &GeminiPartInline{MimeType: strings.TrimSpace(mediaType), Data: base64.StdEncoding.EncodeToString(data)}, nil
+}
+
+// functionResponse wraps the result of a tool call in the object Gemini
+// expects, results that are JSON objects are sent as they are.
+func functionResponse(result string) map[string]any {
+	var object map[string]any
+	if err := json.Unmarshal([]byte(result), &object); err == nil && object != nil {
+		return object
+	}
+	return map[string]any{"content": result}
+}
+
 func geminiToolsFromOpenAIRequest(tools []openai.Tool) []GeminiTool {
 	geminiTools := make([]GeminiTool, 0)
 	for _, tool := range tools {
@@ -301,11 +567,7 @@ func openAIResponseFromGeminiResponse(geminiResp *GeminiResponse) (*openai.ChatC
 		Object:            "chat.completion",
 		ServiceTier:       nil,
 		SystemFingerprint: geminiResp.ModelVersion,
-		Usage: openai.Usage{
-			PromptTokens:     geminiResp.UsageMetadata.PromptTokenCount,
-			CompletionTokens: geminiResp.UsageMetadata.CandidatesTokenCount,
-			TotalTokens:      geminiResp.UsageMetadata.TotalTokenCount,
-		},
+		Usage:             openAIUsageFromGeminiUsage(geminiResp.UsageMetadata),
 	}
 
 	// Convert Gemini response to OpenAI response
@@ -320,22 +582,29 @@ func openAIResponseFromGeminiResponse(geminiResp *GeminiResponse) (*openai.ChatC
 				content = &part.Text
 			}
 			if part.FunctionCall != nil {
+				args, err := json.Marshal(part.FunctionCall.Args)
+				if err != nil {
+					args = []byte("{}")
+				}
+				// Gemini calls have no ids, tool results are matched to them by id
 				toolCalls = append(toolCalls, openai.ToolCall{
+					ID:   "call_" + uuid.New().String(),
+					Type: "function",
 					Function: openai.FunctionCall{
 						Name:      part.FunctionCall.Name,
-						Arguments: part.FunctionCall.Args,
+						Arguments: string(args),
 					},
 				})
 			}
 		}
 
 		choices = append(choices, openai.Choice{
-			FinishReason: candidate.Content.FinishReason,
-			Index:        candidate.Content.Index,
+			FinishReason: openAIFinishReason(candidate.FinishReason, len(toolCalls) > 0),
+			Index:        candidate.Index,
 			Message: openai.CompletionMessage{
 				Content:   content,
 				ToolCalls: toolCalls,
-				Role:      candidate.Content.Role,
+				Role:      "assistant",
 			},
 		})
 	}
@@ -346,6 +615,166 @@ func openAIResponseFromGeminiResponse(geminiResp *GeminiResponse) (*openai.ChatC
 
 }
 
+// geminiStream translates a streamGenerateContent SSE body into OpenAI
+// chat.completion.chunk events. Gemini reports cumulative usage on every
+// event, the last one seen is emitted as a final usage chunk.
+type geminiStream struct {
+	body    io.ReadCloser
+	sse     *sseReader
+	id      string
+	created int
+	model   string
+	usage   *GeminiUsageMetadata
+	pending []*openai.ChatCompletionChunk
+	done    bool
+
+	started   map[int]bool // candidates that already sent their role
+	toolCalls map[int]int  // number of tool calls emitted per candidate
+}
+
+func newGeminiStream(body io.ReadCloser) *geminiStream {
+	return &geminiStream{
+		body:      body,
+		sse:       newSSEReader(body),
+		id:        uuid.New().String(),
+		created:   int(time.Now().Unix()),
+		started:   make(map[int]bool),
+		toolCalls: make(map[int]int),
+	}
+}
+
+func (s *geminiStream) Recv() (*openai.ChatCompletionChunk, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return nil, io.EOF
+		}
+
+		_, data, err := s.sse.Next()
+		if err == io.EOF {
+			s.done = true
+			if s.usage != nil {
+				usage := openAIUsageFromGeminiUsage(*s.usage)
+				chunk := s.newChunk()
+				chunk.Choices = []openai.ChunkChoice{}
+				chunk.Usage = &usage
+				s.pending = append(s.pending, chunk)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var geminiResp GeminiResponse
+		if err := json.Unmarshal(data, &geminiResp); err != nil {
+			return nil, fmt.Errorf("error unmarshaling Gemini stream event: %w", err)
+		}
+		if geminiResp.Error != nil {
+			return nil, fmt.Errorf("gemini API returned error: %s", geminiResp.Error.Message)
+		}
+		if geminiResp.ModelVersion != "" {
+			s.model = geminiResp.ModelVersion
+		}
+		if geminiResp.UsageMetadata.TotalTokenCount > 0 {
+			usage := geminiResp.UsageMetadata
+			s.usage = &usage
+		}
+		if chunk := s.chunkFromGeminiResponse(&geminiResp); chunk != nil {
+			s.pending = append(s.pending, chunk)
+		}
+	}
+
+	chunk := s.pending[0]
+	s.pending = s.pending[1:]
+	return chunk, nil
+}
+
+func (s *geminiStream) Close() error {
+	return s.body.Close()
+}
+
+func (s *geminiStream) newChunk() *openai.ChatCompletionChunk {
+	return &openai.ChatCompletionChunk{
+		ID:                s.id,
+		Created:           s.created,
+		Model:             s.model,
+		Object:            "chat.completion.chunk",
+		SystemFingerprint: s.model,
+	}
+}
+
+// chunkFromGeminiResponse converts the partial candidates of one stream event
+// into a chunk of deltas, nil when the event carries no candidate.
+func (s *geminiStream) chunkFromGeminiResponse(geminiResp *GeminiResponse) *openai.ChatCompletionChunk {
+	if len(geminiResp.Candidates) == 0 {
+		return nil
+	}
+
+	chunk := s.newChunk()
+	for _, candidate := range geminiResp.Candidates {
+		choice := openai.ChunkChoice{Index: candidate.Index}
+		if !s.started[candidate.Index] {
+			choice.Delta.Role = "assistant"
+			s.started[candidate.Index] = true
+		}
+
+		var text string
+		for _, part := range candidate.Content.Parts {
+			text += part.Text
+			if part.FunctionCall != nil {
+				args, err := json.Marshal(part.FunctionCall.Args)
+				if err != nil {
+					args = []byte("{}")
+				}
+				choice.Delta.ToolCalls = append(choice.Delta.ToolCalls, openai.ToolCallDelta{
+					Index: s.toolCalls[candidate.Index],
+					ID:    "call_" + uuid.New().String(),
+					Type:  "function",
+					Function: openai.FunctionCallDelta{
+						Name:      part.FunctionCall.Name,
+						Arguments: string(args),
+					},
+				})
+				s.toolCalls[candidate.Index]++
+			}
+		}
+		if text != "" {
+			choice.Delta.Content = &text
+		}
+
+		if candidate.FinishReason != "" {
+			reason := openAIFinishReason(candidate.FinishReason, s.toolCalls[candidate.Index] > 0)
+			choice.FinishReason = &reason
+		}
+		chunk.Choices = append(chunk.Choices, choice)
+	}
+	return chunk
+}
+
+func openAIUsageFromGeminiUsage(usage GeminiUsageMetadata) openai.Usage {
+	return openai.Usage{
+		PromptTokens:     usage.PromptTokenCount,
+		CompletionTokens: usage.CandidatesTokenCount,
+		TotalTokens:      usage.TotalTokenCount,
+	}
+}
+
+// openAIFinishReason maps a Gemini finishReason onto the OpenAI vocabulary.
+func openAIFinishReason(reason string, toolCalls bool) string {
+	switch reason {
+	case "":
+		return ""
+	case "MAX_TOKENS":
+		return "length"
+	case "SAFETY", "RECITATION", "BLOCKLIST", "PROHIBITED_CONTENT", "SPII", "IMAGE_SAFETY":
+		return "content_filter"
+	}
+	if toolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
 // potentially do: toOpenAIResponse and fromOpenAIResponse as functions that take an openai.ChatCompletionRequest
 // and return a google compatible request and similary for the response
 
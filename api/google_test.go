@@ -0,0 +1,186 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+
+	"llm-balancer/api"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+const geminiStream = `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]},"index":0}],"modelVersion":"gemini-test"}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"lookup","args":{"q":"x"}}}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":3,"totalTokenCount":7},"modelVersion":"gemini-test"}
+
+`
+
+var _ = Describe("GoogleClient", func() {
+	var (
+		server *ghttp.Server
+		client *api.GoogleClient
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		client = api.NewGoogleClient(server.URL(), "test-key")
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("translates streamed candidates into chat.completion.chunk deltas", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/models/gemini-test:streamGenerateContent", "alt=sse&key=test-key"),
+			ghttp.RespondWith(http.StatusOK, geminiStream, http.Header{"Content-Type": {"text/event-stream"}}),
+		))
+
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(`{"stream":true,"messages":[{"role":"user","content":"hi"}]}`), "gemini-test")
+		Expect(err).NotTo(HaveOccurred())
+		out := drain(resp.Stream)
+		Expect(out).To(ContainSubstring(`"object":"chat.completion.chunk"`))
+		Expect(out).To(ContainSubstring(`"delta":{"content":"Hel","role":"assistant"}`))
+		Expect(out).To(ContainSubstring(`"function":{"arguments":"{\"q\":\"x\"}","name":"lookup"}`))
+		Expect(out).To(ContainSubstring(`"finish_reason":"tool_calls"`))
+		Expect(out).To(ContainSubstring(`"usage":{"completion_tokens":3,"prompt_tokens":4,"total_tokens":7}`))
+	})
+
+	It("sends the turns, calls and results of a tool loop the way Gemini expects them", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/models/gemini-test:generateContent"),
+			ghttp.VerifyJSONRepresenting(map[string]any{
+				"system_instruction": map[string]any{"parts": []map[string]any{{"text": "Be brief.\n\nUse the tools."}}},
+				"contents": []map[string]any{
+					{"role": "user", "parts": []map[string]any{{"text": "Weather in "}, {"text": "Paris and Rome?"}}},
+					{"role": "model", "parts": []map[string]any{
+						{"functionCall": map[string]any{"name": "weather", "args": map[string]any{"city": "Paris"}}},
+						{"functionCall": map[string]any{"name": "weather", "args": map[string]any{"city": "Rome"}}},
+					}},
+					{"role": "user", "parts": []map[string]any{
+						{"functionResponse": map[string]any{"name": "weather", "response": map[string]any{"temp": 21}}},
+						{"functionResponse": map[string]any{"name": "weather", "response": map[string]any{"content": "sunny"}}},
+					}},
+				},
+				"generationConfig": map[string]any{"stopSequences": []string{"END"}},
+			}),
+			ghttp.RespondWith(http.StatusOK, `{"candidates":[{"content":{"role":"model","parts":[
+				{"functionCall":{"name":"weather","args":{"city":"Oslo"}}}]},"finishReason":"STOP","index":0}],
+				"usageMetadata":{"promptTokenCount":30,"candidatesTokenCount":5,"totalTokenCount":35},"modelVersion":"gemini-test"}`),
+		))
+
+		body := `{"stop":["END"],"messages":[
+			{"role":"system","content":"Be brief."},
+			{"role":"developer","content":[{"type":"text","text":"Use the tools."}]},
+			{"role":"user","content":[{"type":"text","text":"Weather in "},{"type":"text","text":"Paris and Rome?"}]},
+			{"role":"assistant","content":null,"tool_calls":[
+				{"id":"call_1","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Paris\"}"}},
+				{"id":"call_2","type":"function","function":{"name":"weather","arguments":"{\"city\":\"Rome\"}"}}
+			]},
+			{"role":"tool","tool_call_id":"call_1","content":"{\"temp\":21}"},
+			{"role":"tool","tool_call_id":"call_2","content":"sunny"}
+		]}`
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "gemini-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Response.Choices[0].FinishReason).To(Equal("tool_calls"))
+		call := resp.Response.Choices[0].Message.ToolCalls[0]
+		Expect(call.ID).To(HavePrefix("call_"))
+		Expect(call.Type).To(Equal("function"))
+		Expect(call.Function.Arguments).To(MatchJSON(`{"city":"Oslo"}`))
+		Expect(resp.Response.Usage.TotalTokens).To(Equal(35))
+	})
+
+	It("sends images, audio and files as inline data", func() {
+		// the test server listens on loopback, which the default client refuses
+		client.ImageClient = server.HTTPTestServer.Client()
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/cat.png"),
+				ghttp.RespondWith(http.StatusOK, "png bytes", http.Header{"Content-Type": {"image/png"}}),
+			),
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/models/gemini-test:generateContent"),
+				ghttp.VerifyJSONRepresenting(map[string]any{
+					"contents": []map[string]any{{"role": "user", "parts": []map[string]any{
+						{"text": "Compare these."},
+						{"inline_data": map[string]any{"mime_type": "image/jpeg", "data": "anBn"}},
+						{"inline_data": map[string]any{"mime_type": "image/png", "data": "cG5nIGJ5dGVz"}},
+						{"inline_data": map[string]any{"mime_type": "audio/mp3", "data": "bXAz"}},
+						{"inline_data": map[string]any{"mime_type": "application/pdf", "data": "cGRm"}},
+					}}},
+					"generationConfig": map[string]any{},
+				}),
+				ghttp.RespondWith(http.StatusOK, `{"candidates":[{"content":{"role":"model","parts":[{"text":"Same."}]},"finishReason":"STOP","index":0}],"modelVersion":"gemini-test"}`),
+			),
+		)
+
+		body := `{"messages":[{"role":"user","content":[
+			{"type":"text","text":"Compare these."},
+			{"type":"image_url","image_url":{"url":"data:image/jpeg;base64,anBn"}},
+			{"type":"image_url","image_url":{"url":"` + server.URL() + `/cat.png"}},
+			{"type":"input_audio","input_audio":{"data":"bXAz","format":"mp3"}},
+			{"type":"file","file":{"filename":"report.pdf","file_data":"data:application/pdf;base64,cGRm"}}
+		]}]}`
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "gemini-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Response.Choices[0].Message.Content).To(HaveValue(Equal("Same.")))
+	})
+
+	It("refuses to download images from loopback addresses", func() {
+		body := `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"` + server.URL() + `/cat.png"}}]}]}`
+		_, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "gemini-test")
+		Expect(err).To(MatchError(ContainSubstring("is not public")))
+		Expect(server.ReceivedRequests()).To(BeEmpty())
+	})
+
+	DescribeTable("refuses to download images from addresses that are not public",
+		func(imageURL string) {
+			body := `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"` + imageURL + `"}}]}]}`
+			_, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "gemini-test")
+			Expect(err).To(MatchError(ContainSubstring("is not public")))
+		},
+		Entry("loopback", "http://127.0.0.1:1/cat.png"),
+		Entry("IPv6 loopback", "http://[::1]:1/cat.png"),
+		Entry("unspecified", "http://0.0.0.0:1/cat.png"),
+		Entry("private", "http://10.0.0.1:1/cat.png"),
+		Entry("private 192.168", "http://192.168.1.1:1/cat.png"),
+		Entry("link-local metadata", "http://169.254.169.254/latest/meta-data"),
+		Entry("shared address space", "http://100.64.0.1:1/cat.png"),
+		Entry("shared address space end", "http://100.127.255.254:1/cat.png"),
+		Entry("IPv4-mapped private", "http://[::ffff:10.0.0.1]:1/cat.png"),
+	)
+
+	It("only downloads images over http and https", func() {
+		body := `{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"file:///etc/passwd"}}]}]}`
+		_, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "gemini-test")
+		Expect(err).To(MatchError(ContainSubstring(`scheme "file" is not http or https`)))
+	})
+
+	It("downloads a remote image once for all attempts of a request", func() {
+		client.ImageClient = server.HTTPTestServer.Client()
+		server.AppendHandlers(
+			ghttp.CombineHandlers(
+				ghttp.VerifyRequest("GET", "/cat.png"),
+				ghttp.RespondWith(http.StatusOK, "png bytes", http.Header{"Content-Type": {"image/png"}}),
+			),
+			ghttp.RespondWith(http.StatusServiceUnavailable, `{}`),
+			ghttp.RespondWith(http.StatusOK, `{"candidates":[{"content":{"role":"model","parts":[{"text":"A cat."}]},"finishReason":"STOP","index":0}],"modelVersion":"gemini-test"}`),
+		)
+
+		request := chatRequest(`{"messages":[{"role":"user","content":[{"type":"image_url","image_url":{"url":"` + server.URL() + `/cat.png"}}]}]}`)
+		_, err := client.POSTChatCompletion(context.Background(), request, "gemini-test")
+		Expect(err).To(HaveOccurred())
+		_, err = client.POSTChatCompletion(context.Background(), request, "gemini-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.ReceivedRequests()).To(HaveLen(3))
+	})
+
+	It("rejects tool results that answer no call", func() {
+		body := `{"messages":[{"role":"user","content":"hi"},{"role":"tool","tool_call_id":"call_9","content":"x"}]}`
+		_, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "gemini-test")
+		Expect(err).To(MatchError(ContainSubstring(`no tool call with id "call_9"`)))
+		Expect(server.ReceivedRequests()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,475 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"llm-balancer/openai"
+	"maps"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+type (
+	OllamaClient struct {
+		BaseURL string
+		APIKey  string
+		// Options are sent with every request, e.g. num_ctx. Options set by
+		// the request itself, like temperature, take precedence.
+		Options map[string]any
+		// KeepAlive is how long the model stays loaded after a request,
+		// e.g. "10m", or a number of seconds like "-1" for ever. Empty keeps
+		// the server default.
+		KeepAlive string
+	}
+
+	// OllamaRequest represents a request to the /api/chat endpoint.
+	OllamaRequest struct {
+		Model     string          `json:"model"`
+		Messages  []OllamaMessage `json:"messages"`
+		Tools     []openai.Tool   `json:"tools,omitempty"`
+		Format    any             `json:"format,omitempty"` // "json" or a JSON schema
+		Options   map[string]any  `json:"options,omitempty"`
+		Stream    bool            `json:"stream"`
+		KeepAlive any             `json:"keep_alive,omitempty"` // a duration string or seconds
+	}
+
+	OllamaMessage struct {
+		Role      string           `json:"role"`
+		Content   string           `json:"content"`
+		Images    []string         `json:"images,omitempty"` // base64 encoded
+		ToolCalls []OllamaToolCall `json:"tool_calls,omitempty"`
+		ToolName  string           `json:"tool_name,omitempty"` // the tool a tool message answers
+	}
+
+	OllamaToolCall struct {
+		Function OllamaFunctionCall `json:"function"`
+	}
+
+	OllamaFunctionCall struct {
+		Name      string          `json:"name"`
+		Arguments json.RawMessage `json:"arguments"`
+	}
+
+	// OllamaResponse represents a /api/chat response, streams send one per line.
+	OllamaResponse struct {
+		Model           string        `json:"model"`
+		Message         OllamaMessage `json:"message"`
+		Done            bool          `json:"done"`
+		DoneReason      string        `json:"done_reason,omitempty"`
+		PromptEvalCount int           `json:"prompt_eval_count,omitempty"`
+		EvalCount       int           `json:"eval_count,omitempty"`
+		Error           string        `json:"error,omitempty"`
+	}
+)
+
+// ollamaKeepAlive returns keep_alive as Ollama reads it: a number of seconds
+// is sent as a JSON number, since a string needs a unit, anything else as a
+// duration string. Empty is left out.
+func ollamaKeepAlive(value string) any {
+	if value == "" {
+		return nil
+	}
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return json.Number(value)
+	}
+	return value
+}
+
+// NewOllamaClient creates a new Ollama API client. The base URL is the
+// server root, a /v1 suffix of the OpenAI compatible API is removed.
+func NewOllamaClient(baseURL string, apiKey string) *OllamaClient {
+	baseURL = strings.TrimSuffix(strings.TrimSuffix(baseURL, "/"), "/v1")
+	return &OllamaClient{BaseURL: baseURL, APIKey: apiKey}
+}
+
+// POSTChatCompletion sends a chat completion request to the Ollama chat API.
+func (c *OllamaClient) POSTChatCompletion(ctx context.Context, request *Request, model string) (*Response, error) {
+	url := fmt.Sprintf("%s/api/chat", c.BaseURL)
+	stream := request.Request.Stream != nil && *request.Request.Stream
+
+	ollamaRequest, err := ollamaRequestFromOpenAIRequest(request.Request, c.Options)
+	if err != nil {
+		return nil, fmt.Errorf("error converting OpenAI request to Ollama request: %w", err)
+	}
+	ollamaRequest.Model = model
+	ollamaRequest.Stream = stream
+	ollamaRequest.KeepAlive = ollamaKeepAlive(c.KeepAlive)
+
+	jsonBody, err := json.Marshal(ollamaRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.APIKey != "" {
+		// Ollama itself ignores it, proxies in front of it may not
+		req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	}
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making Ollama request: %w", err)
+	}
+
+	// hand the open body to the caller, it is closed through Stream.Close
+	rateLimit := ParseRateLimit(resp.Header)
+	if stream && resp.StatusCode == http.StatusOK {
+		return &Response{Stream: newOllamaStream(resp.Body), RateLimit: rateLimit}, nil
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading Ollama response body: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{Provider: "ollama", StatusCode: resp.StatusCode, Body: string(body), RateLimit: rateLimit}
+	}
+
+	log.Trace().Str("provider", "ollama").Bytes("body", body).Msg("Upstream response")
+
+	var ollamaResp OllamaResponse
+	if err := json.Unmarshal(body, &ollamaResp); err != nil {
+		return nil, fmt.Errorf("error unmarshaling Ollama response: %w", err)
+	}
+	if ollamaResp.Error != "" {
+		return nil, fmt.Errorf("ollama API returned error: %s", ollamaResp.Error)
+	}
+	return &Response{Response: openAIResponseFromOllamaResponse(&ollamaResp), RateLimit: rateLimit}, nil
+}
+
+// ListModels returns the names of the models pulled on the server. Names
+// with the default :latest tag are also listed without it, the way they are
+// usually configured.
+func (c *OllamaClient) ListModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/api/tags", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing Ollama models: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{Provider: "ollama", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var list struct {
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error unmarshaling Ollama model list: %w", err)
+	}
+	models := make([]string, 0, len(list.Models))
+	for _, m := range list.Models {
+		models = append(models, m.Name)
+		if name, ok := strings.CutSuffix(m.Name, ":latest"); ok {
+			models = append(models, name)
+		}
+	}
+	return models, nil
+}
+
+// ollamaRequestFromOpenAIRequest converts an OpenAI request into an Ollama
+// chat request. Sampling parameters go into the options, on top of the
+// client's, and response_format into format.
+func ollamaRequestFromOpenAIRequest(request *openai.ChatCompletionRequest, options map[string]any) (*OllamaRequest, error) {
+	if request == nil {
+		return nil, fmt.Errorf("request is nil")
+	}
+
+	// tool messages name the tool they answer, Ollama has no call ids
+	toolNames := make(map[string]string)
+	var messages []OllamaMessage
+	for i, message := range request.Messages {
+		out := OllamaMessage{Role: message.Role}
+		switch message.Role {
+		case "system", "user", "assistant", "tool":
+		case "developer":
+			out.Role = "system"
+		default:
+			return nil, fmt.Errorf("message %d: unsupported role %q", i, message.Role)
+		}
+
+		parts, err := message.ContentParts()
+		if err != nil {
+			return nil, fmt.Errorf("message %d: %w", i, err)
+		}
+		var text strings.Builder
+		for _, part := range parts {
+			switch part.Type {
+			case "text":
+				text.WriteString(part.Text)
+			case "refusal":
+				text.WriteString(part.Refusal)
+			case "image_url":
+				if part.ImageURL == nil {
+					return nil, fmt.Errorf("message %d: image_url part without a url", i)
+				}
+				_, data, ok := parseDataURL(part.ImageURL.URL)
+				if !ok {
+					return nil, fmt.Errorf("message %d: ollama only accepts images as base64 data URLs", i)
+				}
+				out.Images = append(out.Images, data)
+			default:
+				return nil, fmt.Errorf("message %d: unsupported content part type %q", i, part.Type)
+			}
+		}
+		out.Content = text.String()
+
+		for _, call := range message.ToolCalls {
+			toolNames[call.ID] = call.Function.Name
+			out.ToolCalls = append(out.ToolCalls, OllamaToolCall{Function: OllamaFunctionCall{
+				Name:      call.Function.Name,
+				Arguments: toolInput(call.Function.Arguments),
+			}})
+		}
+		if message.Role == "tool" {
+			out.ToolName = toolNames[message.ToolCallID]
+		}
+		messages = append(messages, out)
+	}
+
+	ollamaReq := &OllamaRequest{
+		Messages: messages,
+		Tools:    request.Tools,
+		Options:  maps.Clone(options),
+	}
+	if ollamaReq.Options == nil {
+		ollamaReq.Options = make(map[string]any)
+	}
+	setOption := func(name string, value any) {
+		ollamaReq.Options[name] = value
+	}
+	if request.Temperature != nil {
+		setOption("temperature", *request.Temperature)
+	}
+	if request.TopP != nil {
+		setOption("top_p", *request.TopP)
+	}
+	if request.Seed != nil {
+		setOption("seed", *request.Seed)
+	}
+	if maxTokens := request.MaxOutputTokens(); maxTokens != nil {
+		setOption("num_predict", *maxTokens)
+	}
+	if request.FrequencyPenalty != nil {
+		setOption("frequency_penalty", *request.FrequencyPenalty)
+	}
+	if request.PresencePenalty != nil {
+		setOption("presence_penalty", *request.PresencePenalty)
+	}
+	stops, err := stopSequences(request.Stop)
+	if err != nil {
+		return nil, err
+	}
+	if len(stops) > 0 {
+		setOption("stop", stops)
+	}
+	if len(ollamaReq.Options) == 0 {
+		ollamaReq.Options = nil
+	}
+
+	if format := request.ResponseFormat; format != nil {
+		switch format.Type {
+		case "json_schema":
+			if format.JSONSchema == nil || format.JSONSchema.Schema == nil {
+				return nil, fmt.Errorf("response_format json_schema without a schema")
+			}
+			ollamaReq.Format = format.JSONSchema.Schema
+		case "json_object":
+			ollamaReq.Format = "json"
+		}
+	}
+
+	return ollamaReq, nil
+}
+
+func openAIResponseFromOllamaResponse(ollamaResp *OllamaResponse) *openai.ChatCompletionResponse {
+	content := ollamaResp.Message.Content
+	toolCalls := openAIToolCallsFromOllama(ollamaResp.Message.ToolCalls)
+	return &openai.ChatCompletionResponse{
+		ID:                uuid.New().String(),
+		Created:           int(time.Now().Unix()),
+		Model:             ollamaResp.Model,
+		Object:            "chat.completion",
+		SystemFingerprint: ollamaResp.Model,
+		Usage:             openAIUsageFromOllamaResponse(ollamaResp),
+		Choices: []openai.Choice{{
+			FinishReason: openAIFinishReasonFromOllama(ollamaResp.DoneReason, len(toolCalls) > 0),
+			Message: openai.CompletionMessage{
+				Content:   &content,
+				ToolCalls: toolCalls,
+				Role:      "assistant",
+			},
+		}},
+	}
+}
+
+// openAIToolCallsFromOllama gives the tool calls ids, Ollama does not.
+func openAIToolCallsFromOllama(calls []OllamaToolCall) []openai.ToolCall {
+	var toolCalls []openai.ToolCall
+	for _, call := range calls {
+		toolCalls = append(toolCalls, openai.ToolCall{
+			ID:   "call_" + uuid.New().String(),
+			Type: "function",
+			Function: openai.FunctionCall{
+				Name:      call.Function.Name,
+				Arguments: string(toolInput(call.Function.Arguments)),
+			},
+		})
+	}
+	return toolCalls
+}
+
+func openAIUsageFromOllamaResponse(ollamaResp *OllamaResponse) openai.Usage {
+	return openai.Usage{
+		PromptTokens:     ollamaResp.PromptEvalCount,
+		CompletionTokens: ollamaResp.EvalCount,
+		TotalTokens:      ollamaResp.PromptEvalCount + ollamaResp.EvalCount,
+	}
+}
+
+// openAIFinishReasonFromOllama maps an Ollama done_reason onto the OpenAI vocabulary.
+func openAIFinishReasonFromOllama(reason string, toolCalls bool) string {
+	if reason == "length" {
+		return "length"
+	}
+	if toolCalls {
+		return "tool_calls"
+	}
+	return "stop"
+}
+
+// ollamaStream translates the newline delimited JSON stream of /api/chat
+// into OpenAI chat.completion.chunk events. The final line carries the
+// done_reason and token counts, it is emitted as a finish and a usage chunk.
+type ollamaStream struct {
+	body      io.ReadCloser
+	reader    *bufio.Reader
+	id        string
+	created   int
+	started   bool
+	toolCalls int
+	pending   []*openai.ChatCompletionChunk
+	done      bool
+}
+
+func newOllamaStream(body io.ReadCloser) *ollamaStream {
+	return &ollamaStream{
+		body:    body,
+		reader:  bufio.NewReader(body),
+		id:      uuid.New().String(),
+		created: int(time.Now().Unix()),
+	}
+}
+
+func (s *ollamaStream) Recv() (*openai.ChatCompletionChunk, error) {
+	for len(s.pending) == 0 {
+		if s.done {
+			return nil, io.EOF
+		}
+
+		line, err := s.reader.ReadBytes('\n')
+		if err == io.EOF && len(bytes.TrimSpace(line)) == 0 {
+			s.done = true
+			continue
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		var ollamaResp OllamaResponse
+		if err := json.Unmarshal(line, &ollamaResp); err != nil {
+			return nil, fmt.Errorf("error unmarshaling Ollama stream line: %w", err)
+		}
+		if ollamaResp.Error != "" {
+			return nil, fmt.Errorf("ollama API returned error: %s", ollamaResp.Error)
+		}
+		s.handle(&ollamaResp)
+	}
+
+	chunk := s.pending[0]
+	s.pending = s.pending[1:]
+	return chunk, nil
+}
+
+func (s *ollamaStream) Close() error {
+	return s.body.Close()
+}
+
+// handle queues the chunks of one stream line.
+func (s *ollamaStream) handle(ollamaResp *OllamaResponse) {
+	choice := openai.ChunkChoice{}
+	if !s.started {
+		choice.Delta.Role = "assistant"
+		s.started = true
+	}
+	if ollamaResp.Message.Content != "" {
+		content := ollamaResp.Message.Content
+		choice.Delta.Content = &content
+	}
+	for _, call := range openAIToolCallsFromOllama(ollamaResp.Message.ToolCalls) {
+		choice.Delta.ToolCalls = append(choice.Delta.ToolCalls, openai.ToolCallDelta{
+			Index: s.toolCalls,
+			ID:    call.ID,
+			Type:  call.Type,
+			Function: openai.FunctionCallDelta{
+				Name:      call.Function.Name,
+				Arguments: call.Function.Arguments.(string),
+			},
+		})
+		s.toolCalls++
+	}
+	if ollamaResp.Done {
+		reason := openAIFinishReasonFromOllama(ollamaResp.DoneReason, s.toolCalls > 0)
+		choice.FinishReason = &reason
+	}
+	if choice.Delta.Role != "" || choice.Delta.Content != nil || choice.Delta.ToolCalls != nil || choice.FinishReason != nil {
+		chunk := s.newChunk(ollamaResp.Model)
+		chunk.Choices = []openai.ChunkChoice{choice}
+		s.pending = append(s.pending, chunk)
+	}
+
+	if ollamaResp.Done {
+		usage := openAIUsageFromOllamaResponse(ollamaResp)
+		chunk := s.newChunk(ollamaResp.Model)
+		chunk.Choices = []openai.ChunkChoice{}
+		chunk.Usage = &usage
+		s.pending = append(s.pending, chunk)
+		s.done = true
+	}
+}
+
+func (s *ollamaStream) newChunk(model string) *openai.ChatCompletionChunk {
+	return &openai.ChatCompletionChunk{
+		ID:                s.id,
+		Created:           s.created,
+		Model:             model,
+		Object:            "chat.completion.chunk",
+		SystemFingerprint: model,
+	}
+}
@@ -0,0 +1,107 @@
+package api_test
+
+import (
+	"context"
+	"net/http"
+
+	"llm-balancer/api"
+	"llm-balancer/openai"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+const ollamaStream = `{"model":"qwen-test","message":{"role":"assistant","content":"Hel"},"done":false}
+{"model":"qwen-test","message":{"role":"assistant","content":"","tool_calls":[{"function":{"name":"lookup","arguments":{"q":"x"}}}]},"done":false}
+{"model":"qwen-test","message":{"role":"assistant","content":""},"done":true,"done_reason":"stop","prompt_eval_count":4,"eval_count":3}
+`
+
+var _ = Describe("OllamaClient", func() {
+	var (
+		server *ghttp.Server
+		client *api.OllamaClient
+	)
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+		client = api.NewOllamaClient(server.URL()+"/v1", "")
+		client.KeepAlive = "10m"
+		client.Options = map[string]any{"num_ctx": 8192, "temperature": 0.5, "num_gpu": 1}
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	It("translates the request and response of the chat API", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/api/chat"),
+			ghttp.VerifyJSONRepresenting(map[string]any{
+				"model":      "qwen-test",
+				"stream":     false,
+				"keep_alive": "10m",
+				"options":    map[string]any{"num_ctx": 8192, "num_gpu": 1, "temperature": 0, "num_predict": 50},
+				"format":     map[string]any{"type": "object", "properties": map[string]any{"city": map[string]any{"type": "string"}}},
+				"messages": []map[string]any{
+					{"role": "system", "content": "Answer in JSON."},
+					{"role": "user", "content": "Where?", "images": []string{"aGk="}},
+					{"role": "assistant", "content": "", "tool_calls": []map[string]any{
+						{"function": map[string]any{"name": "locate", "arguments": map[string]any{"q": "here"}}},
+					}},
+					{"role": "tool", "content": "Paris", "tool_name": "locate"},
+				},
+			}),
+			ghttp.RespondWith(http.StatusOK, `{"model":"qwen-test","message":{"role":"assistant","content":"{\"city\":\"Paris\"}"},
+				"done":true,"done_reason":"stop","prompt_eval_count":20,"eval_count":8}`),
+		))
+
+		body := `{"temperature":0,"max_completion_tokens":50,
+			"response_format":{"type":"json_schema","json_schema":{"name":"place","schema":{"type":"object","properties":{"city":{"type":"string"}}}}},
+			"messages":[
+				{"role":"developer","content":"Answer in JSON."},
+				{"role":"user","content":[{"type":"text","text":"Where?"},{"type":"image_url","image_url":{"url":"data:image/png;base64,aGk="}}]},
+				{"role":"assistant","content":null,"tool_calls":[{"id":"call_0","type":"function","function":{"name":"locate","arguments":"{\"q\":\"here\"}"}}]},
+				{"role":"tool","tool_call_id":"call_0","content":"Paris"}
+			]}`
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(body), "qwen-test")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Response.Choices).To(HaveLen(1))
+		Expect(resp.Response.Choices[0].FinishReason).To(Equal("stop"))
+		Expect(resp.Response.Choices[0].Message.Content).To(HaveValue(Equal(`{"city":"Paris"}`)))
+		Expect(resp.Response.Usage).To(Equal(openai.Usage{PromptTokens: 20, CompletionTokens: 8, TotalTokens: 28}))
+	})
+
+	It("sends a keep_alive in seconds as a number", func() {
+		client.KeepAlive = "-1"
+		client.Options = nil
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/api/chat"),
+			ghttp.VerifyJSONRepresenting(map[string]any{
+				"model":      "qwen-test",
+				"stream":     false,
+				"keep_alive": -1,
+				"messages":   []map[string]any{{"role": "user", "content": "hi"}},
+			}),
+			ghttp.RespondWith(http.StatusOK, `{"model":"qwen-test","message":{"role":"assistant","content":"hello"},"done":true,"done_reason":"stop"}`),
+		))
+
+		_, err := client.POSTChatCompletion(context.Background(), chatRequest(`{"messages":[{"role":"user","content":"hi"}]}`), "qwen-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("translates the JSON lines stream into chat.completion.chunk deltas", func() {
+		server.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/api/chat"),
+			ghttp.RespondWith(http.StatusOK, ollamaStream, http.Header{"Content-Type": {"application/x-ndjson"}}),
+		))
+
+		resp, err := client.POSTChatCompletion(context.Background(), chatRequest(`{"stream":true,"messages":[{"role":"user","content":"hi"}]}`), "qwen-test")
+		Expect(err).NotTo(HaveOccurred())
+		out := drain(resp.Stream)
+		Expect(out).To(ContainSubstring(`"delta":{"content":"Hel","role":"assistant"}`))
+		Expect(out).To(ContainSubstring(`"function":{"arguments":"{\"q\":\"x\"}","name":"lookup"}`))
+		Expect(out).To(ContainSubstring(`"finish_reason":"tool_calls"`))
+		Expect(out).To(ContainSubstring(`"usage":{"completion_tokens":3,"prompt_tokens":4,"total_tokens":7}`))
+	})
+})
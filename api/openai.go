@@ -12,13 +12,12 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-var (
-	canStream = false // Set to false if streaming is not supported
-)
-
 type OpenAIClient struct {
 	BaseURL string
 	APIKey  string
+	// DailyRequests marks the request rate limit headers of the provider as
+	// per day counts, see RateLimit.DailyRequests.
+	DailyRequests bool
 }
 
 // NewOpenAIClient creates a new Google API client.
@@ -30,12 +29,18 @@ func NewOpenAIClient(baseURL string, apiKey string) *OpenAIClient {
 func (c *OpenAIClient) POSTChatCompletion(ctx context.Context, request *Request, model string) (*Response, error) {
 	url := fmt.Sprintf("%s/chat/completions", c.BaseURL)
 	log.Info().Str("provider", "openai").Str("model", model).Msg("POSTChatCompletion")
-	// Set the model in the request body
-	request.Request.Model = model
-	request.Request.Stream = &canStream
+	// Set the model in a copy of the request body, the original is reused on retries
+	body := *request.Request
+	body.Model = model
+	stream := body.Stream != nil && *body.Stream
+	if stream {
+		// always ask for usage so the balancer can account for it, the handler
+		// only forwards it when the client asked for it
+		body.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
 
 	// Set the request body to the modified request
-	jsonBody, err := json.Marshal(request.Request)
+	jsonBody, err := json.Marshal(&body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal request: %w", err)
 	}
@@ -47,6 +52,9 @@ func (c *OpenAIClient) POSTChatCompletion(ctx context.Context, request *Request,
 
 	req.Header.Set("Content-Type", "application/json")
 	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+	if stream {
+		req.Header.Set("Accept", "text/event-stream")
+	}
 	req = req.WithContext(ctx)
 
 	client := &http.Client{}
@@ -54,6 +62,15 @@ func (c *OpenAIClient) POSTChatCompletion(ctx context.Context, request *Request,
 	if err != nil {
 		return nil, fmt.Errorf("failed to send request: %w", err)
 	}
+
+	// hand the open body to the caller, it is closed through Stream.Close
+	rateLimit := ParseRateLimit(resp.Header)
+	if rateLimit != nil {
+		rateLimit.DailyRequests = c.DailyRequests
+	}
+	if stream && resp.StatusCode == http.StatusOK {
+		return &Response{Stream: newOpenAIStream(resp.Body), RateLimit: rateLimit}, nil
+	}
 	defer func() { _ = resp.Body.Close() }()
 
 	bodyBytes, err := io.ReadAll(resp.Body)
@@ -61,13 +78,11 @@ func (c *OpenAIClient) POSTChatCompletion(ctx context.Context, request *Request,
 		return nil, fmt.Errorf("error reading response body: %v", err)
 	}
 
-	fmt.Println("--------------------------------")
-	fmt.Println("Response body:", string(bodyBytes))
-	fmt.Println("--------------------------------")
+	log.Trace().Str("provider", "openai").Bytes("body", bodyBytes).Msg("Upstream response")
 
-	// handle non-200 status codes, if rate limit related, put back onto queue
+	// handle non-200 status codes, the pool decides whether to retry
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("error: received status code %d", resp.StatusCode)
+		return nil, &StatusError{Provider: "openai", StatusCode: resp.StatusCode, Body: string(bodyBytes), RateLimit: rateLimit}
 	}
 
 	var response openai.ChatCompletionResponse
@@ -76,11 +91,44 @@ func (c *OpenAIClient) POSTChatCompletion(ctx context.Context, request *Request,
 	}
 
 	FullResponse := &Response{
-		Response: &response,
-		Error:    nil,
+		Response:  &response,
+		RateLimit: rateLimit,
+		Error:     nil,
 	}
 
-	// fmt.Printf("Response: %+v\n", FullResponse)
-
 	return FullResponse, FullResponse.Error
 }
+
+// ListModels returns the ids of the models served at the base URL.
+func (c *OpenAIClient) ListModels(ctx context.Context) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+"/models", nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+c.APIKey)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, &StatusError{Provider: "openai", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var list struct {
+		Data []struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, fmt.Errorf("error unmarshaling model list: %w", err)
+	}
+	models := make([]string, 0, len(list.Data))
+	for _, m := range list.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
@@ -2,6 +2,7 @@ package api_test
 
 import (
 	"context"
+	"encoding/json"
 	"llm-balancer/api"
 	"llm-balancer/openai"
 	"net/http"
@@ -15,6 +16,16 @@ const (
 	defaultResponseMessage = "This is a test response"
 )
 
+// verifyRequest decodes the chat completion request an upstream receives and
+// passes it to check.
+func verifyRequest(check func(*openai.ChatCompletionRequest)) http.HandlerFunc {
+	return func(_ http.ResponseWriter, r *http.Request) {
+		var req openai.ChatCompletionRequest
+		Expect(json.NewDecoder(r.Body).Decode(&req)).To(Succeed())
+		check(&req)
+	}
+}
+
 var _ = Describe("OpenAIClient", func() {
 	var (
 		server    *ghttp.Server
@@ -102,8 +113,10 @@ var _ = Describe("OpenAIClient", func() {
 						ghttp.VerifyRequest("POST", "/chat/completions"),
 						ghttp.VerifyHeaderKV("Content-Type", "application/json"),
 						ghttp.VerifyHeaderKV("Authorization", "Bearer "+apiKey),
-						ghttp.VerifyJSONRepresenting(func(req *openai.ChatCompletionRequest) bool {
-							return req.Model == testModel && len(req.Messages) == 1 && req.Messages[0].Role == "user"
+						verifyRequest(func(req *openai.ChatCompletionRequest) {
+							Expect(req.Model).To(Equal(testModel))
+							Expect(req.Messages).To(HaveLen(1))
+							Expect(req.Messages[0].Role).To(Equal("user"))
 						}),
 						ghttp.RespondWithJSONEncoded(http.StatusOK, mockResp),
 					),
@@ -119,7 +132,7 @@ var _ = Describe("OpenAIClient", func() {
 				Expect(response.Response.ID).To(Equal(mockResp.ID))
 				Expect(response.Response.Model).To(Equal(testModel))
 				Expect(response.Response.Choices).To(HaveLen(1))
-				Expect(response.Response.Choices[0].Message.Content).To(Equal("This is a test response"))
+				Expect(response.Response.Choices[0].Message.Content).To(HaveValue(Equal("This is a test response")))
 
 				// Verify the server received exactly one request
 				Expect(server.ReceivedRequests()).To(HaveLen(1))
@@ -193,8 +206,9 @@ var _ = Describe("OpenAIClient", func() {
 				server.AppendHandlers(
 					ghttp.CombineHandlers(
 						ghttp.VerifyRequest("POST", "/chat/completions"),
-						ghttp.VerifyJSONRepresenting(func(req *openai.ChatCompletionRequest) bool {
-							return req.ResponseFormat != nil && req.ResponseFormat.Type == "json_object"
+						verifyRequest(func(req *openai.ChatCompletionRequest) {
+							Expect(req.ResponseFormat).NotTo(BeNil())
+							Expect(req.ResponseFormat.Type).To(Equal("json_object"))
 						}),
 						ghttp.RespondWithJSONEncoded(http.StatusOK, mockResp),
 					),
@@ -206,7 +220,7 @@ var _ = Describe("OpenAIClient", func() {
 
 				Expect(err).NotTo(HaveOccurred())
 				Expect(response).NotTo(BeNil())
-				Expect(response.Response.Choices[0].Message.Content).To(Equal(`{"result": "test result"}`))
+				Expect(response.Response.Choices[0].Message.Content).To(HaveValue(Equal(`{"result": "test result"}`)))
 
 				// Verify the server received exactly one request
 				Expect(server.ReceivedRequests()).To(HaveLen(1))
@@ -268,5 +282,26 @@ var _ = Describe("OpenAIClient", func() {
 				Expect(resp).To(BeNil())
 			})
 		})
+
+		Context("when the request has image, audio and file parts", func() {
+			It("passes them through untouched", func() {
+				messages := []map[string]any{{"role": "user", "content": []map[string]any{
+					{"type": "text", "text": "What is this?"},
+					{"type": "image_url", "image_url": map[string]any{"url": "https://example.com/cat.png", "detail": "low"}},
+					{"type": "input_audio", "input_audio": map[string]any{"data": "d2F2", "format": "wav"}},
+					{"type": "file", "file": map[string]any{"file_id": "file-123"}},
+				}}}
+				server.AppendHandlers(ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/chat/completions"),
+					ghttp.VerifyJSONRepresenting(map[string]any{"model": testModel, "messages": messages}),
+					ghttp.RespondWithJSONEncoded(http.StatusOK, mockResp),
+				))
+
+				body, err := json.Marshal(map[string]any{"messages": messages})
+				Expect(err).NotTo(HaveOccurred())
+				_, err = client.POSTChatCompletion(ctx, chatRequest(string(body)), testModel)
+				Expect(err).NotTo(HaveOccurred())
+			})
+		})
 	})
 })
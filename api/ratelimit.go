@@ -0,0 +1,100 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RateLimit is the provider's view of the quota left for a model, parsed
+// from the x-ratelimit-* (anthropic-ratelimit-* for Anthropic) and retry-after
+// response headers documented in api.go.
+// Counts that were not reported are -1, durations that were not reported are 0.
+type RateLimit struct {
+	LimitRequests     int
+	LimitTokens       int
+	RemainingRequests int
+	RemainingTokens   int
+	ResetRequests     time.Duration // until the request quota is replenished
+	ResetTokens       time.Duration // until the token quota is replenished
+	RetryAfter        time.Duration // only set on 429 responses
+	// DailyRequests is set when the request counts are per day, as Groq
+	// reports them, rather than per minute like the token counts.
+	DailyRequests bool
+}
+
+// ParseRateLimit reads the rate limit headers of a response, it returns nil
+// when the provider did not send any.
+func ParseRateLimit(header http.Header) *RateLimit {
+	rl := &RateLimit{
+		LimitRequests:     parseCount(header, "x-ratelimit-limit-requests", "x-ratelimit-limit", "anthropic-ratelimit-requests-limit"),
+		LimitTokens:       parseCount(header, "x-ratelimit-limit-tokens", "anthropic-ratelimit-tokens-limit"),
+		RemainingRequests: parseCount(header, "x-ratelimit-remaining-requests", "x-ratelimit-remaining", "anthropic-ratelimit-requests-remaining"),
+		RemainingTokens:   parseCount(header, "x-ratelimit-remaining-tokens", "anthropic-ratelimit-tokens-remaining"),
+		ResetRequests:     parseReset(firstHeader(header, "x-ratelimit-reset-requests", "x-ratelimit-reset", "anthropic-ratelimit-requests-reset")),
+		ResetTokens:       parseReset(firstHeader(header, "x-ratelimit-reset-tokens", "anthropic-ratelimit-tokens-reset")),
+		RetryAfter:        parseRetryAfter(header),
+	}
+	if rl.LimitRequests < 0 && rl.LimitTokens < 0 && rl.RemainingRequests < 0 && rl.RemainingTokens < 0 && rl.RetryAfter == 0 {
+		return nil
+	}
+	return rl
+}
+
+func firstHeader(header http.Header, names ...string) string {
+	for _, name := range names {
+		if v := header.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+func parseCount(header http.Header, names ...string) int {
+	n, err := strconv.Atoi(firstHeader(header, names...))
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// parseReset accepts Go style durations ("2m59.56s", "7.66s"), plain seconds,
+// unix timestamps in milliseconds (OpenRouter) and RFC 3339 times (Anthropic).
+func parseReset(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return max(d, 0)
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0
+	}
+	if f > 1e12 {
+		return max(time.Until(time.UnixMilli(int64(f))), 0)
+	}
+	return time.Duration(f * float64(time.Second))
+}
+
+// parseRetryAfter reads retry-after-ms, then retry-after as seconds or an HTTP date.
+func parseRetryAfter(header http.Header) time.Duration {
+	if ms, err := strconv.ParseFloat(header.Get("retry-after-ms"), 64); err == nil && ms > 0 {
+		return time.Duration(ms * float64(time.Millisecond))
+	}
+	value := strings.TrimSpace(header.Get("retry-after"))
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.ParseFloat(value, 64); err == nil {
+		return max(time.Duration(secs*float64(time.Second)), 0)
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return max(time.Until(t), 0)
+	}
+	return 0
+}
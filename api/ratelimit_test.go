@@ -0,0 +1,93 @@
+package api_test
+
+import (
+	"net/http"
+	"time"
+
+	"llm-balancer/api"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ParseRateLimit", func() {
+	header := func(kv ...string) http.Header {
+		h := http.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			h.Set(kv[i], kv[i+1])
+		}
+		return h
+	}
+
+	It("returns nil without rate limit headers, as Gemini answers", func() {
+		Expect(api.ParseRateLimit(header("Content-Type", "application/json"))).To(BeNil())
+	})
+
+	It("reads OpenAI's limits and duration resets", func() {
+		rl := api.ParseRateLimit(header(
+			"x-ratelimit-limit-requests", "500",
+			"x-ratelimit-limit-tokens", "30000",
+			"x-ratelimit-remaining-requests", "499",
+			"x-ratelimit-remaining-tokens", "29000",
+			"x-ratelimit-reset-requests", "120ms",
+			"x-ratelimit-reset-tokens", "6m0s",
+		))
+		Expect(rl).To(Equal(&api.RateLimit{
+			LimitRequests: 500, LimitTokens: 30000, RemainingRequests: 499, RemainingTokens: 29000,
+			ResetRequests: 120 * time.Millisecond, ResetTokens: 6 * time.Minute,
+		}))
+	})
+
+	It("reads Groq's headers and retry-after in seconds", func() {
+		rl := api.ParseRateLimit(header(
+			"x-ratelimit-limit-requests", "14400",
+			"x-ratelimit-remaining-requests", "14370",
+			"x-ratelimit-reset-requests", "2m59.56s",
+			"x-ratelimit-remaining-tokens", "17997",
+			"x-ratelimit-reset-tokens", "7.66s",
+			"retry-after", "2",
+		))
+		Expect(rl.RemainingRequests).To(Equal(14370))
+		Expect(rl.ResetRequests).To(Equal(2*time.Minute + 59560*time.Millisecond))
+		Expect(rl.ResetTokens).To(Equal(7660 * time.Millisecond))
+		Expect(rl.LimitTokens).To(Equal(-1))
+		Expect(rl.RetryAfter).To(Equal(2 * time.Second))
+		Expect(rl.DailyRequests).To(BeFalse())
+	})
+
+	It("reads Anthropic's headers with RFC 3339 resets", func() {
+		rl := api.ParseRateLimit(header(
+			"anthropic-ratelimit-requests-limit", "50",
+			"anthropic-ratelimit-requests-remaining", "0",
+			"anthropic-ratelimit-requests-reset", time.Now().Add(30*time.Second).UTC().Format(time.RFC3339),
+			"anthropic-ratelimit-tokens-remaining", "1000",
+		))
+		Expect(rl.LimitRequests).To(Equal(50))
+		Expect(rl.RemainingRequests).To(Equal(0))
+		Expect(rl.ResetRequests).To(BeNumerically("~", 30*time.Second, 2*time.Second))
+		Expect(rl.RemainingTokens).To(Equal(1000))
+	})
+
+	It("reads OpenRouter's unix millisecond resets", func() {
+		rl := api.ParseRateLimit(header(
+			"x-ratelimit-limit", "20",
+			"x-ratelimit-remaining", "19",
+			"x-ratelimit-reset", "1700000000000",
+		))
+		Expect(rl.LimitRequests).To(Equal(20))
+		Expect(rl.RemainingRequests).To(Equal(19))
+		Expect(rl.ResetRequests).To(BeZero())
+	})
+
+	It("prefers retry-after-ms and accepts HTTP dates", func() {
+		Expect(api.ParseRateLimit(header("retry-after-ms", "1500", "retry-after", "9")).RetryAfter).To(Equal(1500 * time.Millisecond))
+		rl := api.ParseRateLimit(header("retry-after", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)))
+		Expect(rl.RetryAfter).To(BeNumerically("~", time.Minute, 2*time.Second))
+	})
+
+	It("ignores counts and resets it cannot parse", func() {
+		rl := api.ParseRateLimit(header("x-ratelimit-remaining-tokens", "many", "x-ratelimit-reset-tokens", "soon", "retry-after", "1"))
+		Expect(rl.RemainingTokens).To(Equal(-1))
+		Expect(rl.ResetTokens).To(BeZero())
+	})
+})
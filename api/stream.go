@@ -0,0 +1,106 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"llm-balancer/openai"
+)
+
+// Stream yields chat completion chunks from an upstream streaming response.
+// Recv returns io.EOF once the upstream has finished. Close must always be called.
+type Stream interface {
+	Recv() (*openai.ChatCompletionChunk, error)
+	Close() error
+}
+
+// sseReader reads the data payloads of a text/event-stream body.
+type sseReader struct {
+	reader *bufio.Reader
+}
+
+func newSSEReader(body io.Reader) *sseReader {
+	return &sseReader{reader: bufio.NewReader(body)}
+}
+
+// Next returns the event name and data of the next event. Multi-line data
+// fields are joined with a newline as described by the SSE spec.
+func (r *sseReader) Next() (string, []byte, error) {
+	var event string
+	var data []byte
+	for {
+		line, err := r.reader.ReadBytes('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			if err == io.EOF && data != nil {
+				return event, data, nil
+			}
+			return "", nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+
+		// a blank line terminates the event
+		if len(line) == 0 {
+			if data != nil {
+				return event, data, nil
+			}
+			continue
+		}
+		// comments are used as keep-alives
+		if line[0] == ':' {
+			continue
+		}
+
+		field, value, _ := bytes.Cut(line, []byte(":"))
+		value = bytes.TrimPrefix(value, []byte(" "))
+		switch string(field) {
+		case "event":
+			event = string(value)
+		case "data":
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, value...)
+		}
+	}
+}
+
+// openAIStream decodes an OpenAI compatible chat.completion.chunk stream.
+type openAIStream struct {
+	body io.ReadCloser
+	sse  *sseReader
+}
+
+func newOpenAIStream(body io.ReadCloser) *openAIStream {
+	return &openAIStream{body: body, sse: newSSEReader(body)}
+}
+
+func (s *openAIStream) Recv() (*openai.ChatCompletionChunk, error) {
+	_, data, err := s.sse.Next()
+	if err != nil {
+		return nil, err
+	}
+	if string(data) == "[DONE]" {
+		return nil, io.EOF
+	}
+
+	var chunk struct {
+		openai.ChatCompletionChunk
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error,omitempty"`
+	}
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return nil, fmt.Errorf("error unmarshaling stream chunk: %w", err)
+	}
+	// some providers report failures as an event in the middle of the stream
+	if chunk.Error != nil {
+		return nil, fmt.Errorf("upstream stream error: %s", chunk.Error.Message)
+	}
+	return &chunk.ChatCompletionChunk, nil
+}
+
+func (s *openAIStream) Close() error {
+	return s.body.Close()
+}
@@ -0,0 +1,290 @@
+// Package auth verifies the API keys the balancer issues to its clients.
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrKeyExists is returned when adding a key whose name or secret is taken.
+	ErrKeyExists = errors.New("key already exists")
+	// ErrKeyNotFound is returned when updating or removing an unknown key.
+	ErrKeyNotFound = errors.New("key not found")
+)
+
+// Key is a client API key issued by the balancer. Keys without models and
+// groups may use every model.
+type Key struct {
+	Name       string   `yaml:"name" json:"name"`
+	APIKey     string   `yaml:"api_key" json:"api_key,omitempty"`           // the secret sent as bearer token
+	APIKeyName string   `yaml:"api_key_name" json:"api_key_name,omitempty"` // environment variable holding the secret
+	Models     []string `yaml:"models" json:"models,omitempty"`             // models the key may use
+	Groups     []string `yaml:"groups" json:"groups,omitempty"`             // groups the key may use, along with their models
+	Disabled   bool     `yaml:"disabled" json:"disabled"`
+	Budget     *Budget  `yaml:"budget" json:"budget,omitempty"` // nil for no limit
+}
+
+// Validate checks the key has a name and resolves its secret from the
+// environment when only api_key_name is set.
+func (k *Key) Validate() error {
+	if k.Name == "" {
+		return errors.New("key without a name")
+	}
+	if k.APIKey == "" && k.APIKeyName != "" {
+		k.APIKey = os.Getenv(k.APIKeyName)
+	}
+	if k.APIKey == "" {
+		return fmt.Errorf("key %s has no api_key and %q is not set", k.Name, k.APIKeyName)
+	}
+	if k.Budget != nil {
+		if err := k.Budget.Validate(); err != nil {
+			return fmt.Errorf("key %s: %w", k.Name, err)
+		}
+	}
+	return nil
+}
+
+// Unrestricted reports whether the key may use every model.
+func (k *Key) Unrestricted() bool {
+	return len(k.Models) == 0 && len(k.Groups) == 0
+}
+
+// Redacted returns a copy of the key without its secret.
+func (k *Key) Redacted() *Key {
+	c := *k
+	c.APIKey = ""
+	return &c
+}
+
+// Clone returns a copy of the key that shares no slices with it.
+func (k *Key) Clone() *Key {
+	c := *k
+	c.Models = slices.Clone(k.Models)
+	c.Groups = slices.Clone(k.Groups)
+	if k.Budget != nil {
+		budget := *k.Budget
+		c.Budget = &budget
+	}
+	return &c
+}
+
+// NewSecret returns a random secret for a key created without one.
+func NewSecret() string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	return "sk-lb-" + hex.EncodeToString(b)
+}
+
+// Store holds the issued keys and what they spent. When it is not required
+// every request is let through, whether it carries a key or not.
+type Store struct {
+	mu       sync.RWMutex
+	required bool
+	keys     []*Key               // in the order they were added
+	spent    map[string]*spending // by key name, kept across Replace
+}
+
+// NewStore validates keys and returns a store holding them.
+func NewStore(required bool, keys []*Key) (*Store, error) {
+	s := &Store{spent: make(map[string]*spending)}
+	if err := s.Replace(required, keys); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ValidateKeys validates every key and checks no two share a name or secret.
+func ValidateKeys(keys []*Key) error {
+	for i, k := range keys {
+		if err := k.Validate(); err != nil {
+			return err
+		}
+		if err := conflict(keys[:i], k, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace swaps all keys at once, e.g. after the config was reloaded.
+// Nothing changes when the keys are invalid.
+func (s *Store) Replace(required bool, keys []*Key) error {
+	if err := ValidateKeys(keys); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.required = required
+	s.keys = slices.Clone(keys)
+	return nil
+}
+
+// Keys returns every key, secrets included.
+func (s *Store) Keys() []*Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return slices.Clone(s.keys)
+}
+
+// Get returns the key with the given name.
+func (s *Store) Get(name string) (*Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, k := range s.keys {
+		if k.Name == name {
+			return k, true
+		}
+	}
+	return nil, false
+}
+
+// Add validates and adds a key.
+func (s *Store) Add(k *Key) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := conflict(s.keys, k, ""); err != nil {
+		return err
+	}
+	s.keys = append(slices.Clip(s.keys), k)
+	return nil
+}
+
+// Update replaces the key with the given name by k, which may rename it.
+func (s *Store) Update(name string, k *Key) error {
+	if err := k.Validate(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.keys, func(old *Key) bool { return old.Name == name })
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	if err := conflict(s.keys, k, name); err != nil {
+		return err
+	}
+	keys := slices.Clone(s.keys)
+	keys[i] = k
+	s.keys = keys
+	return nil
+}
+
+// Remove deletes the key with the given name.
+func (s *Store) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := slices.IndexFunc(s.keys, func(k *Key) bool { return k.Name == name })
+	if i < 0 {
+		return fmt.Errorf("%s: %w", name, ErrKeyNotFound)
+	}
+	s.keys = slices.Delete(slices.Clone(s.keys), i, i+1)
+	return nil
+}
+
+// conflict reports a key in keys, other than the one named except, that
+// has the name or the secret of k.
+func conflict(keys []*Key, k *Key, except string) error {
+	for _, other := range keys {
+		if other.Name == except {
+			continue
+		}
+		if other.Name == k.Name || other.APIKey == k.APIKey {
+			return fmt.Errorf("%s: %w", k.Name, ErrKeyExists)
+		}
+	}
+	return nil
+}
+
+// lookup returns the enabled key with the given secret. Every key is
+// compared in constant time.
+func (s *Store) lookup(secret string) (*Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var found *Key
+	for _, k := range s.keys {
+		if subtle.ConstantTimeCompare([]byte(k.APIKey), []byte(secret)) == 1 {
+			found = k
+		}
+	}
+	if found == nil || found.Disabled {
+		return nil, false
+	}
+	return found, true
+}
+
+// Middleware rejects requests without a valid key in the
+// "Authorization: Bearer" header, or the x-api-key header Anthropic clients
+// use, and passes the key on in the request context, see FromContext.
+func (s *Store) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		required := s.required
+		s.mu.RUnlock()
+
+		secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			// Anthropic clients send their key in x-api-key
+			secret = r.Header.Get("x-api-key")
+			ok = secret != ""
+		}
+		key, valid := s.lookup(strings.TrimSpace(secret))
+		if required && (!ok || !valid) {
+			log.Debug().Str("path", r.URL.Path).Msg("Rejected request without a valid API key")
+			WriteError(w, http.StatusUnauthorized, "Invalid API key provided.", "invalid_request_error", "invalid_api_key")
+			return
+		}
+		if valid {
+			r = r.WithContext(context.WithValue(r.Context(), keyContext{}, key))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type keyContext struct{}
+
+// FromContext returns the key a request was authenticated with, nil when
+// it carried none.
+func FromContext(ctx context.Context) *Key {
+	key, _ := ctx.Value(keyContext{}).(*Key)
+	return key
+}
+
+// WriteError answers in the error format of the OpenAI API, which clients
+// of the balancer know how to read.
+func WriteError(w http.ResponseWriter, status int, message, errType, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{
+			"message": message,
+			"type":    errType,
+			"code":    code,
+		},
+	})
+}
@@ -0,0 +1,140 @@
+package auth_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"llm-balancer/auth"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Store", func() {
+	var (
+		store *auth.Store
+		seen  *auth.Key
+	)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = auth.FromContext(r.Context())
+	})
+
+	send := func(header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/v1/chat/completions", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rec := httptest.NewRecorder()
+		store.Middleware(next).ServeHTTP(rec, req)
+		return rec
+	}
+
+	BeforeEach(func() {
+		GinkgoT().Setenv("TEST_CLIENT_KEY", "from-env")
+		seen = nil
+		var err error
+		store, err = auth.NewStore(true, []*auth.Key{
+			{Name: "scripts", APIKey: "sk-scripts", Models: []string{"a"}},
+			{Name: "env", APIKeyName: "TEST_CLIENT_KEY"},
+			{Name: "old", APIKey: "sk-old", Disabled: true},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("passes the key of a valid bearer token on in the context", func() {
+		Expect(send("Bearer sk-scripts").Code).To(Equal(http.StatusOK))
+		Expect(seen.Name).To(Equal("scripts"))
+
+		Expect(send("Bearer from-env").Code).To(Equal(http.StatusOK))
+		Expect(seen.Name).To(Equal("env"))
+	})
+
+	It("accepts the key in the x-api-key header of Anthropic clients", func() {
+		req := httptest.NewRequest("POST", "/v1/messages", nil)
+		req.Header.Set("x-api-key", "sk-scripts")
+		rec := httptest.NewRecorder()
+		store.Middleware(next).ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(seen.Name).To(Equal("scripts"))
+	})
+
+	It("rejects missing, unknown and disabled keys", func() {
+		for _, header := range []string{"", "sk-scripts", "Bearer sk-unknown", "Bearer sk-old"} {
+			rec := send(header)
+			Expect(rec.Code).To(Equal(http.StatusUnauthorized), header)
+			Expect(rec.Body.String()).To(ContainSubstring(`"code":"invalid_api_key"`))
+		}
+		Expect(seen).To(BeNil())
+	})
+
+	It("lets every request through when keys are not required", func() {
+		Expect(store.Replace(false, store.Keys())).To(Succeed())
+		Expect(send("").Code).To(Equal(http.StatusOK))
+		Expect(seen).To(BeNil())
+
+		Expect(send("Bearer sk-scripts").Code).To(Equal(http.StatusOK))
+		Expect(seen.Name).To(Equal("scripts"))
+	})
+
+	It("rejects keys sharing a name or secret and keeps the current ones", func() {
+		Expect(store.Replace(true, []*auth.Key{
+			{Name: "a", APIKey: "same"},
+			{Name: "b", APIKey: "same"},
+		})).To(MatchError(auth.ErrKeyExists))
+		Expect(store.Add(&auth.Key{Name: "scripts", APIKey: "sk-other"})).To(MatchError(auth.ErrKeyExists))
+		Expect(store.Keys()).To(HaveLen(3))
+	})
+
+	It("rejects keys without a secret", func() {
+		Expect(store.Add(&auth.Key{Name: "empty", APIKeyName: "TEST_UNSET_KEY"})).NotTo(Succeed())
+	})
+
+	It("updates and removes keys by name", func() {
+		Expect(store.Update("old", &auth.Key{Name: "old", APIKey: "sk-old"})).To(Succeed())
+		Expect(send("Bearer sk-old").Code).To(Equal(http.StatusOK))
+
+		Expect(store.Remove("old")).To(Succeed())
+		Expect(send("Bearer sk-old").Code).To(Equal(http.StatusUnauthorized))
+		Expect(store.Remove("old")).To(MatchError(auth.ErrKeyNotFound))
+	})
+
+	Describe("budgets", func() {
+		var key *auth.Key
+		day := time.Date(2025, 5, 11, 12, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			key = &auth.Key{Name: "capped", APIKey: "sk-capped", Budget: &auth.Budget{Limit: 1, Period: auth.PeriodDay}}
+			Expect(store.Add(key)).To(Succeed())
+		})
+
+		It("fills in the defaults and rejects unknown settings", func() {
+			Expect(key.Budget.OnExceeded).To(Equal(auth.OnExceededReject))
+			Expect(store.Add(&auth.Key{Name: "x", APIKey: "sk-x", Budget: &auth.Budget{Period: "week"}})).NotTo(Succeed())
+			Expect(store.Add(&auth.Key{Name: "y", APIKey: "sk-y", Budget: &auth.Budget{OnExceeded: "ignore"}})).NotTo(Succeed())
+		})
+
+		It("adds up the spending of a key until it is over budget", func() {
+			store.Charge("capped", 0.6, day)
+			Expect(store.OverBudget(key, day)).To(BeFalse())
+			store.Charge("capped", 0.4, day)
+			Expect(store.Spent("capped", day)).To(BeNumerically("~", 1))
+			Expect(store.OverBudget(key, day)).To(BeTrue())
+		})
+
+		It("starts over in the next period", func() {
+			store.Charge("capped", 2, day)
+			Expect(store.OverBudget(key, day.Add(24*time.Hour))).To(BeFalse())
+			store.Charge("capped", 0.5, day.Add(24*time.Hour))
+			store.Charge("capped", 0.5, day)
+			Expect(store.Spent("capped", day.Add(24*time.Hour))).To(BeNumerically("~", 0.5))
+		})
+
+		It("keeps the spending when the keys are reloaded", func() {
+			store.Charge("capped", 2, day)
+			Expect(store.Replace(true, store.Keys())).To(Succeed())
+			Expect(store.OverBudget(key, day)).To(BeTrue())
+		})
+	})
+})
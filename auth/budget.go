@@ -0,0 +1,115 @@
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Budget periods, both in UTC.
+const (
+	PeriodDay   = "day"
+	PeriodMonth = "month"
+)
+
+// What happens to requests of a key over its budget.
+const (
+	OnExceededReject    = "reject"    // answer 429 insufficient_quota
+	OnExceededDowngrade = "downgrade" // serve the request with free models only
+)
+
+// ErrBudgetExceeded is returned for requests of a key over its budget.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budget caps what a key may spend per period, computed from the cost_input
+// and cost_output of the models that served it. A request is only checked
+// before it is sent, so the one crossing the limit still completes.
+type Budget struct {
+	Limit      float64 `yaml:"limit" json:"limit"`             // in dollars per period
+	Period     string  `yaml:"period" json:"period"`           // day or month, defaults to month
+	OnExceeded string  `yaml:"on_exceeded" json:"on_exceeded"` // reject or downgrade, defaults to reject
+}
+
+// Validate checks the budget and fills in the defaults.
+func (b *Budget) Validate() error {
+	if b.Limit < 0 {
+		return fmt.Errorf("negative budget limit %v", b.Limit)
+	}
+	switch b.Period {
+	case "":
+		b.Period = PeriodMonth
+	case PeriodDay, PeriodMonth:
+	default:
+		return fmt.Errorf("unknown budget period %q, want day or month", b.Period)
+	}
+	switch b.OnExceeded {
+	case "":
+		b.OnExceeded = OnExceededReject
+	case OnExceededReject, OnExceededDowngrade:
+	default:
+		return fmt.Errorf("unknown on_exceeded %q, want reject or downgrade", b.OnExceeded)
+	}
+	return nil
+}
+
+// periodStart returns the start of the period t falls into.
+func periodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == PeriodDay {
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// spending is what a key spent since the start of a period.
+type spending struct {
+	since   time.Time
+	dollars float64
+}
+
+// Charge adds the cost of a completed request to what the named key spent
+// in its current period.
+func (s *Store) Charge(name string, dollars float64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	since := periodStart(s.period(name), at)
+	sp, ok := s.spent[name]
+	switch {
+	case !ok || sp.since.Before(since):
+		sp = &spending{since: since}
+		s.spent[name] = sp
+	case since.Before(sp.since):
+		// from a period already over
+		return
+	}
+	sp.dollars += dollars
+}
+
+// Spent returns what the named key spent in the period now falls into.
+func (s *Store) Spent(name string, now time.Time) float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	sp, ok := s.spent[name]
+	if !ok || sp.since.Before(periodStart(s.period(name), now)) {
+		return 0
+	}
+	return sp.dollars
+}
+
+// OverBudget reports whether a key reached the limit of its budget.
+func (s *Store) OverBudget(k *Key, now time.Time) bool {
+	return k.Budget != nil && s.Spent(k.Name, now) >= k.Budget.Limit
+}
+
+// period returns the budget period of the named key, month for keys
+// without a budget. Callers must hold s.mu.
+func (s *Store) period(name string) string {
+	for _, k := range s.keys {
+		if k.Name == name && k.Budget != nil {
+			return k.Budget.Period
+		}
+	}
+	return PeriodMonth
+}
@@ -3,67 +3,85 @@ package balancer
 import (
 	"context"
 	"errors"
+	"fmt"
+	"io"
 	"llm-balancer/api"
 	"llm-balancer/llm"
-	"sort"
+	"llm-balancer/openai"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog/log"
 	"golang.org/x/time/rate"
 )
 
-var (
-	cancel context.CancelFunc
-)
-
 // ModelLimiter wraps an LLM with both request and token limiters.
 type ModelLimiter struct {
 	LLM          *llm.LLM
-	ReqLimiter   *rate.Limiter // limits requests per second
-	TokenLimiter *rate.Limiter // limits tokens per second
-}
-
-// TODO: I need to make every family of LLMs have the same rate limiter, they must share accross source or name or api key
+	ReqLimiter   *rate.Limiter    // limits requests per second
+	TokenLimiter *rate.Limiter    // limits tokens per second
+	Shared       []*SharedLimiter // limits shared with other models, charged alongside the model's own
+	Breaker      *Breaker         // stops traffic to the model while its backend is failing
 
-// SortStrategy defines how to order limiters when picking.
-type SortStrategy interface {
-	Sort(limiters []*ModelLimiter)
-}
-
-// QualitySortStrategy sorts by descending Quality
-type QualitySortStrategy struct{}
+	credit        tokenCredit // tokens refunded after usage came in below the estimate
+	mu            sync.Mutex
+	cooldownUntil time.Time // set when the provider reports the quota as exhausted
 
-// Sort implements SortStrategy; higher Quality first
-func (s *QualitySortStrategy) Sort(limiters []*ModelLimiter) {
-	sort.SliceStable(limiters, func(i, j int) bool {
-		return limiters[i].LLM.Quality > limiters[j].LLM.Quality
-	})
+	Stats  *LatencyStats // durations of completed upstream calls
+	health health        // outcome of the background health checks
 }
 
 // Config holds pool initialization settings
 type Config struct {
 	Models         []*llm.LLM
-	SortStrategy   SortStrategy
-	ContextTimeout time.Duration // optional default timeout when waiting
+	Groups         map[string][]string     // group name to model names
+	SortStrategy   SortStrategy            // default selection strategy
+	GroupSorters   map[string]SortStrategy // selection strategy per group, overriding the default
+	SharedLimits   []*SharedLimit          // rate limits shared by several models
+	ContextTimeout time.Duration           // optional default timeout when waiting
+	Retry          RetryPolicy
+	Breaker        BreakerConfig         // circuit breaker settings applied to every model
+	Cache          CacheConfig           // exact-match response cache, off unless enabled
+	Metrics        prometheus.Registerer // optional registry to record into, a private one is used when nil
 }
 
 // Pool manages multiple ModelLimiters
 // and dispatches requests based on limiter availability.
 type Pool struct {
 	limiters       map[string]*ModelLimiter
-	defaultModel   string
 	Models         []string
 	Groups         map[string][]string
 	sorter         SortStrategy
+	groupSorters   map[string]SortStrategy
 	mu             sync.Mutex
-	next           int
 	defaultTimeout time.Duration
+	retry          RetryPolicy
+	breaker        BreakerConfig
+	shared         []*SharedLimiter
+	cache          *responseCache // nil when disabled
+	metrics        *poolMetrics
 }
 
 // New creates a Pool given Config; error if no valid models.
 // Initializes both request and token limiters for each model.
 func NewPool(cfg Config) (*Pool, error) {
+	pool, err := buildPool(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Metrics == nil {
+		cfg.Metrics = prometheus.NewRegistry()
+	}
+	pool.metrics, err = newPoolMetrics(cfg.Metrics, pool)
+	if err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// buildPool validates cfg and builds a pool with fresh limiters, without metrics.
+func buildPool(cfg Config) (*Pool, error) {
 	if len(cfg.Models) == 0 {
 		return nil, errors.New("no models provided")
 	}
@@ -75,119 +93,449 @@ func NewPool(cfg Config) (*Pool, error) {
 		Groups:         make(map[string][]string),
 		limiters:       make(map[string]*ModelLimiter),
 		sorter:         cfg.SortStrategy,
+		groupSorters:   make(map[string]SortStrategy),
 		defaultTimeout: cfg.ContextTimeout,
+		retry:          cfg.Retry.withDefaults(),
+		breaker:        cfg.Breaker,
+		cache:          newResponseCache(cfg.Cache),
 	}
-	quality := 0
 
-	for _, llm := range cfg.Models {
-		if !llm.Validate() {
-			return nil, errors.New("invalid model configuration: " + llm.String())
-		}
-		// compute request rate per second
-		ratePerSec := rate.Limit(float64(llm.RequestsPerMin) / 60.0)
-		if ratePerSec <= 0 {
-			return nil, errors.New("invalid rate limit for model " + llm.Model)
-		}
-		// compute token rate per second
-		tokenRate := rate.Limit(float64(llm.TokensPerMin) / 60.0)
-		if tokenRate <= 0 {
-			return nil, errors.New("invalid tokens per minute for model " + llm.Model)
+	for _, limit := range cfg.SharedLimits {
+		if err := limit.Validate(); err != nil {
+			return nil, err
 		}
+		pool.shared = append(pool.shared, newSharedLimiter(limit))
+	}
 
-		ml := &ModelLimiter{
-			LLM:          llm,
-			ReqLimiter:   rate.NewLimiter(ratePerSec, llm.RequestsPerMin),
-			TokenLimiter: rate.NewLimiter(tokenRate, llm.TokensPerMin),
+	for _, llm := range cfg.Models {
+		if _, ok := pool.limiters[llm.Model]; ok {
+			return nil, errors.New("model " + llm.Model + " is configured twice")
+		}
+		ml, err := pool.newModelLimiter(llm)
+		if err != nil {
+			return nil, err
 		}
 		pool.Models = append(pool.Models, llm.Model)
 		pool.limiters[llm.Model] = ml
+	}
 
-		if llm.Quality > quality {
-			quality = llm.Quality
-			pool.defaultModel = llm.Model
+	for group, models := range cfg.Groups {
+		for _, model := range models {
+			if _, ok := pool.limiters[model]; !ok {
+				return nil, errors.New("group " + group + " references unknown model " + model)
+			}
+		}
+		pool.Groups[group] = models
+	}
+	for group, sorter := range cfg.GroupSorters {
+		if _, ok := pool.Groups[group]; !ok {
+			return nil, errors.New("strategy configured for unknown group " + group)
 		}
+		pool.groupSorters[group] = sorter
 	}
 
 	return pool, nil
 }
 
-// Pick chooses the next available ModelLimiter.
-// It only checks availability via Allow() (snon-blocking).
+// newModelLimiter validates an LLM and builds its limiters, attaching the
+// shared limits it draws from. Callers must hold p.mu once the pool is in use.
+func (p *Pool) newModelLimiter(llm *llm.LLM) (*ModelLimiter, error) {
+	if !llm.Validate() {
+		return nil, errors.New("invalid model configuration: " + llm.String())
+	}
+	// compute request rate per second
+	ratePerSec := rate.Limit(float64(llm.RequestsPerMin) / 60.0)
+	if ratePerSec <= 0 {
+		return nil, errors.New("invalid rate limit for model " + llm.Model)
+	}
+	// compute token rate per second
+	tokenRate := rate.Limit(float64(llm.TokensPerMin) / 60.0)
+	if tokenRate <= 0 {
+		return nil, errors.New("invalid tokens per minute for model " + llm.Model)
+	}
+
+	ml := &ModelLimiter{
+		LLM:          llm,
+		ReqLimiter:   rate.NewLimiter(ratePerSec, llm.RequestsPerMin),
+		TokenLimiter: rate.NewLimiter(tokenRate, llm.TokensPerMin),
+		Breaker:      newBreaker(llm.String(), p.breaker),
+		Stats:        &LatencyStats{},
+	}
+	for _, bucket := range llm.LimitBuckets {
+		known := false
+		for _, sl := range p.shared {
+			known = known || (sl.Limit.Scope == ScopeBucket && sl.Limit.Name == bucket)
+		}
+		if !known {
+			return nil, errors.New("model " + llm.Model + " references unknown limit bucket " + bucket)
+		}
+	}
+	for _, sl := range p.shared {
+		if sl.Limit.Applies(llm) {
+			ml.Shared = append(ml.Shared, sl)
+		}
+	}
+	return ml, nil
+}
+
+// PickAny chooses a ModelLimiter from the whole pool with the default strategy.
+// It only checks availability of the limiters (non-blocking).
+// Blocking for quota happens in Do(), so Pick never waits.
+// Models in exclude are skipped; nil is returned when no model can serve the request.
+func (p *Pool) PickAny(needs Needs, exclude map[string]bool) *ModelLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pick(needs, p.Models, exclude, p.sorter)
+}
+
+// PickFrom chooses a ModelLimiter among the given models with the default strategy.
+// Models in exclude are skipped; nil is returned when no model can serve the request.
+func (p *Pool) PickFrom(needs Needs, models []string, exclude map[string]bool) *ModelLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.pick(needs, models, exclude, p.sorter)
+}
+
+// PickGroup chooses a ModelLimiter from a group with the group's strategy.
+// It only checks availability of the limiters (non-blocking).
 // Blocking for quota happens in Do(), so Pick never waits.
-func (p *Pool) PickAny(tokensNeeded int) *ModelLimiter {
+// Models in exclude are skipped; nil is returned when no model can serve the request.
+func (p *Pool) PickGroup(needs Needs, group string, exclude map[string]bool) *ModelLimiter {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// round-robin check
-	n := len(p.limiters)
-	for i := range n {
-		idx := (p.next + i) % n
-		ml := p.limiters[p.Models[idx]]
-		if ml.ReqLimiter.Allow() && tokensNeeded < ml.LLM.ContextLength && float64(tokensNeeded) <= ml.TokenLimiter.Tokens() {
-			p.next = (idx + 1) % n
-			return ml
+	sorter, ok := p.groupSorters[group]
+	if !ok {
+		sorter = p.sorter
+	}
+	return p.pick(needs, p.Groups[group], exclude, sorter)
+}
+
+// pick orders the candidates that fit the request's tokens, modalities and
+// capabilities with sorter and returns the first one. Models with quota left
+// right now are preferred; when there are none the others are considered and
+// will wait in DoAssigned.
+// Callers must hold p.mu.
+func (p *Pool) pick(needs Needs, models []string, exclude map[string]bool, sorter SortStrategy) *ModelLimiter {
+	var ready, waiting []*ModelLimiter
+	for _, model := range models {
+		ml, ok := p.limiters[model]
+		if !ok || exclude[model] || !needs.fits(ml.LLM) || !ml.Breaker.Ready() || !ml.Healthy() {
+			continue
+		}
+		if ml.available(needs.Tokens) {
+			ready = append(ready, ml)
+		} else {
+			waiting = append(waiting, ml)
 		}
 	}
 
-	// fallback to highest quality
-	best := p.limiters[p.defaultModel]
-	return best
+	candidates := ready
+	if len(candidates) == 0 {
+		candidates = waiting
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	sorter.Sort(needs.Tokens, candidates)
+	return candidates[0]
 }
 
-// Pick chooses the next available ModelLimiter.
-// It only checks availability via Allow() (snon-blocking).
-// Blocking for quota happens in Do(), so Pick never waits.
-func (p *Pool) PickGroup(tokensNeeded int, models []string) *ModelLimiter {
+// snapshot returns the limiters of every model in the pool.
+func (p *Pool) snapshot() []*ModelLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	limiters := make([]*ModelLimiter, 0, len(p.limiters))
+	for _, ml := range p.limiters {
+		limiters = append(limiters, ml)
+	}
+	return limiters
+}
+
+// sharedLimiters returns the shared limiters of the pool.
+func (p *Pool) sharedLimiters() []*SharedLimiter {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.shared
+}
+
+// Limiter returns the ModelLimiter of a model, nil when it is not in the pool.
+func (p *Pool) Limiter(model string) *ModelLimiter {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	// round-robin check
-	n := len(models)
-	for i := range n {
-		idx := (p.next + i) % n
-		ml := p.limiters[models[idx]]
-		if ml.ReqLimiter.Allow() && tokensNeeded < ml.LLM.ContextLength && float64(tokensNeeded) <= ml.TokenLimiter.Tokens() {
-			p.next = (idx + 1) % n
-			return ml
+	return p.limiters[model]
+}
+
+// Do routes a request by its model name, which may be a configured model,
+// a group or anything else to pick from the whole pool, and executes it.
+// Retryable upstream failures are retried on the next eligible model of the
+// same group (or pool) with exponential backoff, as long as the request
+// deadline allows. The configured default timeout bounds all attempts
+// together, not each one. The last model used is returned along with the
+// result.
+func (p *Pool) Do(ctx context.Context, req *api.Request) (*api.Response, *ModelLimiter, error) {
+	// clients overwrite the model name with the upstream one
+	target := req.Request.Model
+	cache := p.responseCache()
+	var cacheKey requestHash
+	cacheable := false
+	if cache != nil {
+		cacheKey, cacheable = cache.key(target, req)
+	}
+	if cacheable && !req.NoCache {
+		if resp, model, ok := cache.get(cacheKey); ok {
+			// served without a provider, nothing is charged to the limiters
+			p.metrics.cached(CacheHit)
+			return resp, p.Limiter(model), nil
 		}
 	}
+	needs := NeedsOf(req)
+	if err := p.check(target, req, needs); err != nil {
+		return nil, nil, err
+	}
+	ctx = withGroup(ctx, p.groupLabel(target))
+
+	retry, _ := p.settings()
+	ctx, cancel := p.withTimeout(ctx)
+	// a streamed response releases the timeout once it is closed
+	streaming := false
+	defer func() {
+		if !streaming {
+			cancel()
+		}
+	}()
+	deadline, hasDeadline := ctx.Deadline()
+
+	tried := make(map[string]bool)
+	var ml *ModelLimiter
+	var lastErr error
+	for attempt := 1; attempt <= retry.MaxAttempts; attempt++ {
+		if attempt > 1 {
+			backoff := retry.Backoff(attempt - 1)
+			if hasDeadline && time.Now().Add(backoff).After(deadline) {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ml, ctx.Err()
+			case <-time.After(backoff):
+			}
+		}
 
-	// fallback to highest quality
-	return p.limiters[models[0]]
+		next := p.route(target, req, needs, tried)
+		if next == nil {
+			// every candidate failed once, start another round over all of them
+			clear(tried)
+			next = p.route(target, req, needs, tried)
+		}
+		if next == nil {
+			break
+		}
+		ml = next
+
+		resp, err := p.attempt(ctx, ml, req, cancel)
+		if err == nil {
+			streaming = resp.Stream != nil
+			switch {
+			case cache == nil:
+			case cacheable && resp.Response != nil:
+				cache.put(cacheKey, ml.LLM.Model, resp.Response)
+				resp.Cache = CacheMiss
+				if req.NoCache {
+					resp.Cache = CacheBypass
+				}
+			default:
+				resp.Cache = CacheBypass
+			}
+			if resp.Cache != "" {
+				p.metrics.cached(resp.Cache)
+			}
+			return resp, ml, nil
+		}
+		lastErr = err
+		if !api.IsRetryable(err) && !errors.Is(err, ErrCircuitOpen) {
+			break
+		}
+		log.Warn().Err(err).Str("model", ml.LLM.String()).Int("attempt", attempt).Msg("Upstream request failed, retrying")
+		tried[ml.LLM.Model] = true
+	}
+
+	if lastErr == nil {
+		lastErr = errors.New("no model available for " + target)
+	}
+	return nil, ml, lastErr
 }
 
-func (p *Pool) Assign(req *api.Request) *ModelLimiter {
+// settings returns the retry policy and default timeout in effect.
+func (p *Pool) settings() (RetryPolicy, time.Duration) {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
-	ml := p.limiters[req.Request.Model]
-	if ml == nil {
-		log.Fatal().Str("Model", req.Request.Model).Msg("Model not found in pool")
+	return p.retry, p.defaultTimeout
+}
+
+// responseCache returns the response cache, nil when it is disabled.
+func (p *Pool) responseCache() *responseCache {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.cache
+}
+
+// groupLabel is the group metrics of requests for target are recorded under.
+func (p *Pool) groupLabel(target string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, isModel := p.limiters[target]; isModel {
+		return ""
 	}
+	if _, isGroup := p.Groups[target]; isGroup {
+		return target
+	}
+	return "*"
+}
+
+// route resolves a target name to a ModelLimiter, skipping excluded models
+// unless the target names a single model.
+func (p *Pool) route(target string, req *api.Request, needs Needs, exclude map[string]bool) *ModelLimiter {
+	p.mu.Lock()
+	ml, isModel := p.limiters[target]
+	_, isGroup := p.Groups[target]
+	p.mu.Unlock()
 
-	return ml
+	switch {
+	case isModel:
+		return ml
+	case isGroup:
+		return p.PickGroup(needs, target, exclude)
+	case req.AllowedModels != nil:
+		return p.PickFrom(needs, req.AllowedModels, exclude)
+	default:
+		return p.PickAny(needs, exclude)
+	}
 }
 
 // DoAssigned executes a request using an available ModelLimiter,
 // blocking until both a request token and the needed tokens are reserved.
 // Returns api.Response or error (including context.DeadlineExceeded).
 func (p *Pool) DoAssigned(ctx context.Context, ml *ModelLimiter, req *api.Request) (*api.Response, error) {
-	// apply optional default timeout
-	if p.defaultTimeout > 0 {
-		ctx, cancel = context.WithTimeout(ctx, p.defaultTimeout)
-		defer cancel()
+	ctx, cancel := p.withTimeout(ctx)
+	resp, err := p.attempt(ctx, ml, req, cancel)
+	if err != nil || resp.Stream == nil {
+		cancel()
 	}
+	return resp, err
+}
 
+// withTimeout applies the optional default timeout to ctx.
+func (p *Pool) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, defaultTimeout := p.settings(); defaultTimeout > 0 {
+		return context.WithTimeout(ctx, defaultTimeout)
+	}
+	return ctx, func() {}
+}
+
+// attempt executes a request once on ml. A streamed response calls release
+// when it is closed; otherwise releasing ctx is left to the caller.
+func (p *Pool) attempt(ctx context.Context, ml *ModelLimiter, req *api.Request, release context.CancelFunc) (*api.Response, error) {
 	log.Debug().Str("Selected model", ml.LLM.String()).Int("Tokens", req.TokensNeeded).Msg("Dispatching request")
+	group := groupFrom(ctx)
 
-	// reserve one request slot
-	if err := ml.ReqLimiter.WaitN(ctx, 1); err != nil {
+	// fail fast while the backend is known to be down
+	if !ml.Breaker.Allow() {
+		err := fmt.Errorf("%s: %w", ml.LLM.String(), ErrCircuitOpen)
+		p.metrics.request(ml, group, err)
+		return nil, err
+	}
+	// respect a cooldown requested by the provider
+	queued := time.Now()
+	if err := ml.waitCooldown(ctx); err != nil {
+		ml.Breaker.release()
+		p.metrics.request(ml, group, err)
 		return nil, err
 	}
-	// reserve token budget
-	if err := ml.TokenLimiter.WaitN(ctx, req.TokensNeeded); err != nil {
+	// reserve one request slot and the token budget, including shared limits
+	if err := ml.wait(ctx, req.TokensNeeded); err != nil {
+		ml.Breaker.release()
+		p.metrics.request(ml, group, err)
 		return nil, err
 	}
+	waited := time.Since(queued)
+	p.metrics.waited(ml, group, waited)
 	// execute the call
-	return ml.LLM.Client.POSTChatCompletion(ctx, req, ml.LLM.Model)
+	start := time.Now()
+	resp, err := ml.LLM.Client.POSTChatCompletion(ctx, req, ml.LLM.Model)
+	if resp != nil {
+		resp.QueueTime = waited
+	}
+	ml.Breaker.Record(err)
+	ml.observeResult(resp, err)
+	p.metrics.request(ml, group, err)
+	if err == nil && resp.Stream != nil {
+		// the stream outlives this call, release the timeout once it is closed
+		resp.Stream = &pooledStream{
+			Stream:    resp.Stream,
+			cancel:    release,
+			ml:        ml,
+			metrics:   p.metrics,
+			group:     group,
+			estimated: req.TokensNeeded,
+			start:     start,
+		}
+		return resp, nil
+	}
+	if err == nil && resp.Response != nil {
+		elapsed := time.Since(start)
+		ml.Stats.Record(elapsed, elapsed)
+		ml.reconcile(req.TokensNeeded, &resp.Response.Usage)
+		p.metrics.completed(ml, group, elapsed, req.TokensNeeded, &resp.Response.Usage)
+	}
+	return resp, err
+}
+
+// pooledStream releases the request context of a streamed response on Close
+// and reconciles the token estimate with the usage reported in the stream.
+type pooledStream struct {
+	api.Stream
+	cancel    context.CancelFunc
+	ml        *ModelLimiter
+	metrics   *poolMetrics
+	group     string
+	estimated int
+	usage     *openai.Usage
+	start     time.Time
+	ttfb      time.Duration // time until the first chunk arrived
+	completed bool          // the upstream finished the stream
+}
+
+func (s *pooledStream) Recv() (*openai.ChatCompletionChunk, error) {
+	chunk, err := s.Stream.Recv()
+	switch {
+	case err == io.EOF:
+		s.completed = true
+	case err == nil && s.ttfb == 0:
+		s.ttfb = time.Since(s.start)
+	}
+	if err == nil && chunk.Usage != nil {
+		s.usage = chunk.Usage
+	}
+	return chunk, err
+}
+
+func (s *pooledStream) Close() error {
+	defer s.cancel()
+	// only complete streams say how long the model takes to answer
+	if s.completed {
+		elapsed := time.Since(s.start)
+		s.ml.Stats.Record(elapsed, s.ttfb)
+		s.metrics.completed(s.ml, s.group, elapsed, s.estimated, s.usage)
+	}
+	s.ml.reconcile(s.estimated, s.usage)
+	return s.Stream.Close()
 }
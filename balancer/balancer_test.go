@@ -0,0 +1,809 @@
+package balancer_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/balancer"
+	"llm-balancer/llm"
+	"llm-balancer/openai"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func testLLM(model string, server *ghttp.Server, quality int) *llm.LLM {
+	return &llm.LLM{
+		Name:           model,
+		Provider:       "openai",
+		Model:          model,
+		BaseURL:        server.URL(),
+		APIKey:         "test-key",
+		RequestsPerMin: 600,
+		TokensPerMin:   100000,
+		Quality:        quality,
+	}
+}
+
+func testRequest(model string) *api.Request {
+	return &api.Request{
+		Request: &openai.ChatCompletionRequest{
+			Model:    model,
+			Messages: []openai.Message{{Role: "user", Content: "hi"}},
+		},
+		TokensNeeded: 10,
+	}
+}
+
+func completion(model string) openai.ChatCompletionResponse {
+	content := "hello from " + model
+	return openai.ChatCompletionResponse{
+		ID:     "id-" + model,
+		Object: "chat.completion",
+		Model:  model,
+		Choices: []openai.Choice{{
+			Message:      openai.CompletionMessage{Role: "assistant", Content: &content},
+			FinishReason: "stop",
+		}},
+	}
+}
+
+var _ = Describe("Pool", func() {
+	var (
+		first, second *ghttp.Server
+		pool          *balancer.Pool
+	)
+
+	BeforeEach(func() {
+		first = ghttp.NewServer()
+		second = ghttp.NewServer()
+
+		var err error
+		pool, err = balancer.NewPool(balancer.Config{
+			Models: []*llm.LLM{testLLM("first", first, 9), testLLM("second", second, 5)},
+			Groups: map[string][]string{"both": {"first", "second"}},
+			Retry:  balancer.RetryPolicy{MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 1},
+		})
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		first.Close()
+		second.Close()
+	})
+
+	Describe("Do", func() {
+		It("fails over to another group member on a retryable error", func() {
+			first.AppendHandlers(ghttp.RespondWith(http.StatusServiceUnavailable, "overloaded"))
+			second.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("second")))
+
+			resp, ml, err := pool.Do(context.Background(), testRequest("both"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.LLM.Model).To(Equal("second"))
+			Expect(resp.Response.ID).To(Equal("id-second"))
+			Expect(first.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("retries a single model until it succeeds", func() {
+			first.AppendHandlers(
+				ghttp.RespondWith(http.StatusTooManyRequests, "slow down", http.Header{"Retry-After-Ms": {"10"}}),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")),
+			)
+
+			resp, ml, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.LLM.Model).To(Equal("first"))
+			Expect(resp.Response.ID).To(Equal("id-first"))
+			Expect(second.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("does not retry a rejected request", func() {
+			first.AppendHandlers(ghttp.RespondWith(http.StatusBadRequest, "bad request"))
+
+			_, _, err := pool.Do(context.Background(), testRequest("first"))
+			var statusErr *api.StatusError
+			Expect(err).To(BeAssignableToTypeOf(statusErr))
+			Expect(first.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("gives up after the configured number of attempts", func() {
+			for range 3 {
+				first.AppendHandlers(ghttp.RespondWith(http.StatusBadGateway, "down"))
+			}
+
+			_, _, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).To(MatchError(ContainSubstring("status code 502")))
+			Expect(first.ReceivedRequests()).To(HaveLen(3))
+		})
+
+		It("bounds all attempts together by the default timeout", func() {
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models:         []*llm.LLM{testLLM("first", first, 9)},
+				ContextTimeout: 200 * time.Millisecond,
+				Retry:          balancer.RetryPolicy{MaxAttempts: 3, InitialBackoffMs: 1, MaxBackoffMs: 1},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			slow := ghttp.CombineHandlers(
+				func(http.ResponseWriter, *http.Request) { time.Sleep(150 * time.Millisecond) },
+				ghttp.RespondWith(http.StatusBadGateway, "down"),
+			)
+			first.AppendHandlers(slow, slow, slow)
+
+			start := time.Now()
+			_, _, err = pool.Do(context.Background(), testRequest("first"))
+			Expect(err).To(HaveOccurred())
+			Expect(time.Since(start)).To(BeNumerically("<", 270*time.Millisecond))
+			Expect(first.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Describe("modalities", func() {
+		imageRequest := func(model string) *api.Request {
+			req := testRequest(model)
+			req.Request.Messages = []openai.Message{{Role: "user", Content: []openai.ContentPart{
+				{Type: "text", Text: "what is this?"},
+				{Type: "image_url", ImageURL: &openai.ImageURL{URL: "data:image/png;base64,AAAA"}},
+			}}}
+			return req
+		}
+
+		It("works out the modalities a request needs", func() {
+			req := imageRequest("both").Request
+			req.Modalities = []string{"text", "audio"}
+			Expect(balancer.RequiredModalities(req)).To(Equal([]string{llm.ModalityVision, llm.ModalityAudio}))
+			Expect(balancer.RequiredModalities(testRequest("both").Request)).To(BeEmpty())
+		})
+
+		It("routes to a group member supporting them", func() {
+			var err error
+			vision := testLLM("second", second, 5)
+			vision.Modalities = []string{llm.ModalityText, llm.ModalityVision}
+			pool, err = balancer.NewPool(balancer.Config{
+				Models: []*llm.LLM{testLLM("first", first, 9), vision},
+				Groups: map[string][]string{"both": {"first", "second"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			second.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("second")))
+
+			_, ml, err := pool.Do(context.Background(), imageRequest("both"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.LLM.Model).To(Equal("second"))
+			Expect(first.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("fails without calling a provider when no model supports them", func() {
+			_, _, err := pool.Do(context.Background(), imageRequest("both"))
+			Expect(err).To(MatchError(balancer.ErrUnsupportedModality))
+			Expect(err).To(MatchError(ContainSubstring("vision")))
+			Expect(first.ReceivedRequests()).To(BeEmpty())
+			Expect(second.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+
+	Describe("capabilities", func() {
+		toolRequest := func(model string) *api.Request {
+			req := testRequest(model)
+			req.Request.Tools = []openai.Tool{{Type: "function", Function: openai.Function{Name: "lookup"}}}
+			req.Request.ResponseFormat = &openai.ResponseFormat{Type: "json_schema"}
+			return req
+		}
+
+		BeforeEach(func() {
+			var err error
+			plain := testLLM("first", first, 9)
+			plain.Capabilities = []string{llm.CapabilityTools, llm.CapabilitySeed}
+			capable := testLLM("second", second, 5)
+			capable.Capabilities = []string{llm.CapabilityTools, llm.CapabilityJSONSchema}
+			pool, err = balancer.NewPool(balancer.Config{
+				Models: []*llm.LLM{plain, capable},
+				Groups: map[string][]string{"both": {"first", "second"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("works out the features a request uses", func() {
+			n, seed := 2, 7
+			req := toolRequest("both").Request
+			req.N, req.Seed = &n, &seed
+			Expect(balancer.RequiredCapabilities(req)).To(Equal([]string{
+				llm.CapabilityTools, llm.CapabilityJSONSchema, llm.CapabilitySeed, llm.CapabilityMultipleChoices,
+			}))
+			Expect(balancer.RequiredCapabilities(testRequest("both").Request)).To(BeEmpty())
+		})
+
+		It("skips models that do not declare them", func() {
+			for range 3 {
+				Expect(pool.PickGroup(balancer.NeedsOf(toolRequest("both")), "both", nil).LLM.Model).To(Equal("second"))
+				Expect(pool.PickAny(balancer.NeedsOf(toolRequest("both")), nil).LLM.Model).To(Equal("second"))
+			}
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10, Capabilities: []string{llm.CapabilityTools}}, "both", map[string]bool{"second": true}).LLM.Model).To(Equal("first"))
+		})
+
+		It("assumes a model declaring no capabilities serves them all", func() {
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models: []*llm.LLM{testLLM("first", first, 9), testLLM("second", second, 5)},
+				Groups: map[string][]string{"both": {"first", "second"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pool.PickGroup(balancer.NeedsOf(toolRequest("both")), "both", nil).LLM.Model).To(Equal("first"))
+		})
+
+		It("fails without calling the provider of a model that cannot serve them", func() {
+			_, _, err := pool.Do(context.Background(), toolRequest("first"))
+			Expect(err).To(MatchError(balancer.ErrUnsupportedCapability))
+			Expect(err).To(MatchError(ContainSubstring("json_schema")))
+			Expect(first.ReceivedRequests()).To(BeEmpty())
+		})
+	})
+
+	Describe("rate limit headers", func() {
+		It("drains the token bucket to the remaining quota", func() {
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first"), http.Header{
+				"X-Ratelimit-Remaining-Tokens":   {"500"},
+				"X-Ratelimit-Remaining-Requests": {"14000"},
+				"X-Ratelimit-Reset-Tokens":       {"7.66s"},
+			}))
+
+			_, ml, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.TokenLimiter.Tokens()).To(BeNumerically("~", 500, 50))
+			Expect(ml.CooldownUntil()).To(BeZero())
+		})
+
+		It("does not drain the request bucket with Groq's daily request count", func() {
+			groq := testLLM("groq", first, 9)
+			groq.Provider = "groq"
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{Models: []*llm.LLM{groq, testLLM("second", second, 5)}})
+			Expect(err).NotTo(HaveOccurred())
+			daily := http.Header{"X-Ratelimit-Remaining-Requests": {"3"}, "X-Ratelimit-Reset-Requests": {"2m59.56s"}}
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("groq"), daily))
+			second.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("second"), daily))
+
+			_, ml, err := pool.Do(context.Background(), testRequest("groq"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.ReqLimiter.Tokens()).To(BeNumerically(">", 100))
+
+			_, ml, err = pool.Do(context.Background(), testRequest("second"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.ReqLimiter.Tokens()).To(BeNumerically("~", 3, 1))
+		})
+
+		It("reads the request headers of api.groq.com as daily whatever the provider", func() {
+			for _, provider := range []string{"openai", "openrouter"} {
+				groq := &llm.LLM{Provider: provider, BaseURL: "https://api.groq.com/openai/v1"}
+				Expect(groq.SetClient()).To(Succeed())
+				Expect(groq.Client).To(HaveField("DailyRequests", BeTrue()))
+			}
+			other := &llm.LLM{Provider: "openai", BaseURL: "https://api.openai.com/v1"}
+			Expect(other.SetClient()).To(Succeed())
+			Expect(other.Client).To(HaveField("DailyRequests", BeFalse()))
+		})
+
+		It("cools a model down until retry-after on a 429", func() {
+			first.AppendHandlers(ghttp.RespondWith(http.StatusTooManyRequests, "slow down", http.Header{"Retry-After": {"30"}}))
+			second.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("second")))
+
+			_, ml, err := pool.Do(context.Background(), testRequest("both"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.LLM.Model).To(Equal("second"))
+
+			cooling := pool.Limiter("first")
+			Expect(cooling.CooldownUntil()).To(BeTemporally("~", time.Now().Add(30*time.Second), time.Second))
+		})
+	})
+
+	Describe("shared limits", func() {
+		BeforeEach(func() {
+			models := []*llm.LLM{testLLM("first", first, 9), testLLM("second", second, 5)}
+			for _, m := range models {
+				m.LimitBuckets = []string{"account"}
+			}
+
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models:       models,
+				SharedLimits: []*balancer.SharedLimit{{Name: "account", Scope: balancer.ScopeBucket, RequestsPerMin: 1, TokensPerMin: 1000}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("charges a request to every member of the bucket", func() {
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")))
+
+			_, ml, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.Shared).To(HaveLen(1))
+			Expect(ml.Shared[0].ReqLimiter.Tokens()).To(BeNumerically("<", 1))
+
+			other := pool.Limiter("second")
+			Expect(other.Shared[0]).To(BeIdenticalTo(ml.Shared[0]))
+		})
+
+		It("gives back what was reserved when a shared limit cannot be waited for", func() {
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")))
+			_, _, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).NotTo(HaveOccurred())
+
+			// the shared bucket refills one request a minute
+			ml := pool.Limiter("second")
+			requests, tokens := ml.ReqLimiter.Tokens(), ml.TokenLimiter.Tokens()
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			_, err = pool.DoAssigned(ctx, ml, testRequest("second"))
+			Expect(err).To(MatchError(ContainSubstring("would exceed the request deadline")))
+			Expect(ml.ReqLimiter.Tokens()).To(BeNumerically("~", requests, 0.01))
+			Expect(ml.TokenLimiter.Tokens()).To(BeNumerically("~", tokens, 1))
+			Expect(ml.Shared[0].TokenLimiter.Tokens()).To(BeNumerically(">", 980))
+			Expect(second.ReceivedRequests()).To(BeEmpty())
+		})
+
+		It("rejects models referencing an unknown bucket", func() {
+			m := testLLM("third", first, 1)
+			m.LimitBuckets = []string{"missing"}
+			_, err := balancer.NewPool(balancer.Config{Models: []*llm.LLM{m}})
+			Expect(err).To(MatchError(ContainSubstring("unknown limit bucket missing")))
+		})
+	})
+
+	Describe("usage reconciliation", func() {
+		withUsage := func(model string, prompt, completionTokens int) openai.ChatCompletionResponse {
+			resp := completion(model)
+			resp.Usage = openai.Usage{PromptTokens: prompt, CompletionTokens: completionTokens, TotalTokens: prompt + completionTokens}
+			return resp
+		}
+
+		It("charges completion tokens beyond the estimate", func() {
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, withUsage("first", 10, 990)))
+
+			_, ml, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ml.TokenLimiter.Tokens()).To(BeNumerically("~", 99000, 200))
+		})
+
+		It("refunds an overestimate to later requests", func() {
+			small := testLLM("small", first, 9)
+			small.TokensPerMin = 1000
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models: []*llm.LLM{small, testLLM("second", second, 5)},
+				Groups: map[string][]string{"pair": {"small", "second"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, withUsage("small", 50, 50)))
+			req := testRequest("small")
+			req.TokensNeeded = 900
+			_, _, err = pool.Do(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 900}, "pair", nil).LLM.Model).To(Equal("small"))
+		})
+	})
+
+	Describe("selection strategies", func() {
+		var cheap, good *llm.LLM
+
+		newPool := func(strategy balancer.StrategyConfig) {
+			sorter, err := balancer.NewSortStrategy(strategy)
+			Expect(err).NotTo(HaveOccurred())
+			pool, err = balancer.NewPool(balancer.Config{
+				Models:       []*llm.LLM{cheap, good},
+				Groups:       map[string][]string{"both": {"cheap", "good"}},
+				SortStrategy: &balancer.RoundRobinSortStrategy{},
+				GroupSorters: map[string]balancer.SortStrategy{"both": sorter},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		}
+
+		BeforeEach(func() {
+			cheap = testLLM("cheap", first, 3)
+			good = testLLM("good", second, 9)
+			good.CostInput, good.CostOutput = 0.00001, 0.00003
+		})
+
+		It("prefers the cheapest model when cost dominates", func() {
+			newPool(balancer.StrategyConfig{Weights: &balancer.OptimizationWeights{Cost: 1, Quality: 0.2}})
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "both", nil).LLM.Model).To(Equal("cheap"))
+		})
+
+		It("prefers the best model when quality dominates", func() {
+			newPool(balancer.StrategyConfig{Strategy: balancer.StrategyWeighted, Weights: &balancer.OptimizationWeights{Cost: 0.2, Quality: 1}})
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "both", nil).LLM.Model).To(Equal("good"))
+		})
+
+		It("uses the pool default outside of groups", func() {
+			newPool(balancer.StrategyConfig{Strategy: balancer.StrategyQuality})
+			picked := []string{pool.PickAny(balancer.Needs{Tokens: 10}, nil).LLM.Model, pool.PickAny(balancer.Needs{Tokens: 10}, nil).LLM.Model}
+			Expect(picked).To(ConsistOf("cheap", "good"))
+		})
+
+		It("picks only among the given models", func() {
+			newPool(balancer.StrategyConfig{Strategy: balancer.StrategyQuality})
+			for range 3 {
+				Expect(pool.PickFrom(balancer.Needs{Tokens: 10}, []string{"cheap", "unknown"}, nil).LLM.Model).To(Equal("cheap"))
+			}
+			Expect(pool.PickFrom(balancer.Needs{Tokens: 10}, []string{"cheap"}, map[string]bool{"cheap": true})).To(BeNil())
+		})
+
+		It("rejects weighted strategies without weights", func() {
+			_, err := balancer.NewSortStrategy(balancer.StrategyConfig{Strategy: balancer.StrategyWeighted})
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("latency statistics", func() {
+		It("tracks the moving average and percentiles", func() {
+			var stats balancer.LatencyStats
+			for i := 1; i <= 100; i++ {
+				stats.Record(time.Duration(i)*time.Millisecond, time.Millisecond)
+			}
+
+			snap := stats.Snapshot()
+			Expect(snap.Count).To(BeEquivalentTo(100))
+			Expect(snap.P50).To(Equal(50 * time.Millisecond))
+			Expect(snap.P95).To(Equal(95 * time.Millisecond))
+			Expect(snap.TTFB).To(Equal(time.Millisecond))
+			Expect(snap.EWMA).To(BeNumerically(">", 90*time.Millisecond))
+		})
+
+		It("picks the model expected to answer first", func() {
+			sorter, err := balancer.NewSortStrategy(balancer.StrategyConfig{Strategy: balancer.StrategyFastest})
+			Expect(err).NotTo(HaveOccurred())
+			pool, err = balancer.NewPool(balancer.Config{
+				Models:       []*llm.LLM{testLLM("first", first, 9), testLLM("second", second, 5)},
+				Groups:       map[string][]string{"fast": {"first", "second"}},
+				GroupSorters: map[string]balancer.SortStrategy{"fast": sorter},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			pool.Limiter("first").Stats.Record(2*time.Second, time.Second)
+			pool.Limiter("second").Stats.Record(200*time.Millisecond, 50*time.Millisecond)
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "fast", nil).LLM.Model).To(Equal("second"))
+
+			// a drained bucket outweighs a faster model
+			pool.Limiter("second").TokenLimiter.ReserveN(time.Now(), 100000)
+			Expect(pool.Limiter("second").ExpectedWait(5000, time.Now())).To(BeNumerically(">", 2*time.Second))
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 5000}, "fast", nil).LLM.Model).To(Equal("first"))
+		})
+	})
+
+	Describe("circuit breaker", func() {
+		BeforeEach(func() {
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models:  []*llm.LLM{testLLM("first", first, 9), testLLM("second", second, 5)},
+				Groups:  map[string][]string{"both": {"first", "second"}},
+				Retry:   balancer.RetryPolicy{MaxAttempts: 1},
+				Breaker: balancer.BreakerConfig{ConsecutiveFailures: 2, OpenSeconds: 1},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("opens after consecutive failures and skips the model", func() {
+			first.AppendHandlers(
+				ghttp.RespondWith(http.StatusInternalServerError, "boom"),
+				ghttp.RespondWith(http.StatusInternalServerError, "boom"),
+			)
+			for range 2 {
+				_, _, err := pool.Do(context.Background(), testRequest("first"))
+				Expect(err).To(HaveOccurred())
+			}
+			Expect(pool.Limiter("first").Breaker.State()).To(Equal(balancer.CircuitOpen))
+
+			_, _, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).To(MatchError(balancer.ErrCircuitOpen))
+			Expect(first.ReceivedRequests()).To(HaveLen(2))
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "both", nil).LLM.Model).To(Equal("second"))
+		})
+
+		It("does not count rate limits as failures", func() {
+			breaker := pool.Limiter("first").Breaker
+			for range 3 {
+				breaker.Record(&api.StatusError{StatusCode: http.StatusTooManyRequests})
+			}
+			Expect(breaker.State()).To(Equal(balancer.CircuitClosed))
+		})
+
+		It("closes again after a successful half-open probe", func() {
+			breaker := pool.Limiter("first").Breaker
+			breaker.Record(&api.StatusError{StatusCode: http.StatusBadGateway})
+			breaker.Record(&api.StatusError{StatusCode: http.StatusBadGateway})
+			Expect(breaker.Allow()).To(BeFalse())
+
+			time.Sleep(time.Second)
+			Expect(breaker.State()).To(Equal(balancer.CircuitHalfOpen))
+			Expect(breaker.Allow()).To(BeTrue())
+			Expect(breaker.Allow()).To(BeFalse())
+			breaker.Record(nil)
+			Expect(breaker.State()).To(Equal(balancer.CircuitClosed))
+		})
+	})
+
+	Describe("health checks", func() {
+		listing := func(models ...string) http.HandlerFunc {
+			data := make([]map[string]string, 0, len(models))
+			for _, model := range models {
+				data = append(data, map[string]string{"id": model})
+			}
+			return ghttp.CombineHandlers(
+				ghttp.VerifyRequest(http.MethodGet, "/models"),
+				ghttp.VerifyHeaderKV("Authorization", "Bearer test-key"),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, map[string]any{"data": data}),
+			)
+		}
+		cfg := balancer.HealthConfig{FailureThreshold: 2, TimeoutSeconds: 1}
+
+		It("marks a model unhealthy after repeated failures and skips it", func() {
+			first.RouteToHandler(http.MethodGet, "/models", ghttp.RespondWith(http.StatusUnauthorized, "bad key"))
+			second.RouteToHandler(http.MethodGet, "/models", listing("second"))
+
+			failures := pool.CheckAll(context.Background(), cfg)
+			Expect(failures).To(HaveKey("first"))
+			Expect(pool.Limiter("first").Healthy()).To(BeTrue())
+
+			pool.CheckAll(context.Background(), cfg)
+			Expect(pool.Limiter("first").Healthy()).To(BeFalse())
+			Expect(pool.Limiter("first").HealthError()).To(HaveOccurred())
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "both", nil).LLM.Model).To(Equal("second"))
+		})
+
+		It("fails models missing from the provider's listing", func() {
+			first.RouteToHandler(http.MethodGet, "/models", listing("other"))
+			second.RouteToHandler(http.MethodGet, "/models", listing("second"))
+
+			failures := pool.CheckAll(context.Background(), cfg)
+			Expect(failures).To(HaveLen(1))
+			Expect(failures["first"]).To(MatchError(ContainSubstring("not served")))
+		})
+
+		It("recovers on the first successful check", func() {
+			first.RouteToHandler(http.MethodGet, "/models", ghttp.RespondWith(http.StatusBadGateway, "down"))
+			second.RouteToHandler(http.MethodGet, "/models", listing("second"))
+			pool.CheckAll(context.Background(), cfg)
+			pool.CheckAll(context.Background(), cfg)
+			Expect(pool.Limiter("first").Healthy()).To(BeFalse())
+
+			first.RouteToHandler(http.MethodGet, "/models", listing("first"))
+			Expect(pool.CheckAll(context.Background(), cfg)).To(BeEmpty())
+			Expect(pool.Limiter("first").Healthy()).To(BeTrue())
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "both", nil).LLM.Model).To(Equal("first"))
+		})
+
+		It("looks Anthropic models up instead of sending a completion", func() {
+			claude := testLLM("claude-test-0", first, 9)
+			claude.Provider = "anthropic"
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{Models: []*llm.LLM{claude}})
+			Expect(err).NotTo(HaveOccurred())
+			first.RouteToHandler(http.MethodGet, "/models/claude-test-0", ghttp.CombineHandlers(
+				ghttp.VerifyHeaderKV("x-api-key", "test-key"),
+				ghttp.RespondWith(http.StatusOK, `{"type":"model","id":"claude-test-20250101"}`),
+			))
+
+			Expect(pool.CheckAll(context.Background(), cfg)).To(BeEmpty())
+			Expect(first.ReceivedRequests()).To(HaveLen(1))
+			Expect(first.ReceivedRequests()[0].Method).To(Equal(http.MethodGet))
+		})
+	})
+
+	Describe("metrics", func() {
+		It("records outcomes, usage and cost per model and group", func() {
+			registry := prometheus.NewRegistry()
+			priced := testLLM("first", first, 9)
+			priced.CostInput, priced.CostOutput = 0.001, 0.002
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models:  []*llm.LLM{priced, testLLM("second", second, 5)},
+				Groups:  map[string][]string{"both": {"first", "second"}},
+				Retry:   balancer.RetryPolicy{MaxAttempts: 2, InitialBackoffMs: 1, MaxBackoffMs: 1},
+				Metrics: registry,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			resp := completion("first")
+			resp.Usage = openai.Usage{PromptTokens: 100, CompletionTokens: 50, TotalTokens: 150}
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, resp))
+			second.RouteToHandler(http.MethodPost, "/chat/completions", ghttp.RespondWith(http.StatusServiceUnavailable, "overloaded"))
+
+			req := testRequest("both")
+			req.Request.Model = "both"
+			_, _, err = pool.Do(context.Background(), req)
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = pool.Do(context.Background(), testRequest("second"))
+			Expect(err).To(HaveOccurred())
+
+			rec := httptest.NewRecorder()
+			promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+			out := rec.Body.String()
+			Expect(out).To(ContainSubstring(`llm_balancer_requests_total{group="both",model="first",outcome="success",provider="openai"} 1`))
+			Expect(out).To(ContainSubstring(`llm_balancer_requests_total{group="",model="second",outcome="server_error",provider="openai"} 2`))
+			Expect(out).To(ContainSubstring(`llm_balancer_prompt_tokens_total{group="both",model="first",provider="openai"} 100`))
+			Expect(out).To(ContainSubstring(`llm_balancer_estimated_tokens_total{group="both",model="first",provider="openai"} 10`))
+			Expect(out).To(ContainSubstring(`llm_balancer_cost_dollars_total{group="both",model="first",provider="openai"} 0.2`))
+			Expect(out).To(ContainSubstring(`llm_balancer_upstream_latency_seconds_count{group="both",model="first",provider="openai"} 1`))
+			Expect(out).To(ContainSubstring(`llm_balancer_limiter_remaining_requests{model="first",provider="openai"}`))
+			Expect(out).To(ContainSubstring(`llm_balancer_model_up{model="second",provider="openai"}`))
+		})
+	})
+
+	Describe("response cache", func() {
+		deterministic := func(model string) *api.Request {
+			req := testRequest(model)
+			zero := 0.0
+			req.Request.Temperature = &zero
+			return req
+		}
+
+		BeforeEach(func() {
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models: []*llm.LLM{testLLM("first", first, 9)},
+				Cache:  balancer.CacheConfig{Enabled: true, MaxEntries: 1},
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("answers a repeated deterministic request without the provider", func() {
+			first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")))
+
+			resp, _, err := pool.Do(context.Background(), deterministic("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheMiss))
+			remaining := pool.Limiter("first").ReqLimiter.Tokens()
+
+			resp, ml, err := pool.Do(context.Background(), deterministic("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheHit))
+			Expect(resp.Response.ID).To(Equal("id-first"))
+			Expect(ml.LLM.Model).To(Equal("first"))
+			Expect(first.ReceivedRequests()).To(HaveLen(1))
+			Expect(ml.ReqLimiter.Tokens()).To(BeNumerically(">=", remaining))
+		})
+
+		It("bypasses requests that are not deterministic or ask for a fresh response", func() {
+			for range 3 {
+				first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")))
+			}
+
+			resp, _, err := pool.Do(context.Background(), testRequest("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheBypass))
+
+			Expect(pool.Do(context.Background(), deterministic("first"))).Error().NotTo(HaveOccurred())
+			fresh := deterministic("first")
+			fresh.NoCache = true
+			resp, _, err = pool.Do(context.Background(), fresh)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheBypass))
+			Expect(first.ReceivedRequests()).To(HaveLen(3))
+		})
+
+		It("tells apart requests by every setting that changes the answer", func() {
+			var err error
+			pool, err = balancer.NewPool(balancer.Config{
+				Models: []*llm.LLM{testLLM("first", first, 9)},
+				Cache:  balancer.CacheConfig{Enabled: true},
+			})
+			Expect(err).NotTo(HaveOccurred())
+			for range 2 {
+				first.AppendHandlers(ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")))
+			}
+
+			Expect(pool.Do(context.Background(), deterministic("first"))).Error().NotTo(HaveOccurred())
+			penalized := deterministic("first")
+			penalty := 0.5
+			penalized.Request.FrequencyPenalty = &penalty
+			resp, _, err := pool.Do(context.Background(), penalized)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheMiss))
+
+			tagged := deterministic("first")
+			tagged.Request.User = "someone"
+			tagged.Request.Metadata = map[string]string{"run": "2"}
+			resp, _, err = pool.Do(context.Background(), tagged)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheHit))
+			Expect(first.ReceivedRequests()).To(HaveLen(2))
+		})
+
+		It("evicts the least recently used response beyond its size", func() {
+			first.AppendHandlers(
+				ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")),
+				ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")),
+			)
+			other := deterministic("first")
+			other.Request.Messages[0].Content = "something else"
+
+			Expect(pool.Do(context.Background(), deterministic("first"))).Error().NotTo(HaveOccurred())
+			Expect(pool.Do(context.Background(), other)).Error().NotTo(HaveOccurred())
+			resp, _, err := pool.Do(context.Background(), deterministic("first"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.Cache).To(Equal(balancer.CacheMiss))
+			Expect(first.ReceivedRequests()).To(HaveLen(3))
+		})
+	})
+
+	Describe("runtime changes", func() {
+		It("lets in-flight requests finish on a removed model", func() {
+			release := make(chan struct{})
+			first.AppendHandlers(ghttp.CombineHandlers(
+				func(http.ResponseWriter, *http.Request) { <-release },
+				ghttp.RespondWithJSONEncoded(http.StatusOK, completion("first")),
+			))
+
+			done := make(chan error)
+			go func() {
+				_, _, err := pool.Do(context.Background(), testRequest("first"))
+				done <- err
+			}()
+			Eventually(first.ReceivedRequests).Should(HaveLen(1))
+
+			Expect(pool.RemoveModel("first")).To(Succeed())
+			Expect(pool.Limiter("first")).To(BeNil())
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "both", nil).LLM.Model).To(Equal("second"))
+			close(release)
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("keeps the limiter buckets of an updated model", func() {
+			ml := pool.Limiter("first")
+			Expect(ml.ReqLimiter.AllowN(time.Now(), 100)).To(BeTrue())
+
+			updated := ml.LLM.Clone()
+			updated.Quality = 1
+			Expect(pool.UpdateModel(updated)).To(Succeed())
+			Expect(pool.Limiter("first").LLM.Quality).To(Equal(1))
+			Expect(pool.Limiter("first").ReqLimiter.Tokens()).To(BeNumerically("~", 500, 5))
+			Expect(pool.Limiter("first").Breaker).To(BeIdenticalTo(ml.Breaker))
+		})
+
+		It("adds models to the groups they belong to", func() {
+			third := testLLM("third", first, 1)
+			third.Groups = []string{"both"}
+			Expect(pool.AddModel(third)).To(Succeed())
+			Expect(pool.AddModel(third)).To(MatchError(balancer.ErrModelExists))
+			Expect(pool.Groups["both"]).To(ConsistOf("first", "second", "third"))
+			Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "free", nil).LLM.Model).To(Equal("third"))
+		})
+	})
+
+	Describe("Apply", func() {
+		It("keeps the limiter state of unchanged models and drops removed ones", func() {
+			ml := pool.Limiter("first")
+			Expect(ml.ReqLimiter.AllowN(time.Now(), 100)).To(BeTrue())
+
+			err := pool.Apply(balancer.Config{
+				Models: []*llm.LLM{testLLM("first", first, 9), testLLM("third", second, 1)},
+				Groups: map[string][]string{"both": {"first", "third"}},
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(pool.Limiter("second")).To(BeNil())
+			Expect(pool.Limiter("third")).NotTo(BeNil())
+			Expect(pool.Limiter("first").ReqLimiter).To(BeIdenticalTo(ml.ReqLimiter))
+			Expect(pool.Limiter("first").ReqLimiter.Tokens()).To(BeNumerically("~", 500, 5))
+			Expect(pool.Limiter("first").Breaker).To(BeIdenticalTo(ml.Breaker))
+			Expect(pool.Groups).To(HaveKeyWithValue("both", ConsistOf("first", "third")))
+		})
+
+		It("rejects an invalid config and keeps the running one", func() {
+			err := pool.Apply(balancer.Config{
+				Models: []*llm.LLM{testLLM("first", first, 9)},
+				Groups: map[string][]string{"both": {"first", "missing"}},
+			})
+			Expect(err).To(MatchError(ContainSubstring("unknown model missing")))
+			Expect(pool.Limiter("second")).NotTo(BeNil())
+			Expect(pool.Groups["both"]).To(ConsistOf("first", "second"))
+		})
+	})
+})
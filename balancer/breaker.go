@@ -0,0 +1,231 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"llm-balancer/api"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Circuit states of a Breaker.
+const (
+	CircuitClosed   = "closed"    // requests flow normally
+	CircuitOpen     = "open"      // requests are rejected until the open period is over
+	CircuitHalfOpen = "half-open" // a probe request is let through to test recovery
+)
+
+// ErrCircuitOpen is returned for requests to a model whose circuit is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// BreakerConfig sets when the circuit of a model opens and how it recovers.
+type BreakerConfig struct {
+	Disabled            bool    `yaml:"disabled"`
+	ConsecutiveFailures int     `yaml:"consecutive_failures"` // open after this many failures in a row
+	ErrorRate           float64 `yaml:"error_rate"`           // open when this fraction of the window failed
+	Window              int     `yaml:"window"`               // number of recent calls the error rate is computed over
+	OpenSeconds         int     `yaml:"open_seconds"`         // time before a probe is let through
+	HalfOpenProbes      int     `yaml:"half_open_probes"`     // successful probes needed to close again
+}
+
+// DefaultBreakerConfig is used for the fields of BreakerConfig left unset.
+var DefaultBreakerConfig = BreakerConfig{
+	ConsecutiveFailures: 5,
+	ErrorRate:           0.5,
+	Window:              20,
+	OpenSeconds:         30,
+	HalfOpenProbes:      1,
+}
+
+func (c BreakerConfig) withDefaults() BreakerConfig {
+	if c.ConsecutiveFailures <= 0 {
+		c.ConsecutiveFailures = DefaultBreakerConfig.ConsecutiveFailures
+	}
+	if c.ErrorRate <= 0 {
+		c.ErrorRate = DefaultBreakerConfig.ErrorRate
+	}
+	if c.Window <= 0 {
+		c.Window = DefaultBreakerConfig.Window
+	}
+	if c.OpenSeconds <= 0 {
+		c.OpenSeconds = DefaultBreakerConfig.OpenSeconds
+	}
+	if c.HalfOpenProbes <= 0 {
+		c.HalfOpenProbes = DefaultBreakerConfig.HalfOpenProbes
+	}
+	return c
+}
+
+// Breaker is a circuit breaker guarding one model.
+type Breaker struct {
+	name string
+	cfg  BreakerConfig
+
+	mu          sync.Mutex
+	state       string
+	consecutive int
+	outcomes    []bool // ring buffer of recent results, true for a failure
+	next        int
+	openedAt    time.Time
+	probing     bool // a half-open probe is in flight
+	probesOK    int
+}
+
+func newBreaker(name string, cfg BreakerConfig) *Breaker {
+	return &Breaker{name: name, cfg: cfg.withDefaults(), state: CircuitClosed}
+}
+
+// State returns the current state, reporting an open circuit whose open
+// period is over as half-open.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen && b.openPeriodOver() {
+		return CircuitHalfOpen
+	}
+	return b.state
+}
+
+// Ready reports without side effects whether a request could be let through.
+func (b *Breaker) Ready() bool {
+	if b.cfg.Disabled {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case CircuitOpen:
+		return b.openPeriodOver()
+	case CircuitHalfOpen:
+		return !b.probing
+	}
+	return true
+}
+
+// Allow is called before sending a request. It moves an open circuit whose
+// open period is over to half-open and lets a single probe through.
+func (b *Breaker) Allow() bool {
+	if b.cfg.Disabled {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitOpen && b.openPeriodOver() {
+		b.transition(CircuitHalfOpen)
+	}
+	switch b.state {
+	case CircuitOpen:
+		return false
+	case CircuitHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// Record feeds the result of a request let through by Allow.
+func (b *Breaker) Record(err error) {
+	if b.cfg.Disabled {
+		return
+	}
+	failed := isBackendFailure(err)
+	if err != nil && !failed {
+		// the backend answered, but the outcome says nothing about its health
+		b.release()
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == CircuitHalfOpen {
+		b.probing = false
+		if failed {
+			b.transition(CircuitOpen)
+			return
+		}
+		if b.probesOK++; b.probesOK >= b.cfg.HalfOpenProbes {
+			b.transition(CircuitClosed)
+		}
+		return
+	}
+
+	if len(b.outcomes) < b.cfg.Window {
+		b.outcomes = append(b.outcomes, failed)
+	} else {
+		b.outcomes[b.next] = failed
+	}
+	b.next = (b.next + 1) % b.cfg.Window
+	if !failed {
+		b.consecutive = 0
+		return
+	}
+	b.consecutive++
+
+	if b.state == CircuitClosed && (b.consecutive >= b.cfg.ConsecutiveFailures || b.errorRate() >= b.cfg.ErrorRate) {
+		b.transition(CircuitOpen)
+	}
+}
+
+// release frees a half-open probe slot without counting the result.
+func (b *Breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// errorRate is the failure ratio of a full window, 0 until the window is full.
+func (b *Breaker) errorRate() float64 {
+	if len(b.outcomes) < b.cfg.Window {
+		return 0
+	}
+	failures := 0
+	for _, failed := range b.outcomes {
+		if failed {
+			failures++
+		}
+	}
+	return float64(failures) / float64(len(b.outcomes))
+}
+
+func (b *Breaker) openPeriodOver() bool {
+	return time.Since(b.openedAt) >= time.Duration(b.cfg.OpenSeconds)*time.Second
+}
+
+// transition changes the state and resets the counters. Callers must hold b.mu.
+func (b *Breaker) transition(state string) {
+	log.Warn().Str("model", b.name).Str("from", b.state).Str("to", state).Msg("Circuit breaker state changed")
+	b.state = state
+	b.consecutive = 0
+	b.outcomes = b.outcomes[:0]
+	b.next = 0
+	b.probesOK = 0
+	b.probing = false
+	if state == CircuitOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+// isBackendFailure reports whether an error means the backend is unhealthy:
+// server errors and transport failures. Rate limits are handled by the
+// cooldown, client errors and cancelled requests are not the backend's fault.
+func isBackendFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var statusErr *api.StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		return false
+	}
+	return api.IsRetryable(err) || errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,159 @@
+package balancer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/openai"
+)
+
+// Results of the response cache for a request, see api.Response.Cache.
+const (
+	CacheHit    = "HIT"
+	CacheMiss   = "MISS"   // sent to a provider, the response was stored
+	CacheBypass = "BYPASS" // not cacheable, or the client asked for a fresh response
+)
+
+// CacheConfig holds the settings of the exact-match response cache.
+type CacheConfig struct {
+	Enabled    bool `yaml:"enabled"`
+	TTLSeconds int  `yaml:"ttl_seconds"` // how long a response is served, defaults to an hour
+	MaxEntries int  `yaml:"max_entries"` // least recently used responses are evicted beyond, defaults to 1000
+	// Cache every request, not only deterministic ones with a temperature
+	// of 0 or a seed.
+	AllRequests bool `yaml:"all_requests"`
+}
+
+func (c CacheConfig) withDefaults() CacheConfig {
+	if c.TTLSeconds <= 0 {
+		c.TTLSeconds = 3600
+	}
+	if c.MaxEntries <= 0 {
+		c.MaxEntries = 1000
+	}
+	return c
+}
+
+// responseCache is an LRU cache of complete responses keyed on the parts
+// of a request that decide the response.
+type responseCache struct {
+	cfg CacheConfig
+
+	mu      sync.Mutex
+	entries map[requestHash]*list.Element
+	lru     *list.List // of *cacheEntry, most recently used first
+}
+
+type cacheEntry struct {
+	key      requestHash
+	model    string // the model that answered
+	response []byte // JSON, so every hit gets its own copy
+	expires  time.Time
+}
+
+func newResponseCache(cfg CacheConfig) *responseCache {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &responseCache{
+		cfg:     cfg.withDefaults(),
+		entries: make(map[requestHash]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// cacheFields are what a request is identified by in the cache: the whole
+// request, minus the fields that change how the answer is delivered or
+// recorded but not what a model answers, see key.
+type cacheFields struct {
+	Target        string                       `json:"target"`
+	AllowedModels []string                     `json:"allowed_models"` // a key limited to some models must not get answers of others
+	Request       openai.ChatCompletionRequest `json:"request"`
+}
+
+// requestHash identifies a request in the cache, see cacheFields.
+type requestHash [sha256.Size]byte
+
+// key returns the key of a request for target, false when the request may
+// not be cached: streams, and unless configured otherwise requests that are
+// not deterministic.
+func (c *responseCache) key(target string, r *api.Request) (requestHash, bool) {
+	req := r.Request
+	if req.Stream != nil && *req.Stream {
+		return requestHash{}, false
+	}
+	deterministic := (req.Temperature != nil && *req.Temperature == 0) || req.Seed != nil
+	if !deterministic && !c.cfg.AllRequests {
+		return requestHash{}, false
+	}
+	fields := cacheFields{Target: target, AllowedModels: r.AllowedModels, Request: *req}
+	// the model is part of target, the rest only concerns delivery and bookkeeping
+	fields.Request.Model = ""
+	fields.Request.Stream, fields.Request.StreamOptions = nil, nil
+	fields.Request.Metadata, fields.Request.Store, fields.Request.User = nil, nil, ""
+	fields.Request.ServiceTier = nil
+	// maps are marshalled with sorted keys, which makes the encoding canonical
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return requestHash{}, false
+	}
+	return requestHash(sha256.Sum256(data)), true
+}
+
+// get returns a copy of the response stored under key and the model that
+// answered it.
+func (c *responseCache) get(key requestHash) (*api.Response, string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, "", false
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, "", false
+	}
+	var resp openai.ChatCompletionResponse
+	if err := json.Unmarshal(entry.response, &resp); err != nil {
+		return nil, "", false
+	}
+	c.lru.MoveToFront(el)
+	return &api.Response{Response: &resp, Cache: CacheHit}, entry.model, true
+}
+
+// put stores a response, evicting the least recently used ones beyond the
+// size bound.
+func (c *responseCache) put(key requestHash, model string, resp *openai.ChatCompletionResponse) {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return
+	}
+	entry := &cacheEntry{
+		key:      key,
+		model:    model,
+		response: data,
+		expires:  time.Now().Add(time.Duration(c.cfg.TTLSeconds) * time.Second),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = entry
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.cfg.MaxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,193 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/openai"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HealthConfig sets up the background health checks of the pool.
+type HealthConfig struct {
+	Enabled          bool `yaml:"enabled"`
+	IntervalSeconds  int  `yaml:"interval_seconds"`  // time between two rounds of checks
+	TimeoutSeconds   int  `yaml:"timeout_seconds"`   // time a single check may take
+	FailureThreshold int  `yaml:"failure_threshold"` // failed checks in a row before a model is marked unhealthy
+	CheckOnStartup   bool `yaml:"check_on_startup"`  // refuse to start when a model fails its first check
+}
+
+// DefaultHealthConfig is used for the fields of HealthConfig left unset.
+var DefaultHealthConfig = HealthConfig{
+	IntervalSeconds:  60,
+	TimeoutSeconds:   10,
+	FailureThreshold: 2,
+}
+
+func (c HealthConfig) withDefaults() HealthConfig {
+	if c.IntervalSeconds <= 0 {
+		c.IntervalSeconds = DefaultHealthConfig.IntervalSeconds
+	}
+	if c.TimeoutSeconds <= 0 {
+		c.TimeoutSeconds = DefaultHealthConfig.TimeoutSeconds
+	}
+	if c.FailureThreshold <= 0 {
+		c.FailureThreshold = DefaultHealthConfig.FailureThreshold
+	}
+	return c
+}
+
+// probeTokens is the token budget charged for a completion probe.
+const probeTokens = 16
+
+// errProbeSkipped is returned when a model had no quota left for a probe.
+var errProbeSkipped = errors.New("no quota left for a health probe")
+
+// health is the outcome of the latest checks of a model.
+type health struct {
+	mu        sync.Mutex
+	unhealthy bool
+	failures  int // failed checks in a row
+	lastErr   error
+}
+
+// Healthy reports whether the model passed its latest health checks.
+// Models are healthy until checked.
+func (ml *ModelLimiter) Healthy() bool {
+	ml.health.mu.Lock()
+	defer ml.health.mu.Unlock()
+
+	return !ml.health.unhealthy
+}
+
+// HealthError returns the error of the latest failed check, nil while healthy.
+func (ml *ModelLimiter) HealthError() error {
+	ml.health.mu.Lock()
+	defer ml.health.mu.Unlock()
+
+	if !ml.health.unhealthy {
+		return nil
+	}
+	return ml.health.lastErr
+}
+
+// recordHealth feeds the result of a check, marking the model unhealthy
+// after threshold failures in a row and healthy again on the first success.
+func (ml *ModelLimiter) recordHealth(err error, threshold int) {
+	ml.health.mu.Lock()
+	defer ml.health.mu.Unlock()
+
+	if err == nil {
+		if ml.health.unhealthy {
+			log.Info().Str("model", ml.LLM.String()).Msg("Model recovered")
+		}
+		ml.health.unhealthy = false
+		ml.health.failures = 0
+		ml.health.lastErr = nil
+		return
+	}
+	ml.health.failures++
+	ml.health.lastErr = err
+	if !ml.health.unhealthy && ml.health.failures >= threshold {
+		log.Warn().Err(err).Str("model", ml.LLM.String()).Msg("Model marked unhealthy")
+		ml.health.unhealthy = true
+	}
+}
+
+// CheckHealth probes a model once. Clients looking up a single model are
+// asked for it, clients listing their provider's models are asked for the
+// list, which must contain the model; the others are sent a one token
+// completion, charged against the model's limiters and skipped when no quota
+// is left.
+func CheckHealth(ctx context.Context, ml *ModelLimiter) error {
+	if checker, ok := ml.LLM.Client.(api.ModelChecker); ok {
+		return checker.CheckModel(ctx, ml.LLM.Model)
+	}
+	if lister, ok := ml.LLM.Client.(api.ModelLister); ok {
+		models, err := lister.ListModels(ctx)
+		if err != nil {
+			return err
+		}
+		if !slices.Contains(models, ml.LLM.Model) {
+			return fmt.Errorf("model %s is not served at %s", ml.LLM.Model, ml.LLM.BaseURL)
+		}
+		return nil
+	}
+
+	if !ml.available(probeTokens) {
+		return errProbeSkipped
+	}
+	if err := ml.wait(ctx, probeTokens); err != nil {
+		return err
+	}
+	maxTokens := 1
+	_, err := ml.LLM.Client.POSTChatCompletion(ctx, &api.Request{
+		Request: &openai.ChatCompletionRequest{
+			Model:               ml.LLM.Model,
+			Messages:            []openai.Message{{Role: "user", Content: "ping"}},
+			MaxCompletionTokens: &maxTokens,
+		},
+		TokensNeeded: probeTokens,
+	}, ml.LLM.Model)
+	return err
+}
+
+// CheckAll checks every model of the pool concurrently and records the
+// results. The errors of the models that failed are returned by model name.
+func (p *Pool) CheckAll(ctx context.Context, cfg HealthConfig) map[string]error {
+	cfg = cfg.withDefaults()
+
+	limiters := p.snapshot()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	failures := make(map[string]error)
+	for _, ml := range limiters {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, time.Duration(cfg.TimeoutSeconds)*time.Second)
+			defer cancel()
+
+			err := CheckHealth(checkCtx, ml)
+			if errors.Is(err, errProbeSkipped) {
+				return
+			}
+			ml.recordHealth(err, cfg.FailureThreshold)
+			if err != nil {
+				mu.Lock()
+				failures[ml.LLM.Model] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+// StartHealthChecks checks every model on the configured interval until ctx
+// is done. Unhealthy models are not picked for groups or the whole pool
+// until a check succeeds again.
+func (p *Pool) StartHealthChecks(ctx context.Context, cfg HealthConfig) {
+	cfg = cfg.withDefaults()
+	go func() {
+		ticker := time.NewTicker(time.Duration(cfg.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				for model, err := range p.CheckAll(ctx, cfg) {
+					log.Debug().Err(err).Str("model", model).Msg("Health check failed")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,191 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/openai"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of an upstream request as reported in the requests metric.
+const (
+	OutcomeSuccess     = "success"
+	OutcomeRateLimited = "rate_limited" // the provider answered 429
+	OutcomeClientError = "client_error" // any other 4xx, or a request the client could not build
+	OutcomeServerError = "server_error" // 5xx and transport failures
+	OutcomeCircuitOpen = "circuit_open" // rejected by the circuit breaker without calling the provider
+	OutcomeTimeout     = "timeout"      // the deadline passed while waiting or calling
+	OutcomeCanceled    = "canceled"     // the client went away
+	OutcomeCached      = "cached"       // served from the response cache, only recorded in the usage ledger
+)
+
+var (
+	latencyBuckets   = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+	queueWaitBuckets = []float64{0.001, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+)
+
+// poolMetrics are the metric families the pool records into. Requests are
+// labelled with the group they were routed through, empty when the request
+// named the model itself and "*" when it was picked from the whole pool.
+type poolMetrics struct {
+	requests         *prometheus.CounterVec
+	latency          *prometheus.HistogramVec
+	queueWait        *prometheus.HistogramVec
+	estimatedTokens  *prometheus.CounterVec
+	promptTokens     *prometheus.CounterVec
+	completionTokens *prometheus.CounterVec
+	cost             *prometheus.CounterVec
+	cache            *prometheus.CounterVec
+}
+
+func newPoolMetrics(r prometheus.Registerer, p *Pool) (*poolMetrics, error) {
+	labels := []string{"model", "provider", "group"}
+	counter := func(name, help string, labelNames ...string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labelNames)
+	}
+	histogram := func(name, help string, buckets []float64) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, labels)
+	}
+	m := &poolMetrics{
+		requests: counter("llm_balancer_requests_total",
+			"Upstream requests by outcome.", "model", "provider", "group", "outcome"),
+		latency: histogram("llm_balancer_upstream_latency_seconds",
+			"Duration of successful upstream calls, until the last chunk for streams.", latencyBuckets),
+		queueWait: histogram("llm_balancer_queue_wait_seconds",
+			"Time requests waited for cooldowns and rate limiters before being sent.", queueWaitBuckets),
+		estimatedTokens: counter("llm_balancer_estimated_tokens_total",
+			"Tokens estimated up front for requests that completed.", labels...),
+		promptTokens: counter("llm_balancer_prompt_tokens_total",
+			"Prompt tokens reported by the providers.", labels...),
+		completionTokens: counter("llm_balancer_completion_tokens_total",
+			"Completion tokens reported by the providers.", labels...),
+		cost: counter("llm_balancer_cost_dollars_total",
+			"Accrued cost from the configured cost_input and cost_output.", labels...),
+		cache: counter("llm_balancer_cache_requests_total",
+			"Requests by their response cache result: hit, miss or bypass.", "result"),
+	}
+	collectors := []prometheus.Collector{
+		m.requests, m.latency, m.queueWait, m.estimatedTokens, m.promptTokens,
+		m.completionTokens, m.cost, m.cache, &limiterCollector{pool: p},
+	}
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			return nil, fmt.Errorf("registering metrics: %w", err)
+		}
+	}
+	return m, nil
+}
+
+var (
+	remainingRequestsDesc = prometheus.NewDesc("llm_balancer_limiter_remaining_requests",
+		"Requests left in the model's request limiter.", []string{"model", "provider"}, nil)
+	remainingTokensDesc = prometheus.NewDesc("llm_balancer_limiter_remaining_tokens",
+		"Tokens left in the model's token limiter, including refunded credit.", []string{"model", "provider"}, nil)
+	sharedRemainingTokensDesc = prometheus.NewDesc("llm_balancer_shared_limiter_remaining_tokens",
+		"Tokens left in a shared limiter, including refunded credit.", []string{"limit"}, nil)
+	modelUpDesc = prometheus.NewDesc("llm_balancer_model_up",
+		"1 while the model is healthy and its circuit is not open.", []string{"model", "provider"}, nil)
+)
+
+// limiterCollector reports the state of the limiters and models of a pool
+// at scrape time.
+type limiterCollector struct {
+	pool *Pool
+}
+
+func (c *limiterCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- remainingRequestsDesc
+	ch <- remainingTokensDesc
+	ch <- sharedRemainingTokensDesc
+	ch <- modelUpDesc
+}
+
+func (c *limiterCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ml := range c.pool.snapshot() {
+		model, provider := ml.LLM.Model, ml.LLM.Provider
+		up := 0.0
+		if ml.Healthy() && ml.Breaker.State() != CircuitOpen {
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(remainingRequestsDesc, prometheus.GaugeValue, ml.ReqLimiter.Tokens(), model, provider)
+		ch <- prometheus.MustNewConstMetric(remainingTokensDesc, prometheus.GaugeValue,
+			ml.TokenLimiter.Tokens()+float64(ml.credit.balance()), model, provider)
+		ch <- prometheus.MustNewConstMetric(modelUpDesc, prometheus.GaugeValue, up, model, provider)
+	}
+	for _, shared := range c.pool.sharedLimiters() {
+		ch <- prometheus.MustNewConstMetric(sharedRemainingTokensDesc, prometheus.GaugeValue,
+			shared.TokenLimiter.Tokens()+float64(shared.credit.balance()), shared.Limit.Name)
+	}
+}
+
+// request counts an upstream request by its outcome.
+func (m *poolMetrics) request(ml *ModelLimiter, group string, err error) {
+	m.requests.WithLabelValues(ml.LLM.Model, ml.LLM.Provider, group, Outcome(err)).Inc()
+}
+
+// completed records the latency and usage of a request that finished.
+func (m *poolMetrics) completed(ml *ModelLimiter, group string, elapsed time.Duration, estimated int, usage *openai.Usage) {
+	model, provider := ml.LLM.Model, ml.LLM.Provider
+	m.latency.WithLabelValues(model, provider, group).Observe(elapsed.Seconds())
+	m.estimatedTokens.WithLabelValues(model, provider, group).Add(float64(estimated))
+	if usage != nil {
+		m.promptTokens.WithLabelValues(model, provider, group).Add(float64(usage.PromptTokens))
+		m.completionTokens.WithLabelValues(model, provider, group).Add(float64(usage.CompletionTokens))
+		m.cost.WithLabelValues(model, provider, group).Add(ml.LLM.Cost(usage))
+	}
+}
+
+// cached counts a request by its response cache result.
+func (m *poolMetrics) cached(result string) {
+	m.cache.WithLabelValues(strings.ToLower(result)).Inc()
+}
+
+// waited records the time a request spent waiting before being sent.
+func (m *poolMetrics) waited(ml *ModelLimiter, group string, wait time.Duration) {
+	m.queueWait.WithLabelValues(ml.LLM.Model, ml.LLM.Provider, group).Observe(wait.Seconds())
+}
+
+// Outcome classifies the result of an upstream request.
+func Outcome(err error) string {
+	var statusErr *api.StatusError
+	switch {
+	case err == nil:
+		return OutcomeSuccess
+	case errors.Is(err, ErrCircuitOpen):
+		return OutcomeCircuitOpen
+	case errors.Is(err, context.Canceled):
+		return OutcomeCanceled
+	case errors.Is(err, context.DeadlineExceeded):
+		return OutcomeTimeout
+	case errors.As(err, &statusErr):
+		switch {
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return OutcomeRateLimited
+		case statusErr.StatusCode < http.StatusInternalServerError && statusErr.StatusCode != http.StatusRequestTimeout:
+			return OutcomeClientError
+		}
+		return OutcomeServerError
+	case api.IsRetryable(err):
+		return OutcomeServerError
+	}
+	return OutcomeClientError
+}
+
+// groupKey carries the group a request was routed through to DoAssigned.
+type groupKey struct{}
+
+func withGroup(ctx context.Context, group string) context.Context {
+	return context.WithValue(ctx, groupKey{}, group)
+}
+
+func groupFrom(ctx context.Context) string {
+	group, _ := ctx.Value(groupKey{}).(string)
+	return group
+}
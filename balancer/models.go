@@ -0,0 +1,167 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"llm-balancer/llm"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	// ErrModelExists is returned when adding a model already in the pool.
+	ErrModelExists = errors.New("model already in the pool")
+	// ErrModelNotFound is returned when updating or removing a model not in the pool.
+	ErrModelNotFound = errors.New("model not in the pool")
+)
+
+// LLMs returns the configuration of every model in the pool, in the order
+// they were added.
+func (p *Pool) LLMs() []*llm.LLM {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	llms := make([]*llm.LLM, 0, len(p.Models))
+	for _, model := range p.Models {
+		llms = append(llms, p.limiters[model].LLM)
+	}
+	return llms
+}
+
+// Group returns the models of a group.
+func (p *Pool) Group(name string) ([]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	models, ok := p.Groups[name]
+	return models, ok
+}
+
+// AddModel validates an LLM and adds it to the pool and to the groups it
+// belongs to, see llm.LLM.GroupNames.
+func (p *Pool) AddModel(l *llm.LLM) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ml, err := p.newModelLimiter(l)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := p.limiters[l.Model]; ok {
+		return fmt.Errorf("%s: %w", l.Model, ErrModelExists)
+	}
+	p.limiters[l.Model] = ml
+	p.Models = append(slices.Clip(p.Models), l.Model)
+	p.regroup(l.Model, nil, l.GroupNames())
+	return nil
+}
+
+// UpdateModel replaces the configuration of the model named by l.Model.
+// The rate limiter buckets are kept and adjusted to the new limits; the
+// circuit, cooldown and statistics are kept as long as the model is still
+// served by the same provider at the same base URL.
+func (p *Pool) UpdateModel(l *llm.LLM) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ml, err := p.newModelLimiter(l)
+	if err != nil {
+		return err
+	}
+
+	old, ok := p.limiters[l.Model]
+	if !ok {
+		return fmt.Errorf("%s: %w", l.Model, ErrModelNotFound)
+	}
+	ml.inherit(old)
+	p.limiters[l.Model] = ml
+	p.regroup(l.Model, old.LLM.GroupNames(), l.GroupNames())
+	return nil
+}
+
+// RemoveModel takes a model out of the pool and out of every group.
+// Requests already dispatched to it complete normally.
+func (p *Pool) RemoveModel(model string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.limiters[model]; !ok {
+		return fmt.Errorf("%s: %w", model, ErrModelNotFound)
+	}
+	delete(p.limiters, model)
+	p.Models = without(p.Models, model)
+	for group, models := range p.Groups {
+		if slices.Contains(models, model) {
+			p.setGroup(group, without(models, model))
+		}
+	}
+	return nil
+}
+
+// regroup moves a model out of the groups it was derived to belong to and
+// into its new ones, leaving groups it was put in explicitly alone.
+// Callers must hold p.mu.
+func (p *Pool) regroup(model string, before, after []string) {
+	for _, group := range before {
+		if !slices.Contains(after, group) {
+			p.setGroup(group, without(p.Groups[group], model))
+		}
+	}
+	for _, group := range after {
+		if !slices.Contains(p.Groups[group], model) {
+			p.setGroup(group, append(slices.Clip(p.Groups[group]), model))
+		}
+	}
+}
+
+// setGroup replaces the members of a group, dropping it once empty.
+// Callers must hold p.mu.
+func (p *Pool) setGroup(group string, models []string) {
+	if len(models) == 0 {
+		delete(p.Groups, group)
+		return
+	}
+	p.Groups[group] = models
+}
+
+// without returns a copy of models without model. Slices handed out
+// before are never modified, so callers iterating them are not affected.
+func without(models []string, model string) []string {
+	out := make([]string, 0, len(models))
+	for _, m := range models {
+		if m != model {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// inherit carries the live state of the limiter a model had before an
+// update over to its new one.
+func (ml *ModelLimiter) inherit(old *ModelLimiter) {
+	ml.ReqLimiter = adopt(old.ReqLimiter, ml.ReqLimiter)
+	ml.TokenLimiter = adopt(old.TokenLimiter, ml.TokenLimiter)
+	ml.credit.add(old.credit.balance(), ml.TokenLimiter.Burst())
+
+	if old.LLM.Provider != ml.LLM.Provider || old.LLM.BaseURL != ml.LLM.BaseURL {
+		return
+	}
+	ml.Breaker = old.Breaker
+	ml.Stats = old.Stats
+	// ml is not shared yet, its own fields need no locking
+	ml.cooldownUntil = old.CooldownUntil()
+	old.health.mu.Lock()
+	ml.health.unhealthy, ml.health.failures, ml.health.lastErr = old.health.unhealthy, old.health.failures, old.health.lastErr
+	old.health.mu.Unlock()
+}
+
+// adopt keeps the bucket of an old limiter, set to the rate and size of its
+// replacement, so the tokens already spent stay spent.
+func adopt(old, replacement *rate.Limiter) *rate.Limiter {
+	old.SetLimit(replacement.Limit())
+	old.SetBurst(replacement.Burst())
+	return old
+}
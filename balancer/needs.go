@@ -0,0 +1,153 @@
+package balancer
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"llm-balancer/api"
+	"llm-balancer/llm"
+	"llm-balancer/openai"
+)
+
+// ErrUnsupportedModality is returned by Do when no model the request may be
+// routed to supports the modalities it needs, e.g. an image sent to a group
+// of text only models.
+var ErrUnsupportedModality = errors.New("no model supports the modalities of the request")
+
+// ErrUnsupportedCapability is returned by Do when no model the request may be
+// routed to serves the features it uses, e.g. tools or a JSON schema.
+var ErrUnsupportedCapability = errors.New("no model supports the features of the request")
+
+// Needs is what a request requires of the model serving it.
+type Needs struct {
+	Tokens       int      // estimated tokens, must fit the context length
+	Modalities   []string // modalities besides text, see llm.LLM.Modalities
+	Capabilities []string // features used, see llm.LLM.Capabilities
+}
+
+// NeedsOf works out the needs of a request.
+func NeedsOf(req *api.Request) Needs {
+	return Needs{
+		Tokens:       req.TokensNeeded,
+		Modalities:   RequiredModalities(req.Request),
+		Capabilities: RequiredCapabilities(req.Request),
+	}
+}
+
+// fits reports whether a model can serve the request, regardless of its
+// availability.
+func (n Needs) fits(l *llm.LLM) bool {
+	return n.Tokens < l.ContextLength && l.SupportsModalities(n.Modalities) && l.SupportsCapabilities(n.Capabilities)
+}
+
+// RequiredModalities returns the modalities besides text a request needs:
+// vision for image parts, audio for audio parts, audio output or an audio
+// modality and file for file parts.
+func RequiredModalities(req *openai.ChatCompletionRequest) []string {
+	if req == nil {
+		return nil
+	}
+	var modalities []string
+	add := func(modality string) {
+		if modality != llm.ModalityText && !slices.Contains(modalities, modality) {
+			modalities = append(modalities, modality)
+		}
+	}
+	for _, message := range req.Messages {
+		// malformed content is reported by the client converting it
+		parts, _ := message.ContentParts()
+		for _, part := range parts {
+			switch part.Type {
+			case "image_url":
+				add(llm.ModalityVision)
+			case "input_audio":
+				add(llm.ModalityAudio)
+			case "file":
+				add(llm.ModalityFile)
+			}
+		}
+	}
+	if req.Audio != nil {
+		add(llm.ModalityAudio)
+	}
+	for _, modality := range req.Modalities {
+		add(modality)
+	}
+	return modalities
+}
+
+// RequiredCapabilities returns the features a request uses that not every
+// model serves.
+func RequiredCapabilities(req *openai.ChatCompletionRequest) []string {
+	if req == nil {
+		return nil
+	}
+	var capabilities []string
+	if len(req.Tools) > 0 {
+		capabilities = append(capabilities, llm.CapabilityTools)
+		if req.ParallelToolCalls != nil && *req.ParallelToolCalls {
+			capabilities = append(capabilities, llm.CapabilityParallelToolCalls)
+		}
+	}
+	if req.ResponseFormat != nil {
+		switch req.ResponseFormat.Type {
+		case "json_schema":
+			capabilities = append(capabilities, llm.CapabilityJSONSchema)
+		case "json_object":
+			capabilities = append(capabilities, llm.CapabilityJSONObject)
+		}
+	}
+	if req.ReasoningEffort != nil {
+		capabilities = append(capabilities, llm.CapabilityReasoning)
+	}
+	if (req.LogProbs != nil && *req.LogProbs) || req.TopLogprobs != nil {
+		capabilities = append(capabilities, llm.CapabilityLogprobs)
+	}
+	if req.Seed != nil {
+		capabilities = append(capabilities, llm.CapabilitySeed)
+	}
+	if req.N != nil && *req.N > 1 {
+		capabilities = append(capabilities, llm.CapabilityMultipleChoices)
+	}
+	return capabilities
+}
+
+// check returns an ErrUnsupportedModality or ErrUnsupportedCapability error
+// when none of the models target may be routed to can serve the request,
+// whatever their availability.
+func (p *Pool) check(target string, req *api.Request, needs Needs) error {
+	if len(needs.Modalities) == 0 && len(needs.Capabilities) == 0 {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var models []string
+	if _, isModel := p.limiters[target]; isModel {
+		models = []string{target}
+	} else if members, isGroup := p.Groups[target]; isGroup {
+		models = members
+	} else if req.AllowedModels != nil {
+		models = req.AllowedModels
+	} else {
+		models = p.Models
+	}
+	var modalities bool
+	for _, model := range models {
+		ml, ok := p.limiters[model]
+		if !ok || !ml.LLM.SupportsModalities(needs.Modalities) {
+			continue
+		}
+		if ml.LLM.SupportsCapabilities(needs.Capabilities) {
+			return nil
+		}
+		modalities = true
+	}
+	if !modalities {
+		return fmt.Errorf("%q needs %s: %w", target, strings.Join(needs.Modalities, ", "), ErrUnsupportedModality)
+	}
+	return fmt.Errorf("%q needs %s: %w", target, strings.Join(needs.Capabilities, ", "), ErrUnsupportedCapability)
+}
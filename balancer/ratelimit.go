@@ -0,0 +1,127 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"llm-balancer/api"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// defaultRateLimitCooldown is used for a 429 that does not say when to retry.
+const defaultRateLimitCooldown = time.Second
+
+// CooldownUntil returns the time until which the provider asked us to back
+// off, zero when the model is not cooling down.
+func (ml *ModelLimiter) CooldownUntil() time.Time {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if time.Now().After(ml.cooldownUntil) {
+		return time.Time{}
+	}
+	return ml.cooldownUntil
+}
+
+// cooldown keeps the model out of rotation until the given time, an
+// existing longer cooldown is kept.
+func (ml *ModelLimiter) cooldown(until time.Time) {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	if until.After(ml.cooldownUntil) {
+		ml.cooldownUntil = until
+		log.Info().Str("model", ml.LLM.String()).Time("until", until).Msg("Model cooling down after provider rate limit")
+	}
+}
+
+// waitCooldown blocks until a pending cooldown has passed or ctx is done.
+func (ml *ModelLimiter) waitCooldown(ctx context.Context) error {
+	until := ml.CooldownUntil()
+	if until.IsZero() {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && deadline.Before(until) {
+		return errors.New("model " + ml.LLM.Model + " is rate limited past the request deadline")
+	}
+
+	timer := time.NewTimer(time.Until(until))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// observeResult feeds the rate limit state reported with a response or an
+// error back into the limiters.
+func (ml *ModelLimiter) observeResult(resp *api.Response, err error) {
+	var statusErr *api.StatusError
+	switch {
+	case err == nil && resp != nil:
+		ml.observeRateLimit(resp.RateLimit)
+	case errors.As(err, &statusErr):
+		ml.observeRateLimit(statusErr.RateLimit)
+		if statusErr.StatusCode == http.StatusTooManyRequests {
+			wait := defaultRateLimitCooldown
+			if rl := statusErr.RateLimit; rl != nil {
+				switch {
+				case rl.RetryAfter > 0:
+					wait = rl.RetryAfter
+				case rl.RemainingTokens == 0 && rl.ResetTokens > 0:
+					wait = rl.ResetTokens
+				case rl.RemainingRequests == 0 && rl.ResetRequests > 0:
+					wait = rl.ResetRequests
+				}
+			}
+			ml.cooldown(time.Now().Add(wait))
+		}
+	}
+}
+
+// observeRateLimit resyncs the local buckets with what the provider reports.
+// A rate.Limiter cannot be refilled, so the buckets are only ever drained down
+// to the remaining quota; they refill at the configured rate on their own.
+// Daily request counts do not bound the per-minute request bucket and are
+// only used to cool down once they run out.
+// An exhausted quota puts the model in cooldown until the provider resets it.
+func (ml *ModelLimiter) observeRateLimit(rl *api.RateLimit) {
+	if rl == nil {
+		return
+	}
+	now := time.Now()
+	remainingRequests := rl.RemainingRequests
+	if rl.DailyRequests {
+		remainingRequests = -1
+	}
+	drain(ml.ReqLimiter, remainingRequests, now)
+	drain(ml.TokenLimiter, rl.RemainingTokens, now)
+	// the provider's quota is usually per account, so it bounds shared limits too
+	for _, shared := range ml.Shared {
+		drain(shared.ReqLimiter, remainingRequests, now)
+		drain(shared.TokenLimiter, rl.RemainingTokens, now)
+	}
+
+	if rl.RemainingRequests == 0 && rl.ResetRequests > 0 {
+		ml.cooldown(now.Add(rl.ResetRequests))
+	}
+	if rl.RemainingTokens == 0 && rl.ResetTokens > 0 {
+		ml.cooldown(now.Add(rl.ResetTokens))
+	}
+}
+
+// drain consumes tokens until at most remaining are left, remaining < 0 means unknown.
+func drain(limiter *rate.Limiter, remaining int, now time.Time) {
+	if remaining < 0 {
+		return
+	}
+	if excess := int(limiter.TokensAt(now)) - remaining; excess > 0 {
+		limiter.ReserveN(now, excess)
+	}
+}
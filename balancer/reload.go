@@ -0,0 +1,93 @@
+package balancer
+
+import (
+	"reflect"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Apply replaces the configuration of a running pool, e.g. after the config
+// file changed. The new configuration is validated in full first; when it
+// is invalid the error is returned and the pool is left as it was.
+//
+// Models and shared limits that are kept keep their rate limiter buckets,
+// adjusted to their new limits, so a reload neither refills nor empties
+// them. Their circuit, cooldown and statistics are kept as long as they are
+// served by the same provider at the same base URL and the circuit breaker
+// settings did not change. Models missing from cfg are removed, including
+// ones added through the admin API; requests already dispatched to them
+// complete normally. Cached responses are kept unless the cache settings
+// changed. The metrics registry of cfg is ignored.
+func (p *Pool) Apply(cfg Config) error {
+	next, err := buildPool(cfg)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, sl := range next.shared {
+		for _, old := range p.shared {
+			if old.Limit.Name == sl.Limit.Name {
+				sl.inherit(old)
+			}
+		}
+	}
+	added, changed := 0, 0
+	for model, ml := range next.limiters {
+		old, ok := p.limiters[model]
+		if !ok {
+			added++
+			continue
+		}
+		breaker := ml.Breaker
+		ml.inherit(old)
+		if next.breaker != p.breaker {
+			ml.Breaker = breaker
+		}
+		if !sameLLM(old, ml) {
+			changed++
+		}
+	}
+	if next.cache != nil && p.cache != nil && next.cache.cfg == p.cache.cfg {
+		// keep the cached responses
+		next.cache = p.cache
+	}
+	removed := 0
+	for model := range p.limiters {
+		if _, ok := next.limiters[model]; !ok {
+			removed++
+		}
+	}
+
+	p.limiters = next.limiters
+	p.Models = next.Models
+	p.Groups = next.Groups
+	p.sorter = next.sorter
+	p.groupSorters = next.groupSorters
+	p.defaultTimeout = next.defaultTimeout
+	p.retry = next.retry
+	p.breaker = next.breaker
+	p.shared = next.shared
+	p.cache = next.cache
+
+	log.Info().Int("added", added).Int("changed", changed).Int("removed", removed).Int("models", len(p.Models)).Msg("Pool configuration applied")
+	return nil
+}
+
+// sameLLM reports whether the configuration of a model is unchanged, the
+// client built from it aside.
+func sameLLM(a, b *ModelLimiter) bool {
+	x, y := *a.LLM, *b.LLM
+	x.Client, y.Client = nil, nil
+	return reflect.DeepEqual(x, y)
+}
+
+// inherit carries the buckets of the shared limiter a limit had before a
+// reload over to its new one.
+func (sl *SharedLimiter) inherit(old *SharedLimiter) {
+	sl.ReqLimiter = adopt(old.ReqLimiter, sl.ReqLimiter)
+	sl.TokenLimiter = adopt(old.TokenLimiter, sl.TokenLimiter)
+	sl.credit.add(old.credit.balance(), sl.TokenLimiter.Burst())
+}
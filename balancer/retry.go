@@ -0,0 +1,45 @@
+package balancer
+
+import (
+	"time"
+)
+
+// RetryPolicy controls how often and how quickly a failed request is
+// retried on another eligible model.
+type RetryPolicy struct {
+	MaxAttempts      int `yaml:"max_attempts"`       // total attempts including the first, 1 disables retries
+	InitialBackoffMs int `yaml:"initial_backoff_ms"` // wait before the second attempt, doubled after each retry
+	MaxBackoffMs     int `yaml:"max_backoff_ms"`     // upper bound on the wait between attempts
+}
+
+// DefaultRetryPolicy is used when no retry section is configured.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:      3,
+	InitialBackoffMs: 250,
+	MaxBackoffMs:     5000,
+}
+
+// withDefaults fills unset fields from DefaultRetryPolicy.
+func (r RetryPolicy) withDefaults() RetryPolicy {
+	if r.MaxAttempts <= 0 {
+		r.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if r.InitialBackoffMs <= 0 {
+		r.InitialBackoffMs = DefaultRetryPolicy.InitialBackoffMs
+	}
+	if r.MaxBackoffMs < r.InitialBackoffMs {
+		r.MaxBackoffMs = max(DefaultRetryPolicy.MaxBackoffMs, r.InitialBackoffMs)
+	}
+	return r
+}
+
+// Backoff returns the wait before the given retry, starting at 1 for the
+// first retry.
+func (r RetryPolicy) Backoff(retry int) time.Duration {
+	backoff := time.Duration(r.InitialBackoffMs) * time.Millisecond
+	limit := time.Duration(r.MaxBackoffMs) * time.Millisecond
+	for i := 1; i < retry && backoff < limit; i++ {
+		backoff *= 2
+	}
+	return min(backoff, limit)
+}
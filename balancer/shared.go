@@ -0,0 +1,201 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"llm-balancer/llm"
+
+	"golang.org/x/time/rate"
+)
+
+// Scopes a SharedLimit can apply to.
+const (
+	ScopeKey      = "key"      // every model using the API key named by Match
+	ScopeProvider = "provider" // every model of the provider named by Match
+	ScopeBucket   = "bucket"   // every model listing the limit in its limit_buckets
+)
+
+// SharedLimit declares a rate limit drawn from by several models, e.g. every
+// Gemini model configured with the same GOOGLE_API_KEY. A request to any
+// member is charged against both its own limiters and the shared ones.
+type SharedLimit struct {
+	Name           string `yaml:"name" json:"name"`
+	Scope          string `yaml:"scope" json:"scope"` // key, provider or bucket
+	Match          string `yaml:"match" json:"match"` // api_key_name for the key scope, provider for the provider scope
+	TokensPerMin   int    `yaml:"tokens_per_minute" json:"tokens_per_minute"`
+	RequestsPerMin int    `yaml:"requests_per_minute" json:"requests_per_minute"`
+}
+
+// Validate checks the limit is complete and its scope is known.
+func (l *SharedLimit) Validate() error {
+	if l.Name == "" {
+		return errors.New("shared limit without a name")
+	}
+	if l.RequestsPerMin <= 0 || l.TokensPerMin <= 0 {
+		return fmt.Errorf("shared limit %s needs positive requests_per_minute and tokens_per_minute", l.Name)
+	}
+	switch l.Scope {
+	case ScopeKey, ScopeProvider:
+		if l.Match == "" {
+			return fmt.Errorf("shared limit %s with scope %s needs match", l.Name, l.Scope)
+		}
+	case ScopeBucket:
+	default:
+		return fmt.Errorf("shared limit %s has unknown scope %q", l.Name, l.Scope)
+	}
+	return nil
+}
+
+// Applies reports whether the model draws from this limit.
+func (l *SharedLimit) Applies(m *llm.LLM) bool {
+	switch l.Scope {
+	case ScopeKey:
+		return m.APIKeyName == l.Match
+	case ScopeProvider:
+		return m.Provider == l.Match
+	case ScopeBucket:
+		return slices.Contains(m.LimitBuckets, l.Name)
+	}
+	return false
+}
+
+// SharedLimiter holds the live buckets of a SharedLimit.
+type SharedLimiter struct {
+	Limit        *SharedLimit
+	ReqLimiter   *rate.Limiter
+	TokenLimiter *rate.Limiter
+
+	credit tokenCredit // tokens refunded after usage came in below the estimate
+}
+
+func newSharedLimiter(l *SharedLimit) *SharedLimiter {
+	return &SharedLimiter{
+		Limit:        l,
+		ReqLimiter:   rate.NewLimiter(rate.Limit(float64(l.RequestsPerMin)/60.0), l.RequestsPerMin),
+		TokenLimiter: rate.NewLimiter(rate.Limit(float64(l.TokensPerMin)/60.0), l.TokensPerMin),
+	}
+}
+
+// available reports without consuming whether a request of tokensNeeded
+// could be sent right away as far as this model's limiters are concerned.
+func (ml *ModelLimiter) available(tokensNeeded int) bool {
+	if !ml.CooldownUntil().IsZero() {
+		return false
+	}
+	if ml.ReqLimiter.Tokens() < 1 || float64(tokensNeeded) > ml.TokenLimiter.Tokens()+float64(ml.credit.balance()) {
+		return false
+	}
+	for _, shared := range ml.Shared {
+		if shared.ReqLimiter.Tokens() < 1 || float64(tokensNeeded) > shared.TokenLimiter.Tokens()+float64(shared.credit.balance()) {
+			return false
+		}
+	}
+	return true
+}
+
+// wait blocks until one request and tokensNeeded tokens have been reserved
+// from the model's own limiters and every shared limiter it belongs to.
+// Everything is reserved up front and waited for at once; when the request
+// cannot wait that long the reservations and the credit spent are given back,
+// so a rejected request does not use up capacity.
+func (ml *ModelLimiter) wait(ctx context.Context, tokensNeeded int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	now := time.Now()
+	var held reservations
+	err := held.reserve("requests", ml.ReqLimiter, nil, 1, now)
+	if err == nil {
+		err = held.reserve("tokens", ml.TokenLimiter, &ml.credit, tokensNeeded, now)
+	}
+	for _, shared := range ml.Shared {
+		if err == nil {
+			err = held.reserve("shared limit "+shared.Limit.Name+" requests", shared.ReqLimiter, nil, 1, now)
+		}
+		if err == nil {
+			err = held.reserve("shared limit "+shared.Limit.Name+" tokens", shared.TokenLimiter, &shared.credit, tokensNeeded, now)
+		}
+	}
+	if err != nil {
+		held.cancel(now)
+		return err
+	}
+
+	delay := held.delay(now)
+	if delay == 0 {
+		return nil
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(delay).After(deadline) {
+		held.cancel(now)
+		return fmt.Errorf("rate limit wait of %s would exceed the request deadline", delay)
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		held.cancel(now)
+		return ctx.Err()
+	}
+}
+
+// reservation is what wait took from one limiter.
+type reservation struct {
+	r      *rate.Reservation // nil when credit covered everything
+	credit *tokenCredit      // where spent credit came from, nil for requests
+	spent  int               // credit spent instead of limiter tokens
+	burst  int
+}
+
+type reservations []reservation
+
+// reserve reserves n tokens of limiter at now, spending credit first when
+// there is any.
+func (rs *reservations) reserve(name string, limiter *rate.Limiter, credit *tokenCredit, n int, now time.Time) error {
+	res := reservation{credit: credit, burst: limiter.Burst()}
+	if credit != nil {
+		charge := credit.spend(n)
+		res.spent, n = n-charge, charge
+	}
+	if n > 0 {
+		if r := limiter.ReserveN(now, n); r.OK() {
+			res.r = r
+		} else {
+			// keep the spent credit to give it back
+			*rs = append(*rs, res)
+			return fmt.Errorf("%s: %d exceeds the limit of %d", name, n, res.burst)
+		}
+	}
+	*rs = append(*rs, res)
+	return nil
+}
+
+// delay is how long the slowest reservation has to wait from now.
+func (rs reservations) delay(now time.Time) time.Duration {
+	var delay time.Duration
+	for _, res := range rs {
+		if res.r != nil {
+			delay = max(delay, res.r.DelayFrom(now))
+		}
+	}
+	return delay
+}
+
+// cancel gives back the reservations made at now and the credit spent, last
+// first. Cancelling at the time of reservation also returns tokens that were
+// available right away.
+func (rs reservations) cancel(now time.Time) {
+	for i := len(rs) - 1; i >= 0; i-- {
+		if rs[i].r != nil {
+			rs[i].r.CancelAt(now)
+		}
+		if rs[i].spent > 0 {
+			rs[i].credit.add(rs[i].spent, rs[i].burst)
+		}
+	}
+}
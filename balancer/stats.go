@@ -0,0 +1,86 @@
+package balancer
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// latencyDecay is the weight of a new sample in the moving averages.
+	latencyDecay = 0.2
+	// latencyWindow is the number of recent samples percentiles are computed from.
+	latencyWindow = 128
+)
+
+// LatencyStats holds rolling statistics of a model's upstream calls.
+type LatencyStats struct {
+	mu      sync.Mutex
+	ewma    time.Duration
+	ttfb    time.Duration
+	samples []time.Duration // ring buffer of the latest durations
+	next    int
+	count   int64
+}
+
+// LatencySnapshot is a point in time copy of LatencyStats.
+type LatencySnapshot struct {
+	Count int64         `json:"count"`
+	EWMA  time.Duration `json:"ewma"`
+	P50   time.Duration `json:"p50"`
+	P95   time.Duration `json:"p95"`
+	TTFB  time.Duration `json:"ttfb"` // moving average of the time to the first byte or chunk
+}
+
+// Record adds a completed call that took total, with the first byte after ttfb.
+func (s *LatencyStats) Record(total, ttfb time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.ewma = ewma(s.ewma, total)
+	s.ttfb = ewma(s.ttfb, ttfb)
+	if len(s.samples) < latencyWindow {
+		s.samples = append(s.samples, total)
+	} else {
+		s.samples[s.next] = total
+	}
+	s.next = (s.next + 1) % latencyWindow
+	s.count++
+}
+
+// Snapshot returns the current statistics, all zero until a call completed.
+func (s *LatencyStats) Snapshot() LatencySnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snap := LatencySnapshot{Count: s.count, EWMA: s.ewma, TTFB: s.ttfb}
+	if len(s.samples) > 0 {
+		sorted := slices.Clone(s.samples)
+		slices.Sort(sorted)
+		snap.P50 = percentile(sorted, 0.50)
+		snap.P95 = percentile(sorted, 0.95)
+	}
+	return snap
+}
+
+func ewma(avg, sample time.Duration) time.Duration {
+	if avg == 0 {
+		return sample
+	}
+	return time.Duration(latencyDecay*float64(sample) + (1-latencyDecay)*float64(avg))
+}
+
+// percentile uses the nearest rank of a sorted, non-empty slice.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[min(max(idx, 0), len(sorted)-1)]
+}
+
+// Latency returns the exponentially weighted average duration of the
+// model's upstream calls, 0 until one completed.
+func (ml *ModelLimiter) Latency() time.Duration {
+	ml.Stats.mu.Lock()
+	defer ml.Stats.mu.Unlock()
+
+	return ml.Stats.ewma
+}
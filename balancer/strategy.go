@@ -0,0 +1,229 @@
+package balancer
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Strategy names accepted in the configuration.
+const (
+	StrategyRoundRobin = "round_robin"
+	StrategyQuality    = "quality"
+	StrategyWeighted   = "weighted"
+	StrategyFastest    = "fastest"
+)
+
+// SortStrategy defines how to order limiters when picking.
+// The first limiter after sorting is the one selected.
+type SortStrategy interface {
+	Sort(tokensNeeded int, limiters []*ModelLimiter)
+}
+
+// OptimizationWeights sets how much each input counts in the weighted
+// score. Weights are relative, they do not need to sum to one.
+type OptimizationWeights struct {
+	Cost    float64 `yaml:"cost" json:"cost"`       // prefer cheaper models
+	Quality float64 `yaml:"quality" json:"quality"` // prefer higher quality models
+	Speed   float64 `yaml:"speed" json:"speed"`     // prefer models with lower observed latency
+	Quota   float64 `yaml:"quota" json:"quota"`     // prefer models with more of their rate limits left
+}
+
+// StrategyConfig selects a SortStrategy by name, as used for the pool
+// default and for individual groups.
+type StrategyConfig struct {
+	Strategy string               `yaml:"strategy" json:"strategy"` // round_robin, quality, weighted or fastest
+	Weights  *OptimizationWeights `yaml:"optimization_weights" json:"optimization_weights,omitempty"`
+}
+
+// NewSortStrategy builds the strategy described by cfg. Without a name the
+// weighted strategy is used when weights are given, quality otherwise.
+func NewSortStrategy(cfg StrategyConfig) (SortStrategy, error) {
+	name := cfg.Strategy
+	if name == "" {
+		name = StrategyQuality
+		if cfg.Weights != nil {
+			name = StrategyWeighted
+		}
+	}
+
+	switch name {
+	case StrategyRoundRobin:
+		return &RoundRobinSortStrategy{}, nil
+	case StrategyQuality:
+		return &QualitySortStrategy{}, nil
+	case StrategyWeighted:
+		if cfg.Weights == nil {
+			return nil, fmt.Errorf("strategy %s needs optimization_weights", name)
+		}
+		return &WeightedSortStrategy{Weights: *cfg.Weights}, nil
+	case StrategyFastest:
+		return &FastestSortStrategy{}, nil
+	}
+	return nil, fmt.Errorf("unknown strategy %q", name)
+}
+
+// RoundRobinSortStrategy rotates through the candidates on every pick.
+type RoundRobinSortStrategy struct {
+	next atomic.Uint64
+}
+
+// Sort implements SortStrategy; rotates the candidates by one on every call
+func (s *RoundRobinSortStrategy) Sort(_ int, limiters []*ModelLimiter) {
+	if len(limiters) < 2 {
+		return
+	}
+	shift := int((s.next.Add(1) - 1) % uint64(len(limiters)))
+	rotated := append(append([]*ModelLimiter{}, limiters[shift:]...), limiters[:shift]...)
+	copy(limiters, rotated)
+}
+
+// QualitySortStrategy sorts by descending Quality
+type QualitySortStrategy struct{}
+
+// Sort implements SortStrategy; higher Quality first
+func (s *QualitySortStrategy) Sort(_ int, limiters []*ModelLimiter) {
+	sort.SliceStable(limiters, func(i, j int) bool {
+		return limiters[i].LLM.Quality > limiters[j].LLM.Quality
+	})
+}
+
+// WeightedSortStrategy scores every candidate on cost, quality, observed
+// latency and remaining quota, each normalized to [0, 1] across the
+// candidates, and sorts by the weighted sum.
+type WeightedSortStrategy struct {
+	Weights OptimizationWeights
+}
+
+// Sort implements SortStrategy; highest score first
+func (s *WeightedSortStrategy) Sort(_ int, limiters []*ModelLimiter) {
+	if len(limiters) < 2 {
+		return
+	}
+
+	costs := make([]float64, len(limiters))
+	qualities := make([]float64, len(limiters))
+	latencies := make([]float64, len(limiters))
+	for i, ml := range limiters {
+		costs[i] = ml.LLM.CostInput + ml.LLM.CostOutput
+		qualities[i] = float64(ml.LLM.Quality)
+		latencies[i] = float64(ml.Latency())
+	}
+	costScores := normalize(costs, true)
+	qualityScores := normalize(qualities, false)
+	speedScores := normalize(latencies, true)
+
+	scores := make(map[*ModelLimiter]float64, len(limiters))
+	for i, ml := range limiters {
+		speed := speedScores[i]
+		if latencies[i] == 0 {
+			// untried models are assumed fast so they get a chance to be measured
+			speed = 1
+		}
+		scores[ml] = s.Weights.Cost*costScores[i] +
+			s.Weights.Quality*qualityScores[i] +
+			s.Weights.Speed*speed +
+			s.Weights.Quota*ml.remainingQuota()
+	}
+
+	sort.SliceStable(limiters, func(i, j int) bool {
+		return scores[limiters[i]] > scores[limiters[j]]
+	})
+}
+
+// normalize maps values onto [0, 1] by their position between the minimum
+// and maximum, inverted when lower values are better. Equal values score 1.
+func normalize(values []float64, lowerIsBetter bool) []float64 {
+	lo, hi := values[0], values[0]
+	for _, v := range values {
+		lo, hi = min(lo, v), max(hi, v)
+	}
+
+	scores := make([]float64, len(values))
+	for i, v := range values {
+		switch {
+		case hi == lo:
+			scores[i] = 1
+		case lowerIsBetter:
+			scores[i] = (hi - v) / (hi - lo)
+		default:
+			scores[i] = (v - lo) / (hi - lo)
+		}
+	}
+	return scores
+}
+
+// FastestSortStrategy prefers the model expected to answer soonest: the
+// wait its limiters impose on the request plus its average latency.
+type FastestSortStrategy struct{}
+
+// Sort implements SortStrategy; lowest expected completion time first
+func (s *FastestSortStrategy) Sort(tokensNeeded int, limiters []*ModelLimiter) {
+	now := time.Now()
+	expected := make(map[*ModelLimiter]time.Duration, len(limiters))
+	for _, ml := range limiters {
+		wait, latency := ml.ExpectedWait(tokensNeeded, now), ml.Latency()
+		if wait > time.Duration(math.MaxInt64)-latency {
+			expected[ml] = time.Duration(math.MaxInt64)
+			continue
+		}
+		expected[ml] = wait + latency
+	}
+	sort.SliceStable(limiters, func(i, j int) bool {
+		return expected[limiters[i]] < expected[limiters[j]]
+	})
+}
+
+// ExpectedWait returns how long a request of tokensNeeded would wait for
+// the model's cooldown and limiters, including the shared ones.
+// Reservations are only used to peek at the delay and are cancelled right away.
+func (ml *ModelLimiter) ExpectedWait(tokensNeeded int, now time.Time) time.Duration {
+	var wait time.Duration
+	if until := ml.CooldownUntil(); !until.IsZero() {
+		wait = until.Sub(now)
+	}
+	wait = max(wait,
+		reservationDelay(ml.ReqLimiter, 1, now),
+		reservationDelay(ml.TokenLimiter, tokensNeeded-ml.credit.balance(), now),
+	)
+	for _, shared := range ml.Shared {
+		wait = max(wait,
+			reservationDelay(shared.ReqLimiter, 1, now),
+			reservationDelay(shared.TokenLimiter, tokensNeeded-shared.credit.balance(), now),
+		)
+	}
+	return wait
+}
+
+// reservationDelay is the delay a reservation of n tokens would get, without
+// keeping it. Requests that can never be served wait forever.
+func reservationDelay(limiter *rate.Limiter, n int, now time.Time) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	r := limiter.ReserveN(now, n)
+	if !r.OK() {
+		return time.Duration(math.MaxInt64)
+	}
+	defer r.CancelAt(now)
+	return r.DelayFrom(now)
+}
+
+// remainingQuota is the fraction left of the model's tightest bucket.
+func (ml *ModelLimiter) remainingQuota() float64 {
+	quota := min(
+		ml.ReqLimiter.Tokens()/float64(ml.ReqLimiter.Burst()),
+		ml.TokenLimiter.Tokens()/float64(ml.TokenLimiter.Burst()),
+	)
+	for _, shared := range ml.Shared {
+		quota = min(quota,
+			shared.ReqLimiter.Tokens()/float64(shared.ReqLimiter.Burst()),
+			shared.TokenLimiter.Tokens()/float64(shared.TokenLimiter.Burst()),
+		)
+	}
+	return max(quota, 0)
+}
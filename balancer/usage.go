@@ -0,0 +1,85 @@
+package balancer
+
+import (
+	"sync"
+	"time"
+
+	"llm-balancer/openai"
+
+	"github.com/rs/zerolog/log"
+	"golang.org/x/time/rate"
+)
+
+// tokenCredit holds tokens refunded to a rate.Limiter. A limiter cannot be
+// given tokens back once they are spent, so refunds are kept aside and used
+// before the limiter is charged again.
+type tokenCredit struct {
+	mu     sync.Mutex
+	tokens int
+}
+
+// add refunds n tokens, never holding more than limit.
+func (c *tokenCredit) add(n, limit int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tokens = min(c.tokens+n, limit)
+}
+
+// spend uses up to n tokens of credit and returns how many are left to charge.
+func (c *tokenCredit) spend(n int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	used := min(c.tokens, n)
+	c.tokens -= used
+	return n - used
+}
+
+func (c *tokenCredit) balance() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.tokens
+}
+
+// usageTokens returns the tokens a response actually consumed, 0 when the
+// provider did not report usage.
+func usageTokens(usage *openai.Usage) int {
+	if usage == nil {
+		return 0
+	}
+	if usage.TotalTokens > 0 {
+		return usage.TotalTokens
+	}
+	return usage.PromptTokens + usage.CompletionTokens
+}
+
+// reconcile settles the difference between the tokens charged up front and
+// the tokens the provider reports, against the model's own and shared buckets.
+func (ml *ModelLimiter) reconcile(estimated int, usage *openai.Usage) {
+	actual := usageTokens(usage)
+	if actual == 0 {
+		return
+	}
+	log.Debug().Str("model", ml.LLM.String()).Int("estimated", estimated).Int("actual", actual).Msg("Reconciling token usage")
+
+	now := time.Now()
+	settle(ml.TokenLimiter, &ml.credit, actual-estimated, now)
+	for _, shared := range ml.Shared {
+		settle(shared.TokenLimiter, &shared.credit, actual-estimated, now)
+	}
+}
+
+// settle charges a positive diff to the limiter, letting it go into debt
+// that later requests wait for, and refunds a negative diff as credit.
+func settle(limiter *rate.Limiter, credit *tokenCredit, diff int, now time.Time) {
+	switch {
+	case diff > 0:
+		if n := min(credit.spend(diff), limiter.Burst()); n > 0 {
+			limiter.ReserveN(now, n)
+		}
+	case diff < 0:
+		credit.add(-diff, limiter.Burst())
+	}
+}
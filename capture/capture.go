@@ -0,0 +1,156 @@
+// Package capture logs requests with the responses they got, so a report
+// can be reproduced later with the replay command.
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"llm-balancer/openai"
+)
+
+// Config holds where captures are written and what is redacted from them.
+type Config struct {
+	Path   string   `yaml:"path"`   // JSON Lines file, nothing is captured when empty
+	Redact []string `yaml:"redact"` // regular expressions redacted in addition to the built-in ones
+}
+
+// Entry is a captured request and the response it got.
+type Entry struct {
+	Time      time.Time                      `json:"time"`
+	Key       string                         `json:"key,omitempty"` // name of the client key, empty without one
+	Requested string                         `json:"requested"`     // model or group the client asked for
+	Model     string                         `json:"model,omitempty"`
+	Provider  string                         `json:"provider,omitempty"`
+	Request   json.RawMessage                `json:"request"`            // the body as the client sent it
+	Response  *openai.ChatCompletionResponse `json:"response,omitempty"` // assembled from the chunks for streams
+	Error     string                         `json:"error,omitempty"`    // why there is no response
+	Streamed  bool                           `json:"streamed,omitempty"`
+	LatencyMS int64                          `json:"latency_ms"`
+}
+
+// Redacted replaces secrets in captures.
+const Redacted = "[REDACTED]"
+
+// secretPatterns match API keys of the common providers and bearer tokens.
+var secretPatterns = []string{
+	`sk-[A-Za-z0-9_\-]{16,}`,    // OpenAI, OpenRouter and the balancer's own keys
+	`gsk_[A-Za-z0-9]{20,}`,      // Groq
+	`AIza[0-9A-Za-z_\-]{35}`,    // Google
+	`nvapi-[A-Za-z0-9_\-]{20,}`, // NVIDIA
+	`csk-[A-Za-z0-9]{20,}`,      // Cerebras
+	`(?i)bearer\s+[A-Za-z0-9._\-]{16,}`,
+}
+
+// Sink appends entries to a JSON Lines file with secrets redacted.
+type Sink struct {
+	// Secrets returns the values redacted verbatim, such as the configured
+	// provider and client keys. It may be nil.
+	Secrets func() []string
+
+	mu       sync.Mutex
+	file     *os.File
+	patterns []*regexp.Regexp
+}
+
+// Open opens the capture file of cfg, creating it and its directory if needed.
+func Open(cfg Config) (*Sink, error) {
+	patterns, err := compile(slices.Concat(secretPatterns, cfg.Redact))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Sink{file: file, patterns: patterns}, nil
+}
+
+func compile(patterns []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, 0, len(patterns))
+	for _, p := range patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return nil, fmt.Errorf("redact pattern %q: %w", p, err)
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+// Write redacts and appends an entry.
+func (s *Sink) Write(e *Entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(s.redact(line), '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err = s.file.Write(line)
+	return err
+}
+
+// redact replaces the known secrets and everything matching a pattern.
+// Secrets are replaced in their JSON encoded form, as they appear in line.
+func (s *Sink) redact(line []byte) []byte {
+	if s.Secrets != nil {
+		for _, secret := range s.Secrets() {
+			if len(secret) < 8 {
+				// too short to be a real secret, replacing it would mangle the capture
+				continue
+			}
+			encoded, _ := json.Marshal(secret)
+			encoded = encoded[1 : len(encoded)-1]
+			line = []byte(strings.ReplaceAll(string(line), string(encoded), Redacted))
+		}
+	}
+	for _, re := range s.patterns {
+		line = re.ReplaceAll(line, []byte(Redacted))
+	}
+	return line
+}
+
+// Close closes the capture file.
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.file.Close()
+}
+
+// Read calls fn for every entry in a capture file, stopping at the first
+// error fn returns.
+func Read(path string, fn func(line int, e *Entry) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if err := fn(line, &e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
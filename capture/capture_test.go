@@ -0,0 +1,83 @@
+package capture_test
+
+import (
+	"os"
+	"path/filepath"
+
+	"llm-balancer/capture"
+	"llm-balancer/openai"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sink", func() {
+	var (
+		path string
+		sink *capture.Sink
+	)
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "captures", "capture.jsonl")
+		var err error
+		sink, err = capture.Open(capture.Config{Path: path, Redact: []string{`ticket-\d+`}})
+		Expect(err).NotTo(HaveOccurred())
+		sink.Secrets = func() []string { return []string{"provider-secret-1234", "", "short"} }
+		DeferCleanup(sink.Close)
+	})
+
+	It("redacts secrets before writing", func() {
+		content := "hello"
+		Expect(sink.Write(&capture.Entry{
+			Requested: "free",
+			Request: []byte(`{"model":"free","messages":[{"role":"user","content":` +
+				`"my key is sk-abcdefghijklmnopqrstuvwx, gsk_abcdefghijklmnopqrstuvwx and provider-secret-1234 for ticket-42, keep it short"}]}`),
+			Response: &openai.ChatCompletionResponse{Choices: []openai.Choice{{Message: openai.CompletionMessage{Content: &content}}}},
+		})).To(Succeed())
+
+		data, err := os.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).NotTo(ContainSubstring("sk-abc"))
+		Expect(string(data)).NotTo(ContainSubstring("gsk_"))
+		Expect(string(data)).NotTo(ContainSubstring("provider-secret"))
+		Expect(string(data)).NotTo(ContainSubstring("ticket-42"))
+		Expect(string(data)).To(ContainSubstring("keep it short"))
+		Expect(string(data)).To(HaveSuffix("}\n"))
+
+		var entries []*capture.Entry
+		Expect(capture.Read(path, func(_ int, e *capture.Entry) error {
+			entries = append(entries, e)
+			return nil
+		})).To(Succeed())
+		Expect(entries).To(HaveLen(1))
+		Expect(entries[0].Requested).To(Equal("free"))
+		Expect(capture.Text(entries[0].Response)).To(Equal("hello\n"))
+	})
+
+	It("rejects invalid redact patterns", func() {
+		_, err := capture.Open(capture.Config{Path: path, Redact: []string{"("}})
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("Diff", func() {
+	It("is empty for equal texts", func() {
+		Expect(capture.Diff("a\nb\n", "a\nb\n")).To(BeEmpty())
+	})
+
+	It("marks removed and added lines", func() {
+		Expect(capture.Diff("a\nb\nc", "a\nx\nc")).To(Equal("  a\n- b\n+ x\n  c\n"))
+		Expect(capture.Diff("", "new")).To(Equal("- \n+ new\n"))
+	})
+
+	It("renders tool calls for comparison", func() {
+		resp := &openai.ChatCompletionResponse{}
+		Expect(resp.Add(&openai.ChatCompletionChunk{ID: "1", Choices: []openai.ChunkChoice{{Delta: openai.Delta{
+			ToolCalls: []openai.ToolCallDelta{{Index: 0, ID: "call_1", Type: "function", Function: openai.FunctionCallDelta{Name: "lookup", Arguments: `{"q":`}}},
+		}}}})).To(Succeed())
+		Expect(resp.Add(&openai.ChatCompletionChunk{ID: "1", Choices: []openai.ChunkChoice{{Delta: openai.Delta{
+			ToolCalls: []openai.ToolCallDelta{{Index: 0, Function: openai.FunctionCallDelta{Arguments: `"x"}`}}},
+		}}}})).To(Succeed())
+		Expect(capture.Text(resp)).To(Equal("[tool call] lookup({\"q\":\"x\"})\n"))
+	})
+})
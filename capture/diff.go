@@ -0,0 +1,81 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"llm-balancer/openai"
+)
+
+// Text renders the choices of a response for comparison: the content of
+// each message followed by its tool calls, one per line.
+func Text(resp *openai.ChatCompletionResponse) string {
+	if resp == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, choice := range resp.Choices {
+		if len(resp.Choices) > 1 {
+			fmt.Fprintf(&b, "[choice %d]\n", choice.Index)
+		}
+		if choice.Message.Content != nil {
+			b.WriteString(*choice.Message.Content)
+			b.WriteString("\n")
+		}
+		if choice.Message.Refusal != nil {
+			fmt.Fprintf(&b, "[refusal] %s\n", *choice.Message.Refusal)
+		}
+		for _, call := range choice.Message.ToolCalls {
+			args, ok := call.Function.Arguments.(string)
+			if !ok {
+				raw, _ := json.Marshal(call.Function.Arguments)
+				args = string(raw)
+			}
+			fmt.Fprintf(&b, "[tool call] %s(%s)\n", call.Function.Name, args)
+		}
+	}
+	return b.String()
+}
+
+// Diff compares two texts line by line. Lines only in a are prefixed with
+// "-", lines only in b with "+" and common lines with a space. It returns
+// the empty string when they are equal.
+func Diff(a, b string) string {
+	if a == b {
+		return ""
+	}
+	x, y := strings.Split(a, "\n"), strings.Split(b, "\n")
+
+	// lcs[i][j] is the length of the longest common subsequence of x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var out strings.Builder
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			fmt.Fprintf(&out, "  %s\n", x[i])
+			i, j = i+1, j+1
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(&out, "- %s\n", x[i])
+			i++
+		default:
+			fmt.Fprintf(&out, "+ %s\n", y[j])
+			j++
+		}
+	}
+	return out.String()
+}
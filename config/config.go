@@ -2,7 +2,11 @@ package config
 
 import (
 	"fmt"
+	"llm-balancer/auth"
+	"llm-balancer/balancer"
+	"llm-balancer/capture"
 	"llm-balancer/llm"
+	"llm-balancer/usage"
 	"os"
 
 	"gopkg.in/yaml.v3"
@@ -14,13 +18,57 @@ type GeneralConfig struct {
 	ListenPort     int    `yaml:"listen_port"`
 	LogLevel       string `yaml:"log_level"`
 	ContextTimeout int    `yaml:"context_timeout"` // in seconds
+	ReloadInterval int    `yaml:"reload_interval"` // seconds between checks of the config file for changes, 0 reloads on SIGHUP only
+
+	// Default model selection, see balancer.NewSortStrategy
+	Strategy            string                        `yaml:"strategy"`
+	OptimizationWeights *balancer.OptimizationWeights `yaml:"optimization_weights"`
+}
+
+// AdminConfig holds the key of the admin API, which is off without one.
+type AdminConfig struct {
+	APIKey     string `yaml:"api_key"`
+	APIKeyName string `yaml:"api_key_name"` // environment variable holding the key
+}
+
+// Key returns the admin key, read from the environment when not set directly.
+func (a AdminConfig) Key() string {
+	if a.APIKey != "" || a.APIKeyName == "" {
+		return a.APIKey
+	}
+	return os.Getenv(a.APIKeyName)
+}
+
+// MetricsConfig sets where the Prometheus metrics are served. Without a
+// listen address they are served at /metrics of the API server to requests
+// carrying the admin key, and not at all without one.
+type MetricsConfig struct {
+	ListenAddress string `yaml:"listen_address"` // e.g. 127.0.0.1:9090, served without authentication
+}
+
+// AuthConfig holds the API keys clients authenticate with, see auth.Key.
+type AuthConfig struct {
+	Enabled bool        `yaml:"enabled"` // reject requests without a valid key
+	Keys    []*auth.Key `yaml:"keys"`
 }
 
 // Config is the root configuration struct.
 type Config struct {
-	General GeneralConfig       `yaml:"general"`
-	LLMAPIs []*llm.LLM          `yaml:"llms"`
-	Groups  map[string][]string `yaml:"-"` // maybe not a map[string][]string, but a struct with fields like free, fast, local, provider, etc.
+	General GeneralConfig          `yaml:"general"`
+	LLMAPIs []*llm.LLM             `yaml:"llms"`
+	Groups  map[string][]string    `yaml:"-"` // maybe not a map[string][]string, but a struct with fields like free, fast, local, provider, etc.
+	Retry   balancer.RetryPolicy   `yaml:"retry"`
+	Breaker balancer.BreakerConfig `yaml:"circuit_breaker"`
+	Health  balancer.HealthConfig  `yaml:"health_checks"`
+	Cache   balancer.CacheConfig   `yaml:"response_cache"`
+	Admin   AdminConfig            `yaml:"admin"`
+	Metrics MetricsConfig          `yaml:"metrics"`
+	Auth    AuthConfig             `yaml:"auth"`
+	Usage   usage.Config           `yaml:"usage"`
+	Capture capture.Config         `yaml:"capture"`
+
+	SharedLimits    []*balancer.SharedLimit            `yaml:"shared_limits"`
+	GroupStrategies map[string]balancer.StrategyConfig `yaml:"group_strategies"` // selection strategy per group
 }
 
 // LoadConfig reads the YAML config file and unmarshals it into a Config struct.
@@ -37,11 +85,7 @@ func LoadConfig(filename string) (*Config, error) {
 	// TODO: Create groups dynmically
 	cfg.Groups = make(map[string][]string)
 	for _, llm := range cfg.LLMAPIs {
-		cfg.Groups[llm.Provider] = append(cfg.Groups[llm.Provider], llm.Model)
-		if llm.CostInput+llm.CostOutput == 0 {
-			cfg.Groups["free"] = append(cfg.Groups["free"], llm.Model)
-		}
-		for _, g := range llm.Groups {
+		for _, g := range llm.GroupNames() {
 			cfg.Groups[g] = append(cfg.Groups[g], llm.Model)
 		}
 	}
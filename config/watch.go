@@ -0,0 +1,65 @@
+package config
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Watch reloads the config file on SIGHUP and, when interval is positive,
+// whenever its modification time changes, checked every interval. Every new
+// config that loads is handed to apply; configs that fail to load or that
+// apply rejects are logged and the running one stays active.
+// Watch blocks until ctx is done.
+func Watch(ctx context.Context, filename string, interval time.Duration, apply func(*Config) error) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	lastMod := modTime(filename)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Info().Str("file", filename).Msg("Reloading config on SIGHUP")
+		case <-tick:
+			mod := modTime(filename)
+			if mod.IsZero() || mod.Equal(lastMod) {
+				continue
+			}
+			log.Info().Str("file", filename).Msg("Reloading changed config")
+		}
+		lastMod = modTime(filename)
+
+		cfg, err := LoadConfig(filename)
+		if err == nil {
+			err = apply(cfg)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("file", filename).Msg("Rejected config reload, keeping the running config")
+			continue
+		}
+		log.Info().Str("file", filename).Msg("Config reloaded")
+	}
+}
+
+// modTime returns the modification time of a file, zero when it cannot be read.
+func modTime(filename string) time.Time {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
@@ -0,0 +1,70 @@
+package config_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"llm-balancer/config"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Watch", func() {
+	var (
+		path    string
+		applied chan *config.Config
+		cancel  context.CancelFunc
+	)
+
+	write := func(requestsPerMin int, mod time.Time) {
+		content := fmt.Sprintf(`
+general:
+  listen_address: "127.0.0.1"
+  listen_port: 8080
+llms:
+  - provider: "openai"
+    model: "gpt-4"
+    base_url: "https://api.openai.com/v1"
+    api_key: "test-key"
+    requests_per_minute: %d
+    tokens_per_minute: 1000
+`, requestsPerMin)
+		Expect(os.WriteFile(path, []byte(content), 0o600)).To(Succeed())
+		Expect(os.Chtimes(path, mod, mod)).To(Succeed())
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "config.yaml")
+		write(10, time.Now().Add(-time.Minute))
+
+		applied = make(chan *config.Config, 1)
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(context.Background())
+		go config.Watch(ctx, path, 10*time.Millisecond, func(cfg *config.Config) error {
+			applied <- cfg
+			return nil
+		})
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("applies the config when the file changes", func() {
+		Consistently(applied, "50ms").ShouldNot(Receive())
+
+		write(20, time.Now())
+		var cfg *config.Config
+		Eventually(applied).Should(Receive(&cfg))
+		Expect(cfg.LLMAPIs[0].RequestsPerMin).To(Equal(20))
+	})
+
+	It("keeps the running config when the new one is invalid", func() {
+		write(0, time.Now())
+		Consistently(applied, "100ms").ShouldNot(Receive())
+	})
+})
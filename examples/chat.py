@@ -1,12 +1,14 @@
 from openai import OpenAI
 import json
+import os
 import jsonschema
 from jsonschema import validate
 
 # Initialize the client pointing to your local llm-balancer
 client = OpenAI(
     base_url="http://localhost:8000/v1",  # Your llm-balancer endpoint
-    api_key="dummy-key",  # The actual API key is handled by the balancer
+    # A key issued by the balancer (see auth in config.yaml), the provider keys stay in the balancer
+    api_key=os.environ.get("LLM_BALANCER_API_KEY", "dummy-key"),
 )
 
 
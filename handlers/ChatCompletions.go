@@ -2,13 +2,19 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"llm-balancer/api"
+	"llm-balancer/auth"
 	"llm-balancer/balancer"
 	"llm-balancer/openai"
+	"llm-balancer/usage"
 	"net/http"
-	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
 )
 
 func (h *Handler) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
@@ -23,44 +29,124 @@ func (h *Handler) HandleChatCompletion(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	fmt.Printf("Received chat completion request messages: %s\n", string(bodyBytes))
+	log.Debug().Str("model", reqBody.Model).Int("messages", len(reqBody.Messages)).Int("bytes", len(bodyBytes)).Msg("Received chat completion request")
 
-	tokensNeeded, err := countTokens(string(bodyBytes))
-	if err != nil {
-		tokensNeeded = int(1.1 * float64(len(bodyBytes)) / BytesPerToken)
-	}
+	tokensNeeded := EstimateTokens(bodyBytes)
 
 	apiReq := &api.Request{
 		Request:      &reqBody,
 		TokensNeeded: tokensNeeded,
+		NoCache:      strings.Contains(r.Header.Get("Cache-Control"), "no-cache"),
 	}
 
 	ctx := r.Context()
-
-	// Route to the correct model
-	var ml *balancer.ModelLimiter
-	model := reqBody.Model
-	if slices.Contains(h.Pool.Models, model) {
-		ml = h.Pool.Assign(apiReq)
-	} else if group, ok := h.Pool.Groups[model]; ok {
-		ml = h.Pool.PickGroup(apiReq.TokensNeeded, group)
-	} else {
-		ml = h.Pool.PickAny(apiReq.TokensNeeded)
+	key := auth.FromContext(ctx)
+	rec := usage.Record{Time: time.Now(), Requested: reqBody.Model}
+	if key != nil {
+		rec.Key = key.Name
+	}
+	if err := h.restrict(key, apiReq); err != nil {
+		auth.WriteError(w, http.StatusForbidden, fmt.Sprintf("%v: %s", err, reqBody.Model), "invalid_request_error", "permission_denied")
+		return
+	}
+	if err := h.budget(key, apiReq); err != nil {
+		auth.WriteError(w, http.StatusTooManyRequests, err.Error(), "insufficient_quota", "insufficient_quota")
+		return
 	}
 
-	resp, err := h.Pool.DoAssigned(ctx, ml, apiReq)
+	// Route to the correct model, retrying on another one if it fails
+	resp, ml, err := h.Pool.Do(ctx, apiReq)
+	if errors.Is(err, balancer.ErrUnsupportedModality) {
+		auth.WriteError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "unsupported_modality")
+		return
+	}
+	if errors.Is(err, balancer.ErrUnsupportedCapability) {
+		auth.WriteError(w, http.StatusBadRequest, err.Error(), "invalid_request_error", "unsupported_capability")
+		return
+	}
 	if err != nil {
+		h.finish(rec, bodyBytes, ml, nil, nil, err)
 		http.Error(w, fmt.Sprintf("balancer Do failed: %v", err), http.StatusInternalServerError)
 		return
 	}
 	if resp.Error != nil {
+		h.finish(rec, bodyBytes, ml, resp, nil, resp.Error)
 		http.Error(w, fmt.Sprintf("API request failed: %v", resp.Error), http.StatusInternalServerError)
 		return
 	}
+	if resp.Cache != "" {
+		w.Header().Set("X-Cache", resp.Cache)
+	}
+	if resp.Stream != nil {
+		includeUsage := reqBody.StreamOptions != nil && reqBody.StreamOptions.IncludeUsage
+		streamed := writeStream(w, resp.Stream, includeUsage)
+		h.finish(rec, bodyBytes, ml, resp, streamed, nil)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(resp.Response); err != nil {
 		http.Error(w, fmt.Sprintf("failed to encode response: %v", err), http.StatusInternalServerError)
-		return
 	}
+	h.finish(rec, bodyBytes, ml, resp, resp.Response, nil)
+}
+
+// writeStream relays the chunks of an upstream stream to the client as
+// server-sent events, flushing after every chunk. It returns the response
+// the chunks relayed so far add up to.
+func writeStream(w http.ResponseWriter, stream api.Stream, includeUsage bool) *openai.ChatCompletionResponse {
+	defer func() { _ = stream.Close() }()
+
+	var streamed openai.ChatCompletionResponse
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = streamed.Add(chunk)
+		}
+		if err != nil {
+			// headers are already sent, report the failure in-band
+			log.Error().Err(err).Msg("Upstream stream failed")
+			writeEvent(w, map[string]any{"error": map[string]string{"message": err.Error(), "type": "upstream_error"}})
+			break
+		}
+
+		// only forward usage when the client asked for it
+		if !includeUsage && chunk.Usage != nil {
+			if len(chunk.Choices) == 0 {
+				continue
+			}
+			chunk.Usage = nil
+		}
+		if err := writeEvent(w, chunk); err != nil {
+			log.Debug().Err(err).Msg("Client went away while streaming")
+			return &streamed
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	if flusher != nil {
+		flusher.Flush()
+	}
+	return &streamed
+}
+
+func writeEvent(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", data)
+	return err
 }
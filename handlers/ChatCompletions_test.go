@@ -0,0 +1,372 @@
+package handlers_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"llm-balancer/auth"
+	"llm-balancer/balancer"
+	"llm-balancer/capture"
+	"llm-balancer/handlers"
+	"llm-balancer/llm"
+	"llm-balancer/usage"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+const upstreamStream = `data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"},"finish_reason":null}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"content":"lo"},"finish_reason":"stop"}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}
+
+data: [DONE]
+
+`
+
+const geminiStream = `data: {"candidates":[{"content":{"role":"model","parts":[{"text":"Hel"}]},"index":0}],"modelVersion":"gemini-test"}
+
+data: {"candidates":[{"content":{"role":"model","parts":[{"functionCall":{"name":"lookup","args":{"q":"x"}}}]},"finishReason":"STOP","index":0}],"usageMetadata":{"promptTokenCount":4,"candidatesTokenCount":3,"totalTokenCount":7},"modelVersion":"gemini-test"}
+
+`
+
+var _ = Describe("HandleChatCompletion", func() {
+	var (
+		upstream *ghttp.Server
+		handler  *handlers.Handler
+	)
+
+	BeforeEach(func() {
+		upstream = ghttp.NewServer()
+		model := upstreamLLM(upstream, "openai", "test-model")
+		model.Modalities = []string{llm.ModalityText, llm.ModalityVision, llm.ModalityAudio, llm.ModalityFile}
+		handler = newHandler(model)
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	Context("when the client asks to stream", func() {
+		BeforeEach(func() {
+			upstream.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/chat/completions"),
+				ghttp.VerifyJSONRepresenting(map[string]any{
+					"model":          "test-model",
+					"stream":         true,
+					"stream_options": map[string]any{"include_usage": true},
+					"messages":       []map[string]any{{"role": "user", "content": "hi"}},
+				}),
+				ghttp.RespondWith(http.StatusOK, upstreamStream, http.Header{"Content-Type": {"text/event-stream"}}),
+			))
+		})
+
+		It("relays every chunk as a server-sent event", func() {
+			body := `{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			rec := httptest.NewRecorder()
+			handler.HandleChatCompletion(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Header().Get("Content-Type")).To(Equal("text/event-stream"))
+			Expect(rec.Body.String()).To(ContainSubstring(`"content":"Hel"`))
+			Expect(rec.Body.String()).To(ContainSubstring(`"content":"lo"`))
+			Expect(rec.Body.String()).NotTo(ContainSubstring(`"usage"`))
+			Expect(rec.Body.String()).To(HaveSuffix("data: [DONE]\n\n"))
+		})
+
+		It("captures the request with the response the chunks add up to", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "capture.jsonl")
+			sink, err := capture.Open(capture.Config{Path: path})
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(sink.Close)
+			handler.Capture = sink
+
+			body := `{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+			rec := httptest.NewRecorder()
+			handler.HandleChatCompletion(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+			Expect(rec.Code).To(Equal(http.StatusOK))
+
+			var entries []*capture.Entry
+			Expect(capture.Read(path, func(_ int, e *capture.Entry) error {
+				entries = append(entries, e)
+				return nil
+			})).To(Succeed())
+			Expect(entries).To(HaveLen(1))
+			Expect(entries[0].Model).To(Equal("test-model"))
+			Expect(entries[0].Streamed).To(BeTrue())
+			Expect(entries[0].Request).To(MatchJSON(body))
+			Expect(capture.Text(entries[0].Response)).To(Equal("Hello\n"))
+			Expect(entries[0].Response.Choices[0].FinishReason).To(Equal("stop"))
+			Expect(entries[0].Response.Usage.TotalTokens).To(Equal(7))
+		})
+	})
+
+	It("reports a tool call index out of range in-band instead of relaying it", func() {
+		stream := `data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"tool_calls":[{"index":1099511627776,"function":{"arguments":"{}"}}]}}]}
+
+`
+		upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK, stream, http.Header{"Content-Type": {"text/event-stream"}}))
+
+		body := `{"model":"test-model","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+		rec := httptest.NewRecorder()
+		handler.HandleChatCompletion(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		Expect(rec.Body.String()).To(ContainSubstring("tool call index 1099511627776 out of range"))
+		Expect(rec.Body.String()).NotTo(ContainSubstring(`"tool_calls"`))
+	})
+
+	It("rejects parts no model supports with a 400", func() {
+		handler = newHandler(upstreamLLM(upstream, "openai", "test-model"))
+
+		body := `{"model":"test-model","messages":[{"role":"user","content":[{"type":"input_audio","input_audio":{"data":"d2F2","format":"wav"}}]}]}`
+		rec := httptest.NewRecorder()
+		handler.HandleChatCompletion(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring(`"type":"invalid_request_error"`))
+		Expect(rec.Body.String()).To(ContainSubstring("needs audio"))
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+
+	It("rejects features the model does not serve with a 400", func() {
+		model := upstreamLLM(upstream, "openai", "test-model")
+		model.Capabilities = []string{llm.CapabilityTools}
+		handler = newHandler(model)
+
+		body := `{"model":"test-model","response_format":{"type":"json_object"},"messages":[{"role":"user","content":"hi"}]}`
+		rec := httptest.NewRecorder()
+		handler.HandleChatCompletion(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring("needs json_object"))
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+
+	Context("when the API key is restricted to some models", func() {
+		var keys *auth.Store
+
+		send := func(body string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer sk-test")
+			rec := httptest.NewRecorder()
+			keys.Middleware(http.HandlerFunc(handler.HandleChatCompletion)).ServeHTTP(rec, req)
+			return rec
+		}
+
+		BeforeEach(func() {
+			other := upstreamLLM(upstream, "openai", "other-model")
+			other.BaseURL = "http://localhost:1"
+			handler = newHandler(other, upstreamLLM(upstream, "openai", "test-model"))
+			var err error
+			keys, err = auth.NewStore(true, []*auth.Key{{Name: "test", APIKey: "sk-test", Models: []string{"test-model"}}})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects requests for other models", func() {
+			rec := send(`{"model":"other-model","messages":[{"role":"user","content":"hi"}]}`)
+			Expect(rec.Code).To(Equal(http.StatusForbidden))
+			Expect(rec.Header().Get("Content-Type")).To(Equal("application/json"))
+			Expect(rec.Body.String()).To(ContainSubstring(`"code":"permission_denied"`))
+		})
+
+		It("picks among the allowed models only", func() {
+			upstream.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/chat/completions"),
+				ghttp.RespondWith(http.StatusOK, `{"id":"1","object":"chat.completion","model":"test-model","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}]}`,
+					http.Header{"Content-Type": {"application/json"}}),
+			))
+			rec := send(`{"model":"any","messages":[{"role":"user","content":"hi"}]}`)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("hello"))
+		})
+	})
+
+	Context("when the API key has a budget", func() {
+		var (
+			keys *auth.Store
+			key  *auth.Key
+		)
+
+		send := func(model string) *httptest.ResponseRecorder {
+			body := `{"model":"` + model + `","messages":[{"role":"user","content":"hi"}]}`
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer sk-test")
+			rec := httptest.NewRecorder()
+			keys.Middleware(http.HandlerFunc(handler.HandleChatCompletion)).ServeHTTP(rec, req)
+			return rec
+		}
+
+		respondAs := func(model string) http.HandlerFunc {
+			return ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/chat/completions"),
+				func(w http.ResponseWriter, r *http.Request) {
+					body, _ := io.ReadAll(r.Body)
+					Expect(string(body)).To(ContainSubstring(`"model":"` + model + `"`))
+				},
+				ghttp.RespondWith(http.StatusOK, `{"id":"1","object":"chat.completion","model":"`+model+`","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":100,"completion_tokens":50,"total_tokens":150}}`,
+					http.Header{"Content-Type": {"application/json"}}),
+			)
+		}
+
+		BeforeEach(func() {
+			paid := upstreamLLM(upstream, "openai", "paid-model")
+			paid.CostInput, paid.CostOutput = 0.001, 0.002
+			models := []*llm.LLM{paid, upstreamLLM(upstream, "openai", "free-model")}
+			pool, err := balancer.NewPool(balancer.Config{Models: models, Groups: map[string][]string{"free": {"free-model"}}})
+			Expect(err).NotTo(HaveOccurred())
+			key = &auth.Key{Name: "test", APIKey: "sk-test", Budget: &auth.Budget{Limit: 0.15}}
+			keys, err = auth.NewStore(true, []*auth.Key{key})
+			Expect(err).NotTo(HaveOccurred())
+			handler = handlers.NewHandler(pool, keys, nil, nil)
+		})
+
+		It("charges the cost of each call to the key", func() {
+			upstream.AppendHandlers(respondAs("paid-model"))
+			Expect(send("paid-model").Code).To(Equal(http.StatusOK))
+			Expect(keys.Spent("test", time.Now())).To(BeNumerically("~", 0.2))
+		})
+
+		It("rejects requests once the key is over budget", func() {
+			upstream.AppendHandlers(respondAs("paid-model"))
+			Expect(send("paid-model").Code).To(Equal(http.StatusOK))
+
+			rec := send("paid-model")
+			Expect(rec.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(rec.Body.String()).To(ContainSubstring(`"code":"insufficient_quota"`))
+			Expect(upstream.ReceivedRequests()).To(HaveLen(1))
+		})
+
+		It("downgrades to free models when configured", func() {
+			key.Budget.OnExceeded = auth.OnExceededDowngrade
+			upstream.AppendHandlers(respondAs("paid-model"), respondAs("free-model"), respondAs("free-model"))
+			Expect(send("paid-model").Code).To(Equal(http.StatusOK))
+			Expect(send("paid-model").Code).To(Equal(http.StatusOK))
+			Expect(send("free-model").Code).To(Equal(http.StatusOK))
+			Expect(keys.Spent("test", time.Now())).To(BeNumerically("~", 0.2))
+		})
+
+		It("only downgrades to free models the key may use", func() {
+			key.Budget.OnExceeded = auth.OnExceededDowngrade
+			key.Models = []string{"paid-model"}
+			upstream.AppendHandlers(respondAs("paid-model"))
+			Expect(send("paid-model").Code).To(Equal(http.StatusOK))
+
+			rec := send("paid-model")
+			Expect(rec.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(rec.Body.String()).To(ContainSubstring(`"code":"insufficient_quota"`))
+			Expect(upstream.ReceivedRequests()).To(HaveLen(1))
+		})
+	})
+
+	Context("when a usage ledger is kept", func() {
+		var keys *auth.Store
+
+		send := func(method, path, secret, body string, serve http.HandlerFunc) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(method, path, strings.NewReader(body))
+			req.Header.Set("Authorization", "Bearer "+secret)
+			rec := httptest.NewRecorder()
+			keys.Middleware(serve).ServeHTTP(rec, req)
+			return rec
+		}
+
+		BeforeEach(func() {
+			model := upstreamLLM(upstream, "openai", "test-model")
+			model.CostInput = 0.001
+			pool, err := balancer.NewPool(balancer.Config{Models: []*llm.LLM{model}})
+			Expect(err).NotTo(HaveOccurred())
+			keys, err = auth.NewStore(true, []*auth.Key{{Name: "a", APIKey: "sk-a"}, {Name: "b", APIKey: "sk-b"}})
+			Expect(err).NotTo(HaveOccurred())
+			ledger, err := usage.Open(filepath.Join(GinkgoT().TempDir(), "usage.jsonl"))
+			Expect(err).NotTo(HaveOccurred())
+			DeferCleanup(ledger.Close)
+			handler = handlers.NewHandler(pool, keys, ledger, nil)
+
+			upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK,
+				`{"id":"1","object":"chat.completion","model":"test-model","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}],"usage":{"prompt_tokens":100,"completion_tokens":50,"total_tokens":150}}`,
+				http.Header{"Content-Type": {"application/json"}}))
+			rec := send("POST", "/v1/chat/completions", "sk-a", `{"model":"test-model","messages":[{"role":"user","content":"hi"}]}`, handler.HandleChatCompletion)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		})
+
+		It("reports the usage of the requesting key", func() {
+			rec := send("GET", "/v1/usage?group_by=key,provider", "sk-a", "", handler.HandleUsage)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring(`"provider":"openai","key":"a","requests":1,"failed":0,"prompt_tokens":100,"completion_tokens":50,"cost":0.1,`))
+
+			rec = send("GET", "/v1/usage", "sk-b", "", handler.HandleUsage)
+			Expect(rec.Body.String()).To(MatchJSON(`{"object":"list","data":[]}`))
+		})
+
+		It("reports as CSV", func() {
+			rec := send("GET", "/v1/usage?format=csv&from=2000-01-01", "sk-a", "", handler.HandleUsage)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(HavePrefix("model,requests,failed,prompt_tokens,completion_tokens,cost,avg_latency_ms,avg_queue_ms\ntest-model,1,0,100,50,0.1,"))
+
+			Expect(send("GET", "/v1/usage?group_by=color", "sk-a", "", handler.HandleUsage).Code).To(Equal(http.StatusBadRequest))
+			Expect(send("GET", "/v1/usage?to=yesterday", "sk-a", "", handler.HandleUsage).Code).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("when the response cache is enabled", func() {
+		BeforeEach(func() {
+			models := []*llm.LLM{upstreamLLM(upstream, "openai", "test-model")}
+			pool, err := balancer.NewPool(balancer.Config{Models: models, Cache: balancer.CacheConfig{Enabled: true}})
+			Expect(err).NotTo(HaveOccurred())
+			handler = handlers.NewHandler(pool, nil, nil, nil)
+			for range 2 {
+				upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK,
+					`{"id":"1","object":"chat.completion","model":"test-model","choices":[{"index":0,"message":{"role":"assistant","content":"hello"},"finish_reason":"stop"}]}`,
+					http.Header{"Content-Type": {"application/json"}}))
+			}
+		})
+
+		send := func(cacheControl string) *httptest.ResponseRecorder {
+			body := `{"model":"test-model","temperature":0,"messages":[{"role":"user","content":"hi"}]}`
+			req := httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body))
+			if cacheControl != "" {
+				req.Header.Set("Cache-Control", cacheControl)
+			}
+			rec := httptest.NewRecorder()
+			handler.HandleChatCompletion(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			Expect(rec.Body.String()).To(ContainSubstring("hello"))
+			return rec
+		}
+
+		It("reports hits and misses and honors no-cache", func() {
+			Expect(send("").Header().Get("X-Cache")).To(Equal("MISS"))
+			Expect(send("").Header().Get("X-Cache")).To(Equal("HIT"))
+			Expect(send("no-cache").Header().Get("X-Cache")).To(Equal("BYPASS"))
+			Expect(upstream.ReceivedRequests()).To(HaveLen(2))
+		})
+	})
+
+	Context("when the model is served by another provider", func() {
+		BeforeEach(func() {
+			handler = newHandler(upstreamLLM(upstream, "google", "gemini-test"))
+
+			upstream.AppendHandlers(ghttp.CombineHandlers(
+				ghttp.VerifyRequest("POST", "/models/gemini-test:streamGenerateContent", "alt=sse&key=test-key"),
+				ghttp.RespondWith(http.StatusOK, geminiStream, http.Header{"Content-Type": {"text/event-stream"}}),
+			))
+		})
+
+		It("relays the stream translated into chat.completion.chunk deltas", func() {
+			body := `{"model":"gemini-test","stream":true,"stream_options":{"include_usage":true},"messages":[{"role":"user","content":"hi"}]}`
+			rec := httptest.NewRecorder()
+			handler.HandleChatCompletion(rec, httptest.NewRequest("POST", "/v1/chat/completions", strings.NewReader(body)))
+
+			Expect(rec.Code).To(Equal(http.StatusOK))
+			out := rec.Body.String()
+			Expect(out).To(ContainSubstring(`"object":"chat.completion.chunk"`))
+			Expect(out).To(ContainSubstring(`"delta":{"content":"Hel","role":"assistant"}`))
+			Expect(out).To(ContainSubstring(`"function":{"arguments":"{\"q\":\"x\"}","name":"lookup"}`))
+			Expect(out).To(ContainSubstring(`"finish_reason":"tool_calls"`))
+			Expect(out).To(ContainSubstring(`"usage":{"completion_tokens":3,"prompt_tokens":4,"total_tokens":7}`))
+			Expect(out).To(HaveSuffix("data: [DONE]\n\n"))
+		})
+	})
+})
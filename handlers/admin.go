@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"llm-balancer/auth"
+	"llm-balancer/balancer"
+	"llm-balancer/llm"
+	"llm-balancer/usage"
+
+	"github.com/rs/zerolog/log"
+)
+
+// AdminHandler serves the admin API, changing the pool at runtime.
+// Every request must carry the admin key as a bearer token.
+type AdminHandler struct {
+	Pool   *balancer.Pool
+	Keys   *auth.Store
+	Ledger *usage.Ledger
+	APIKey string
+
+	mux *http.ServeMux
+}
+
+// NewAdminHandler returns the admin API for pool and the client keys, serving:
+//
+//	POST   /admin/llms          add an LLM
+//	PATCH  /admin/llms/{model}  change fields of an LLM
+//	DELETE /admin/llms/{model}  remove an LLM
+//	GET    /admin/keys          list the client keys, without their secrets
+//	POST   /admin/keys          add a client key, generating the secret when none is given
+//	PATCH  /admin/keys/{name}   change fields of a client key
+//	DELETE /admin/keys/{name}   remove a client key
+//	GET    /admin/usage         report the usage of every key, see Handler.HandleUsage
+func NewAdminHandler(pool *balancer.Pool, keys *auth.Store, ledger *usage.Ledger, apiKey string) *AdminHandler {
+	h := &AdminHandler{Pool: pool, Keys: keys, Ledger: ledger, APIKey: apiKey, mux: http.NewServeMux()}
+	h.mux.HandleFunc("POST /admin/llms", h.HandleAddLLM)
+	h.mux.HandleFunc("PATCH /admin/llms/{model...}", h.HandleUpdateLLM)
+	h.mux.HandleFunc("DELETE /admin/llms/{model...}", h.HandleRemoveLLM)
+	h.mux.HandleFunc("GET /admin/keys", h.HandleListKeys)
+	h.mux.HandleFunc("POST /admin/keys", h.HandleAddKey)
+	h.mux.HandleFunc("PATCH /admin/keys/{name}", h.HandleUpdateKey)
+	h.mux.HandleFunc("DELETE /admin/keys/{name}", h.HandleRemoveKey)
+	h.mux.HandleFunc("GET /admin/usage", h.HandleUsage)
+	return h
+}
+
+func (h *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	RequireAdminKey(h.APIKey, h.mux).ServeHTTP(w, r)
+}
+
+// RequireAdminKey serves next only to requests carrying the admin key as a
+// bearer token, e.g. the metrics. Every request is rejected without a key.
+func RequireAdminKey(apiKey string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		want := "Bearer " + apiKey
+		got := r.Header.Get("Authorization")
+		if apiKey == "" || subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleAddLLM adds the LLM in the body to the pool. API keys are taken from
+// the environment variable named by api_key_name.
+func (h *AdminHandler) HandleAddLLM(w http.ResponseWriter, r *http.Request) {
+	var l llm.LLM
+	if err := decodeStrict(r, &l); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if err := h.Pool.AddModel(&l); err != nil {
+		writePoolError(w, err)
+		return
+	}
+	log.Info().Str("model", l.String()).Msg("Model added through the admin API")
+	writeJSON(w, http.StatusCreated, &l)
+}
+
+// HandleUpdateLLM applies the fields in the body to a copy of the LLM's
+// current configuration and replaces it. The model name cannot be changed.
+func (h *AdminHandler) HandleUpdateLLM(w http.ResponseWriter, r *http.Request) {
+	model := r.PathValue("model")
+	ml := h.Pool.Limiter(model)
+	if ml == nil {
+		http.Error(w, "unknown model "+model, http.StatusNotFound)
+		return
+	}
+
+	l := ml.LLM.Clone()
+	if err := decodeStrict(r, l); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if l.Model != model {
+		http.Error(w, "the model name cannot be changed, remove and add the model instead", http.StatusBadRequest)
+		return
+	}
+	if l.APIKeyName != ml.LLM.APIKeyName {
+		// read the key from the new variable
+		l.APIKey = ""
+	}
+	if err := h.Pool.UpdateModel(l); err != nil {
+		writePoolError(w, err)
+		return
+	}
+	log.Info().Str("model", l.String()).Msg("Model updated through the admin API")
+	writeJSON(w, http.StatusOK, l)
+}
+
+// HandleRemoveLLM removes an LLM from the pool.
+func (h *AdminHandler) HandleRemoveLLM(w http.ResponseWriter, r *http.Request) {
+	model := r.PathValue("model")
+	if err := h.Pool.RemoveModel(model); err != nil {
+		writePoolError(w, err)
+		return
+	}
+	log.Info().Str("model", model).Msg("Model removed through the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleListKeys lists the client keys without their secrets.
+func (h *AdminHandler) HandleListKeys(w http.ResponseWriter, r *http.Request) {
+	keys := h.Keys.Keys()
+	redacted := make([]*auth.Key, 0, len(keys))
+	for _, k := range keys {
+		redacted = append(redacted, k.Redacted())
+	}
+	writeJSON(w, http.StatusOK, redacted)
+}
+
+// HandleAddKey adds a client key. Without api_key or api_key_name a secret
+// is generated; it is only ever returned in this response.
+func (h *AdminHandler) HandleAddKey(w http.ResponseWriter, r *http.Request) {
+	var k auth.Key
+	if err := decodeStrict(r, &k); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if k.APIKey == "" && k.APIKeyName == "" {
+		k.APIKey = auth.NewSecret()
+	}
+	if err := h.Keys.Add(&k); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	log.Info().Str("key", k.Name).Msg("Client key added through the admin API")
+	writeJSON(w, http.StatusCreated, &k)
+}
+
+// HandleUpdateKey applies the fields in the body to a copy of a client key
+// and replaces it.
+func (h *AdminHandler) HandleUpdateKey(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	current, ok := h.Keys.Get(name)
+	if !ok {
+		http.Error(w, "unknown key "+name, http.StatusNotFound)
+		return
+	}
+
+	k := current.Clone()
+	if err := decodeStrict(r, k); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %v", err), http.StatusBadRequest)
+		return
+	}
+	if k.APIKeyName != current.APIKeyName && k.APIKey == current.APIKey {
+		// read the secret from the new variable
+		k.APIKey = ""
+	}
+	if err := h.Keys.Update(name, k); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	log.Info().Str("key", k.Name).Msg("Client key updated through the admin API")
+	writeJSON(w, http.StatusOK, k.Redacted())
+}
+
+// HandleRemoveKey removes a client key.
+func (h *AdminHandler) HandleRemoveKey(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if err := h.Keys.Remove(name); err != nil {
+		writeKeyError(w, err)
+		return
+	}
+	log.Info().Str("key", name).Msg("Client key removed through the admin API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleUsage reports the usage of every key in the ledger.
+func (h *AdminHandler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	writeUsage(w, r, h.Ledger, "")
+}
+
+func writeKeyError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, auth.ErrKeyNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, auth.ErrKeyExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+// decodeStrict decodes a JSON body, rejecting fields v does not have.
+func decodeStrict(r *http.Request, v any) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
+
+func writePoolError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, balancer.ErrModelNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, balancer.ErrModelExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
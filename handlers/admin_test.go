@@ -0,0 +1,154 @@
+package handlers_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"llm-balancer/auth"
+	"llm-balancer/balancer"
+	"llm-balancer/handlers"
+	"llm-balancer/llm"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("AdminHandler", func() {
+	var (
+		pool  *balancer.Pool
+		keys  *auth.Store
+		admin *handlers.AdminHandler
+	)
+
+	send := func(method, path, body string, authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorized {
+			req.Header.Set("Authorization", "Bearer admin-key")
+		}
+		rec := httptest.NewRecorder()
+		admin.ServeHTTP(rec, req)
+		return rec
+	}
+
+	BeforeEach(func() {
+		GinkgoT().Setenv("TEST_PROVIDER_KEY", "provider-key")
+		var err error
+		pool, err = balancer.NewPool(balancer.Config{Models: []*llm.LLM{{
+			Provider:       "openai",
+			Model:          "existing",
+			BaseURL:        "http://localhost:1",
+			APIKey:         "test-key",
+			RequestsPerMin: 60,
+			TokensPerMin:   100000,
+		}}, Groups: map[string][]string{"openai": {"existing"}}})
+		Expect(err).NotTo(HaveOccurred())
+		keys, err = auth.NewStore(true, nil)
+		Expect(err).NotTo(HaveOccurred())
+		admin = handlers.NewAdminHandler(pool, keys, nil, "admin-key")
+	})
+
+	It("rejects requests without the admin key", func() {
+		rec := send("DELETE", "/admin/llms/existing", "", false)
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		Expect(pool.Limiter("existing")).NotTo(BeNil())
+	})
+
+	It("adds an LLM to the pool and its groups", func() {
+		rec := send("POST", "/admin/llms", `{
+			"provider": "groq", "model": "org/new-model", "base_url": "http://localhost:2/v1",
+			"requests_per_minute": 30, "tokens_per_minute": 6000, "api_key_name": "TEST_PROVIDER_KEY",
+			"groups": ["fast"]
+		}`, true)
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+		Expect(rec.Body.String()).NotTo(ContainSubstring("provider-key"))
+
+		Expect(pool.Limiter("org/new-model")).NotTo(BeNil())
+		Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "fast", nil).LLM.Model).To(Equal("org/new-model"))
+		Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "free", map[string]bool{"existing": true}).LLM.Model).To(Equal("org/new-model"))
+	})
+
+	It("rejects invalid and duplicate LLMs", func() {
+		Expect(send("POST", "/admin/llms", `{"provider": "openai", "model": "broken"}`, true).Code).To(Equal(http.StatusBadRequest))
+		Expect(send("POST", "/admin/llms", `{"model": "x", "unknown": 1}`, true).Code).To(Equal(http.StatusBadRequest))
+		Expect(send("POST", "/admin/llms", `{
+			"provider": "openai", "model": "existing", "base_url": "http://localhost:2",
+			"requests_per_minute": 1, "tokens_per_minute": 1, "api_key_name": "TEST_PROVIDER_KEY"
+		}`, true).Code).To(Equal(http.StatusConflict))
+	})
+
+	It("updates fields of an LLM and keeps the rest", func() {
+		rec := send("PATCH", "/admin/llms/existing", `{"requests_per_minute": 5, "groups": ["slow"]}`, true)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+
+		ml := pool.Limiter("existing")
+		Expect(ml.LLM.RequestsPerMin).To(Equal(5))
+		Expect(ml.LLM.TokensPerMin).To(Equal(100000))
+		Expect(ml.ReqLimiter.Burst()).To(Equal(5))
+		Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "slow", nil)).To(Equal(ml))
+
+		Expect(send("PATCH", "/admin/llms/existing", `{"model": "renamed"}`, true).Code).To(Equal(http.StatusBadRequest))
+		Expect(send("PATCH", "/admin/llms/missing", `{}`, true).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("removes an LLM", func() {
+		Expect(send("DELETE", "/admin/llms/existing", "", true).Code).To(Equal(http.StatusNoContent))
+		Expect(pool.Limiter("existing")).To(BeNil())
+		Expect(pool.PickGroup(balancer.Needs{Tokens: 10}, "openai", nil)).To(BeNil())
+		Expect(send("DELETE", "/admin/llms/existing", "", true).Code).To(Equal(http.StatusNotFound))
+	})
+
+	It("issues a client key and only shows its secret once", func() {
+		rec := send("POST", "/admin/keys", `{"name": "scripts", "groups": ["free"]}`, true)
+		Expect(rec.Code).To(Equal(http.StatusCreated))
+		Expect(rec.Body.String()).To(ContainSubstring(`"api_key":"sk-lb-`))
+
+		key, ok := keys.Get("scripts")
+		Expect(ok).To(BeTrue())
+		Expect(key.Groups).To(Equal([]string{"free"}))
+
+		rec = send("GET", "/admin/keys", "", true)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(ContainSubstring(`"name":"scripts"`))
+		Expect(rec.Body.String()).NotTo(ContainSubstring(key.APIKey))
+
+		Expect(send("POST", "/admin/keys", `{"name": "scripts"}`, true).Code).To(Equal(http.StatusConflict))
+	})
+
+	It("disables and removes client keys", func() {
+		Expect(keys.Add(&auth.Key{Name: "scripts", APIKey: "sk-scripts"})).To(Succeed())
+
+		rec := send("PATCH", "/admin/keys/scripts", `{"disabled": true}`, true)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).NotTo(ContainSubstring("sk-scripts"))
+		key, _ := keys.Get("scripts")
+		Expect(key.Disabled).To(BeTrue())
+		Expect(key.APIKey).To(Equal("sk-scripts"))
+
+		Expect(send("DELETE", "/admin/keys/scripts", "", true).Code).To(Equal(http.StatusNoContent))
+		Expect(send("DELETE", "/admin/keys/scripts", "", true).Code).To(Equal(http.StatusNotFound))
+		Expect(send("PATCH", "/admin/keys/scripts", `{}`, true).Code).To(Equal(http.StatusNotFound))
+	})
+})
+
+var _ = Describe("RequireAdminKey", func() {
+	serve := func(apiKey, authorization string) int {
+		handler := handlers.RequireAdminKey(apiKey, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	It("serves requests carrying the admin key only", func() {
+		Expect(serve("admin-key", "Bearer admin-key")).To(Equal(http.StatusOK))
+		Expect(serve("admin-key", "Bearer other")).To(Equal(http.StatusUnauthorized))
+		Expect(serve("admin-key", "")).To(Equal(http.StatusUnauthorized))
+		Expect(serve("", "Bearer ")).To(Equal(http.StatusUnauthorized))
+	})
+})
@@ -1,8 +1,10 @@
 package handlers
 
 import (
+	"llm-balancer/auth"
 	"llm-balancer/balancer"
-	"llm-balancer/llm"
+	"llm-balancer/capture"
+	"llm-balancer/usage"
 )
 
 const (
@@ -10,13 +12,17 @@ const (
 )
 
 type Handler struct {
-	Pool *balancer.Pool
-	LLMs []*llm.LLM
+	Pool    *balancer.Pool
+	Keys    *auth.Store   // tracks the spending of client keys, may be nil
+	Ledger  *usage.Ledger // records every request, may be nil
+	Capture *capture.Sink // captures requests with their responses, may be nil
 }
 
-func NewHandler(pool *balancer.Pool, llms []*llm.LLM) *Handler {
+func NewHandler(pool *balancer.Pool, keys *auth.Store, ledger *usage.Ledger, sink *capture.Sink) *Handler {
 	return &Handler{
-		Pool: pool,
-		LLMs: llms,
+		Pool:    pool,
+		Keys:    keys,
+		Ledger:  ledger,
+		Capture: sink,
 	}
 }
@@ -0,0 +1,40 @@
+package handlers_test
+
+import (
+	"testing"
+
+	"llm-balancer/balancer"
+	"llm-balancer/handlers"
+	"llm-balancer/llm"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+func TestHandlers(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Handlers Suite")
+}
+
+// upstreamLLM returns a model of provider served by upstream, with limits no
+// test reaches.
+func upstreamLLM(upstream *ghttp.Server, provider, model string) *llm.LLM {
+	return &llm.LLM{
+		Name:           model,
+		Provider:       provider,
+		Model:          model,
+		BaseURL:        upstream.URL(),
+		APIKey:         "test-key",
+		RequestsPerMin: 60,
+		TokensPerMin:   100000,
+	}
+}
+
+// newHandler returns a handler routing to models, without keys, a usage
+// ledger or a capture.
+func newHandler(models ...*llm.LLM) *handlers.Handler {
+	pool, err := balancer.NewPool(balancer.Config{Models: models})
+	Expect(err).NotTo(HaveOccurred())
+	return handlers.NewHandler(pool, nil, nil, nil)
+}
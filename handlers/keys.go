@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/auth"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errModelNotAllowed is returned for requests naming a model or group
+// their key may not use.
+var errModelNotAllowed = errors.New("the API key may not use this model")
+
+// restrict applies the restrictions of the key a request was made with. A
+// model or group named by the request must be allowed; any other name picks
+// among the allowed models only.
+func (h *Handler) restrict(key *auth.Key, req *api.Request) error {
+	if key == nil || key.Unrestricted() {
+		return nil
+	}
+	allowed := h.allowedModels(key)
+	target := req.Request.Model
+	if h.Pool.Limiter(target) != nil {
+		if !slices.Contains(allowed, target) {
+			return errModelNotAllowed
+		}
+		return nil
+	}
+	if _, ok := h.Pool.Group(target); ok {
+		if !slices.Contains(key.Groups, target) {
+			return errModelNotAllowed
+		}
+		return nil
+	}
+	if len(allowed) == 0 {
+		// its groups are gone, e.g. after the models were removed
+		return errModelNotAllowed
+	}
+	req.AllowedModels = allowed
+	return nil
+}
+
+// allowedModels returns the models a restricted key may use: the ones it
+// lists and the members of the groups it lists.
+func (h *Handler) allowedModels(key *auth.Key) []string {
+	allowed := append([]string{}, key.Models...)
+	for _, group := range key.Groups {
+		members, _ := h.Pool.Group(group)
+		for _, model := range members {
+			if !slices.Contains(allowed, model) {
+				allowed = append(allowed, model)
+			}
+		}
+	}
+	return allowed
+}
+
+// budget applies the budget of the key a request was made with. A key over
+// its budget is rejected, or with on_exceeded: downgrade limited to the free
+// models it may use.
+func (h *Handler) budget(key *auth.Key, req *api.Request) error {
+	if key == nil || h.Keys == nil || !h.Keys.OverBudget(key, time.Now()) {
+		return nil
+	}
+	exceeded := fmt.Errorf("API key %s is over its budget of $%.2f per %s: %w",
+		key.Name, key.Budget.Limit, key.Budget.Period, auth.ErrBudgetExceeded)
+	if key.Budget.OnExceeded != auth.OnExceededDowngrade {
+		return exceeded
+	}
+
+	target := req.Request.Model
+	free, _ := h.Pool.Group("free")
+	if slices.Contains(free, target) {
+		return nil
+	}
+	candidates := free
+	if members, ok := h.Pool.Group(target); ok {
+		candidates = intersect(candidates, members)
+	}
+	if !key.Unrestricted() {
+		// restrict leaves AllowedModels unset for a named model
+		candidates = intersect(candidates, h.allowedModels(key))
+	}
+	if len(candidates) == 0 {
+		return exceeded
+	}
+	log.Info().Str("key", key.Name).Str("model", target).Msg("Key over budget, downgrading to free models")
+	// an empty model name picks among AllowedModels, see api.Request
+	req.Request.Model = ""
+	req.AllowedModels = candidates
+	return nil
+}
+
+// intersect returns the models in a that are also in b.
+func intersect(a, b []string) []string {
+	out := make([]string, 0, len(a))
+	for _, model := range a {
+		if slices.Contains(b, model) {
+			out = append(out, model)
+		}
+	}
+	return out
+}
@@ -0,0 +1,308 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"llm-balancer/api"
+	"llm-balancer/auth"
+	"llm-balancer/balancer"
+	"llm-balancer/openai"
+	"llm-balancer/usage"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// HandleMessages serves the Anthropic Messages API. The request is converted
+// into a chat completion, routed through the pool like any other and the
+// response or stream converted back, so Anthropic clients can use every
+// configured provider.
+func (h *Handler) HandleMessages(w http.ResponseWriter, r *http.Request) {
+	var anthropicReq api.AnthropicRequest
+	bodyBytes, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "invalid request")
+		return
+	}
+	if err := json.Unmarshal(bodyBytes, &anthropicReq); err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", "invalid JSON")
+		return
+	}
+	reqBody, err := api.OpenAIRequestFromAnthropicRequest(&anthropicReq)
+	if err != nil {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	// usage records and captures hold the chat completion that was routed
+	chatBody, err := json.Marshal(reqBody)
+	if err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", err.Error())
+		return
+	}
+
+	log.Debug().Str("model", reqBody.Model).Int("messages", len(reqBody.Messages)).Int("bytes", len(bodyBytes)).Msg("Received messages request")
+
+	tokensNeeded := EstimateTokens(bodyBytes)
+
+	apiReq := &api.Request{
+		Request:      reqBody,
+		TokensNeeded: tokensNeeded,
+		NoCache:      strings.Contains(r.Header.Get("Cache-Control"), "no-cache"),
+	}
+
+	ctx := r.Context()
+	key := auth.FromContext(ctx)
+	rec := usage.Record{Time: time.Now(), Requested: reqBody.Model}
+	if key != nil {
+		rec.Key = key.Name
+	}
+	if err := h.restrict(key, apiReq); err != nil {
+		writeAnthropicError(w, http.StatusForbidden, "permission_error", fmt.Sprintf("%v: %s", err, reqBody.Model))
+		return
+	}
+	if err := h.budget(key, apiReq); err != nil {
+		writeAnthropicError(w, http.StatusTooManyRequests, "rate_limit_error", err.Error())
+		return
+	}
+
+	resp, ml, err := h.Pool.Do(ctx, apiReq)
+	if errors.Is(err, balancer.ErrUnsupportedModality) || errors.Is(err, balancer.ErrUnsupportedCapability) {
+		writeAnthropicError(w, http.StatusBadRequest, "invalid_request_error", err.Error())
+		return
+	}
+	if err != nil {
+		h.finish(rec, chatBody, ml, nil, nil, err)
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", fmt.Sprintf("balancer Do failed: %v", err))
+		return
+	}
+	if resp.Error != nil {
+		h.finish(rec, chatBody, ml, resp, nil, resp.Error)
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", fmt.Sprintf("API request failed: %v", resp.Error))
+		return
+	}
+	if resp.Cache != "" {
+		w.Header().Set("X-Cache", resp.Cache)
+	}
+	if resp.Stream != nil {
+		streamed := writeAnthropicStream(w, resp.Stream)
+		h.finish(rec, chatBody, ml, resp, streamed, nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(api.AnthropicResponseFromOpenAIResponse(resp.Response)); err != nil {
+		writeAnthropicError(w, http.StatusInternalServerError, "api_error", fmt.Sprintf("failed to encode response: %v", err))
+	}
+	h.finish(rec, chatBody, ml, resp, resp.Response, nil)
+}
+
+// writeAnthropicStream relays an upstream stream to the client as Messages
+// API events: message_start, a content block per text run and tool call,
+// message_delta with the stop reason and usage, then message_stop. It
+// returns the response the chunks relayed so far add up to.
+func writeAnthropicStream(w http.ResponseWriter, stream api.Stream) *openai.ChatCompletionResponse {
+	defer func() { _ = stream.Close() }()
+
+	var streamed openai.ChatCompletionResponse
+	flusher, _ := w.(http.Flusher)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	events := &anthropicEvents{w: w, flusher: flusher, text: -1, toolBlocks: make(map[int]int)}
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err == nil {
+			err = streamed.Add(chunk)
+		}
+		if err != nil {
+			// headers are already sent, report the failure in-band
+			log.Error().Err(err).Msg("Upstream stream failed")
+			_ = events.send("error", map[string]any{"error": map[string]string{"type": "api_error", "message": err.Error()}})
+			return &streamed
+		}
+
+		if err := events.chunk(&streamed, chunk); err != nil {
+			log.Debug().Err(err).Msg("Client went away while streaming")
+			return &streamed
+		}
+	}
+
+	if err := events.finish(&streamed); err != nil {
+		log.Debug().Err(err).Msg("Client went away while streaming")
+	}
+	return &streamed
+}
+
+// anthropicEvents writes the Messages API events for the chunks of a stream.
+// Only the first choice is relayed, the Messages API has no choices.
+// Upstreams may interleave the arguments of several tool calls, so tool_use
+// blocks stay open until the end; a text block is closed by the next block.
+type anthropicEvents struct {
+	w          io.Writer
+	flusher    http.Flusher
+	started    bool
+	blocks     int         // content blocks started so far
+	text       int         // index of the open text block, -1 when none is
+	toolBlocks map[int]int // content block index per tool call index
+	stopReason string
+}
+
+func (e *anthropicEvents) send(event string, data map[string]any) error {
+	data["type"] = event
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(e.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	if e.flusher != nil {
+		e.flusher.Flush()
+	}
+	return nil
+}
+
+// start sends message_start before the first content, usage is only known
+// at the end and reported by message_delta.
+func (e *anthropicEvents) start(streamed *openai.ChatCompletionResponse) error {
+	if e.started {
+		return nil
+	}
+	e.started = true
+	return e.send("message_start", map[string]any{"message": map[string]any{
+		"id": streamed.ID, "type": "message", "role": "assistant", "model": streamed.Model,
+		"content": []any{}, "stop_reason": nil, "stop_sequence": nil,
+		"usage": map[string]int{"input_tokens": 0, "output_tokens": 0},
+	}})
+}
+
+// open closes the open text block and starts a new block, returning its index.
+func (e *anthropicEvents) open(blockType string, contentBlock map[string]any) (int, error) {
+	if err := e.closeText(); err != nil {
+		return 0, err
+	}
+	index := e.blocks
+	e.blocks++
+	contentBlock["type"] = blockType
+	return index, e.send("content_block_start", map[string]any{"index": index, "content_block": contentBlock})
+}
+
+// closeText closes the open text block, if any.
+func (e *anthropicEvents) closeText() error {
+	if e.text < 0 {
+		return nil
+	}
+	index := e.text
+	e.text = -1
+	return e.send("content_block_stop", map[string]any{"index": index})
+}
+
+func (e *anthropicEvents) chunk(streamed *openai.ChatCompletionResponse, chunk *openai.ChatCompletionChunk) error {
+	if err := e.start(streamed); err != nil {
+		return err
+	}
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		if err := e.delta(choice.Delta); err != nil {
+			return err
+		}
+		if choice.FinishReason != nil {
+			e.stopReason = api.AnthropicStopReason(*choice.FinishReason)
+		}
+	}
+	return nil
+}
+
+// delta sends a text_delta for content, in a new text block unless one is
+// open, and an input_json_delta for tool call arguments to the tool_use block
+// of the call, starting one for each new tool call.
+func (e *anthropicEvents) delta(delta openai.Delta) error {
+	if delta.Content != nil && *delta.Content != "" {
+		if e.text < 0 {
+			index, err := e.open("text", map[string]any{"text": ""})
+			if err != nil {
+				return err
+			}
+			e.text = index
+		}
+		err := e.send("content_block_delta", map[string]any{
+			"index": e.text,
+			"delta": map[string]any{"type": "text_delta", "text": *delta.Content},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, call := range delta.ToolCalls {
+		index, ok := e.toolBlocks[call.Index]
+		if !ok {
+			var err error
+			index, err = e.open("tool_use", map[string]any{"id": call.ID, "name": call.Function.Name, "input": map[string]any{}})
+			if err != nil {
+				return err
+			}
+			e.toolBlocks[call.Index] = index
+		}
+		if call.Function.Arguments == "" {
+			continue
+		}
+		err := e.send("content_block_delta", map[string]any{
+			"index": index,
+			"delta": map[string]any{"type": "input_json_delta", "partial_json": call.Function.Arguments},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// finish closes the open content blocks and sends message_delta and
+// message_stop.
+func (e *anthropicEvents) finish(streamed *openai.ChatCompletionResponse) error {
+	if err := e.start(streamed); err != nil {
+		return err
+	}
+	if err := e.closeText(); err != nil {
+		return err
+	}
+	for _, index := range slices.Sorted(maps.Values(e.toolBlocks)) {
+		if err := e.send("content_block_stop", map[string]any{"index": index}); err != nil {
+			return err
+		}
+	}
+	if e.stopReason == "" {
+		e.stopReason = "end_turn"
+	}
+	err := e.send("message_delta", map[string]any{
+		"delta": map[string]any{"stop_reason": e.stopReason, "stop_sequence": nil},
+		"usage": map[string]int{"input_tokens": streamed.Usage.PromptTokens, "output_tokens": streamed.Usage.CompletionTokens},
+	})
+	if err != nil {
+		return err
+	}
+	return e.send("message_stop", map[string]any{})
+}
+
+// writeAnthropicError answers in the error format of the Anthropic API.
+func writeAnthropicError(w http.ResponseWriter, status int, errType, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{
+		"type":  "error",
+		"error": map[string]string{"type": errType, "message": message},
+	})
+}
@@ -0,0 +1,182 @@
+package handlers_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"llm-balancer/api"
+	"llm-balancer/handlers"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+)
+
+const toolCallStream = `data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"role":"assistant","content":"Hel"},"finish_reason":null}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":""}}]},"finish_reason":null}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"q\":\"x\"}"}}]},"finish_reason":"tool_calls"}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[],"usage":{"prompt_tokens":5,"completion_tokens":2,"total_tokens":7}}
+
+data: [DONE]
+
+`
+
+const interleavedToolCallStream = `data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"lookup","arguments":"{\"q\":"}}]}}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"tool_calls":[{"index":1,"id":"call_2","type":"function","function":{"name":"lookup","arguments":"{\"q\":"}}]}}]}
+
+data: {"id":"1","object":"chat.completion.chunk","model":"test-model","choices":[{"index":0,"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"x\"}"}},{"index":1,"function":{"arguments":"\"y\"}"}}]},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+
+`
+
+var _ = Describe("HandleMessages", func() {
+	var (
+		upstream *ghttp.Server
+		handler  *handlers.Handler
+	)
+
+	send := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.HandleMessages(rec, httptest.NewRequest("POST", "/v1/messages", strings.NewReader(body)))
+		return rec
+	}
+
+	BeforeEach(func() {
+		upstream = ghttp.NewServer()
+		handler = newHandler(upstreamLLM(upstream, "openai", "test-model"))
+	})
+
+	AfterEach(func() {
+		upstream.Close()
+	})
+
+	It("routes a Messages API request as a chat completion and converts the response back", func() {
+		upstream.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/chat/completions"),
+			ghttp.VerifyJSONRepresenting(map[string]any{
+				"model":                 "test-model",
+				"max_completion_tokens": 256,
+				"messages": []map[string]any{
+					{"role": "system", "content": "Be brief."},
+					{"role": "user", "content": []map[string]any{{"type": "text", "text": "Look it up"}}},
+					{"role": "assistant", "content": nil, "tool_calls": []map[string]any{
+						{"id": "toolu_1", "type": "function", "function": map[string]any{"name": "lookup", "arguments": `{"q":"x"}`}},
+					}},
+					{"role": "tool", "tool_call_id": "toolu_1", "content": "found"},
+				},
+				"tools": []map[string]any{{
+					"type":     "function",
+					"function": map[string]any{"name": "lookup", "parameters": map[string]any{"type": "object"}},
+				}},
+				"tool_choice": "auto",
+			}),
+			ghttp.RespondWith(http.StatusOK, `{"id":"chatcmpl-1","object":"chat.completion","model":"test-model",
+				"choices":[{"index":0,"finish_reason":"stop","message":{"role":"assistant","content":"It is x."}}],
+				"usage":{"prompt_tokens":12,"completion_tokens":4,"total_tokens":16}}`),
+		))
+
+		rec := send(`{"model":"test-model","max_tokens":256,"system":[{"type":"text","text":"Be brief."}],
+			"tools":[{"name":"lookup","input_schema":{"type":"object"}}],"tool_choice":{"type":"auto"},
+			"messages":[
+				{"role":"user","content":"Look it up"},
+				{"role":"assistant","content":[{"type":"tool_use","id":"toolu_1","name":"lookup","input":{"q":"x"}}]},
+				{"role":"user","content":[{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"found"}]}]}
+			]}`)
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		var resp api.AnthropicResponse
+		Expect(json.Unmarshal(rec.Body.Bytes(), &resp)).To(Succeed())
+		Expect(resp.Type).To(Equal("message"))
+		Expect(resp.Role).To(Equal("assistant"))
+		Expect(resp.StopReason).To(Equal("end_turn"))
+		Expect(resp.Content).To(HaveLen(1))
+		Expect(resp.Content[0].Text).To(Equal("It is x."))
+		Expect(resp.Usage).To(Equal(api.AnthropicUsage{InputTokens: 12, OutputTokens: 4}))
+	})
+
+	It("converts the stream into Messages API events", func() {
+		upstream.AppendHandlers(ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/chat/completions"),
+			ghttp.RespondWith(http.StatusOK, toolCallStream, http.Header{"Content-Type": {"text/event-stream"}}),
+		))
+
+		rec := send(`{"model":"test-model","max_tokens":256,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get("Content-Type")).To(Equal("text/event-stream"))
+		var events []string
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if event, ok := strings.CutPrefix(line, "event: "); ok {
+				events = append(events, event)
+			}
+		}
+		Expect(events).To(Equal([]string{
+			"message_start",
+			"content_block_start", "content_block_delta", "content_block_stop",
+			"content_block_start", "content_block_delta", "content_block_stop",
+			"message_delta", "message_stop",
+		}))
+		out := rec.Body.String()
+		Expect(out).To(ContainSubstring(`"delta":{"text":"Hel","type":"text_delta"}`))
+		Expect(out).To(ContainSubstring(`"content_block":{"id":"call_1","input":{},"name":"lookup","type":"tool_use"}`))
+		Expect(out).To(ContainSubstring(`"delta":{"partial_json":"{\"q\":\"x\"}","type":"input_json_delta"}`))
+		Expect(out).To(ContainSubstring(`"delta":{"stop_reason":"tool_use","stop_sequence":null}`))
+		Expect(out).To(ContainSubstring(`"usage":{"input_tokens":5,"output_tokens":2}`))
+	})
+
+	It("keeps the block of every tool call open while their arguments interleave", func() {
+		upstream.AppendHandlers(ghttp.RespondWith(http.StatusOK, interleavedToolCallStream, http.Header{"Content-Type": {"text/event-stream"}}))
+
+		rec := send(`{"model":"test-model","max_tokens":256,"stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		stopped := map[int]bool{}
+		arguments := map[int]string{}
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			data, ok := strings.CutPrefix(line, "data: ")
+			if !ok {
+				continue
+			}
+			var event struct {
+				Type  string `json:"type"`
+				Index int    `json:"index"`
+				Delta struct {
+					PartialJSON string `json:"partial_json"`
+				} `json:"delta"`
+			}
+			Expect(json.Unmarshal([]byte(data), &event)).To(Succeed())
+			switch event.Type {
+			case "content_block_delta":
+				Expect(stopped[event.Index]).To(BeFalse(), "delta for closed block %d", event.Index)
+				arguments[event.Index] += event.Delta.PartialJSON
+			case "content_block_stop":
+				stopped[event.Index] = true
+			}
+		}
+		Expect(arguments).To(Equal(map[int]string{0: `{"q":"x"}`, 1: `{"q":"y"}`}))
+		Expect(stopped).To(Equal(map[int]bool{0: true, 1: true}))
+	})
+
+	It("answers unsupported requests with an Anthropic error", func() {
+		rec := send(`{"model":"test-model","max_tokens":256,"messages":[{"role":"user","content":[{"type":"video"}]}]}`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring(`"type":"invalid_request_error"`))
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+
+	It("rejects images when no model supports vision", func() {
+		rec := send(`{"model":"test-model","max_tokens":256,"messages":[{"role":"user","content":[
+			{"type":"image","source":{"type":"base64","media_type":"image/png","data":"aGk="}}]}]}`)
+		Expect(rec.Code).To(Equal(http.StatusBadRequest))
+		Expect(rec.Body.String()).To(ContainSubstring(`"type":"invalid_request_error"`))
+		Expect(rec.Body.String()).To(ContainSubstring("needs vision"))
+		Expect(upstream.ReceivedRequests()).To(BeEmpty())
+	})
+})
@@ -2,10 +2,47 @@ package handlers
 
 import (
 	"encoding/json"
+	"llm-balancer/auth"
+	"llm-balancer/llm"
 	"net/http"
+	"slices"
+	"time"
 )
 
+// modelStatus is a configured LLM along with its live state in the pool.
+type modelStatus struct {
+	*llm.LLM
+	Circuit       string     `json:"circuit"`                  // closed, open or half-open
+	CooldownUntil *time.Time `json:"cooldown_until,omitempty"` // set while the provider rate limits the model
+	Healthy       bool       `json:"healthy"`
+	HealthError   string     `json:"health_error,omitempty"` // why the latest health check failed
+}
+
 func (h *Handler) HandleModels(w http.ResponseWriter, r *http.Request) {
+	llms := h.Pool.LLMs()
+	var allowed []string
+	if key := auth.FromContext(r.Context()); key != nil && !key.Unrestricted() {
+		allowed = h.allowedModels(key)
+	}
+	models := make([]modelStatus, 0, len(llms))
+	for _, l := range llms {
+		if allowed != nil && !slices.Contains(allowed, l.Model) {
+			continue
+		}
+		status := modelStatus{LLM: l}
+		if ml := h.Pool.Limiter(l.Model); ml != nil {
+			status.Circuit = ml.Breaker.State()
+			status.Healthy = ml.Healthy()
+			if err := ml.HealthError(); err != nil {
+				status.HealthError = err.Error()
+			}
+			if until := ml.CooldownUntil(); !until.IsZero() {
+				status.CooldownUntil = &until
+			}
+		}
+		models = append(models, status)
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(h.LLMs)
+	json.NewEncoder(w).Encode(models)
 }
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/auth"
+	"llm-balancer/balancer"
+	"llm-balancer/capture"
+	"llm-balancer/openai"
+	"llm-balancer/usage"
+
+	"github.com/rs/zerolog/log"
+)
+
+// finish completes the usage record of a request started at rec.Time,
+// charges its cost to the client key, appends it to the ledger and captures
+// the body with the final response.
+func (h *Handler) finish(rec usage.Record, body []byte, ml *balancer.ModelLimiter, resp *api.Response, final *openai.ChatCompletionResponse, err error) {
+	var u *openai.Usage
+	if final != nil {
+		u = &final.Usage
+	}
+	rec.LatencyMS = time.Since(rec.Time).Milliseconds()
+	rec.Outcome = balancer.Outcome(err)
+	if resp != nil {
+		rec.QueueMS = resp.QueueTime.Milliseconds()
+	}
+	if ml != nil {
+		rec.Name, rec.Model, rec.Provider = ml.LLM.Name, ml.LLM.Model, ml.LLM.Provider
+		rec.Cost = ml.LLM.Cost(u)
+	}
+	if u != nil {
+		rec.PromptTokens, rec.CompletionTokens = u.PromptTokens, u.CompletionTokens
+	}
+	if resp != nil && resp.Cache == balancer.CacheHit {
+		// no provider was called, the tokens were paid for by the cached request
+		rec.Outcome = balancer.OutcomeCached
+		rec.PromptTokens, rec.CompletionTokens, rec.Cost = 0, 0, 0
+	}
+
+	if rec.Key != "" && h.Keys != nil {
+		h.Keys.Charge(rec.Key, rec.Cost, rec.Time)
+	}
+	if h.Ledger != nil {
+		if err := h.Ledger.Append(rec); err != nil {
+			log.Error().Err(err).Msg("Failed to write usage record")
+		}
+	}
+	if h.Capture != nil {
+		entry := &capture.Entry{
+			Time:      rec.Time,
+			Key:       rec.Key,
+			Requested: rec.Requested,
+			Model:     rec.Model,
+			Provider:  rec.Provider,
+			Request:   body,
+			Response:  final,
+			Streamed:  resp != nil && resp.Stream != nil,
+			LatencyMS: rec.LatencyMS,
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+		if err := h.Capture.Write(entry); err != nil {
+			log.Error().Err(err).Msg("Failed to capture request")
+		}
+	}
+}
+
+// HandleUsage reports the usage in the ledger, aggregated by the
+// dimensions in group_by (model, provider, key and day; model by default).
+// from and to select whole UTC days, format selects json or csv. Clients
+// authenticated with a key only see their own usage.
+func (h *Handler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+	var keyName string
+	if key := auth.FromContext(r.Context()); key != nil {
+		keyName = key.Name
+	}
+	writeUsage(w, r, h.Ledger, keyName)
+}
+
+// writeUsage answers a usage report, limited to the named key unless empty.
+func writeUsage(w http.ResponseWriter, r *http.Request, ledger *usage.Ledger, keyName string) {
+	if ledger == nil {
+		http.Error(w, "no usage ledger is configured", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	groupBy := []string{usage.ByModel}
+	if g := query.Get("group_by"); g != "" {
+		groupBy = strings.Split(g, ",")
+	}
+	report, err := usage.NewReport(groupBy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var from, to time.Time
+	if s := query.Get("from"); s != "" {
+		if from, err = time.Parse(time.DateOnly, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := query.Get("to"); s != "" {
+		if to, err = time.Parse(time.DateOnly, s); err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %v", err), http.StatusBadRequest)
+			return
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+
+	err = ledger.Records(from, func(rec usage.Record) {
+		if (to.IsZero() || rec.Time.Before(to)) && (keyName == "" || rec.Key == keyName) {
+			report.Add(rec)
+		}
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to read the usage ledger")
+		http.Error(w, "failed to read the usage ledger", http.StatusInternalServerError)
+		return
+	}
+
+	switch query.Get("format") {
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv")
+		if err := report.WriteCSV(w); err != nil {
+			log.Debug().Err(err).Msg("Failed to write the usage report")
+		}
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"object": "list", "data": report.Aggregates()})
+	default:
+		http.Error(w, "format must be json or csv", http.StatusBadRequest)
+	}
+}
@@ -11,3 +11,13 @@ func countTokens(text string) (int, error) {
 	tokens := encoding.Encode(text, nil, nil)
 	return len(tokens), nil
 }
+
+// EstimateTokens returns the tokens a request body is reserved for with the
+// rate limiters, counted with tiktoken or estimated from its length.
+func EstimateTokens(body []byte) int {
+	tokens, err := countTokens(string(body))
+	if err != nil {
+		return int(1.1 * float64(len(body)) / BytesPerToken)
+	}
+	return tokens
+}
@@ -3,7 +3,12 @@ package llm
 import (
 	"fmt"
 	"llm-balancer/api"
+	"llm-balancer/openai"
+	"maps"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
@@ -17,21 +22,117 @@ type LLM struct {
 	TokensPerMin   int      `yaml:"tokens_per_minute" json:"tokens_per_minute"`     // tokens per minute
 	RequestsPerMin int      `yaml:"requests_per_minute" json:"requests_per_minute"` // requests per minute
 	ContextLength  int      `yaml:"context_length" json:"context_length"`
-	CostInput      float64  `yaml:"cost_input" json:"cost_input"`   // in dollars
-	CostOutput     float64  `yaml:"cost_output" json:"cost_output"` // in dollars
+	CostInput      float64  `yaml:"cost_input" json:"cost_input"`   // in dollars per input token
+	CostOutput     float64  `yaml:"cost_output" json:"cost_output"` // in dollars per output token
 	Quality        int      `yaml:"quality" json:"quality"`
-	APIKey         string   `yaml:"api_key" json:"-"`                 // API key for the provider
-	APIKeyName     string   `yaml:"api_key_name" json:"api_key_name"` // API key name for the provider
-	Modalities     []string `yaml:"modalities" json:"modalities"`     // text, vision, audio, etc
+	APIKey         string   `yaml:"api_key" json:"-"`                           // API key for the provider
+	APIKeyName     string   `yaml:"api_key_name" json:"api_key_name"`           // API key name for the provider
+	Modalities     []string `yaml:"modalities" json:"modalities"`               // text, vision, audio, file, etc
+	Capabilities   []string `yaml:"capabilities" json:"capabilities,omitempty"` // request features served, all when empty
 	Groups         []string `yaml:"groups" json:"groups"`
+	LimitBuckets   []string `yaml:"limit_buckets" json:"limit_buckets,omitempty"` // named shared limits this model draws from
 
-	Client api.Client `yaml:"-"` // API client for the provider
+	// Ollama only: options sent with every request, and how long the model
+	// stays loaded after a request.
+	Options   map[string]any `yaml:"options" json:"options,omitempty"`
+	KeepAlive string         `yaml:"keep_alive" json:"keep_alive,omitempty"`
+
+	Client api.Client `yaml:"-" json:"-"` // API client for the provider
 }
 
 func (llm *LLM) String() string {
 	return fmt.Sprintf("%s-%s", llm.Provider, llm.Model)
 }
 
+// Clone returns a copy of the configuration that shares no slices with it.
+func (llm *LLM) Clone() *LLM {
+	c := *llm
+	c.Modalities = slices.Clone(llm.Modalities)
+	c.Capabilities = slices.Clone(llm.Capabilities)
+	c.Groups = slices.Clone(llm.Groups)
+	c.LimitBuckets = slices.Clone(llm.LimitBuckets)
+	c.Options = maps.Clone(llm.Options)
+	return &c
+}
+
+// Modalities a request can need besides text, see LLM.Modalities.
+const (
+	ModalityText   = "text"
+	ModalityVision = "vision" // image inputs
+	ModalityAudio  = "audio"  // audio inputs or outputs
+	ModalityFile   = "file"   // file inputs such as PDFs
+)
+
+// SupportsModalities reports whether the model declares every one of the
+// modalities, a model declaring none supports text only.
+func (llm *LLM) SupportsModalities(modalities []string) bool {
+	for _, modality := range modalities {
+		if modality == ModalityText {
+			continue
+		}
+		if !slices.Contains(llm.Modalities, modality) {
+			return false
+		}
+	}
+	return true
+}
+
+// Capabilities are request features not every model serves, see
+// LLM.Capabilities.
+const (
+	CapabilityTools             = "tools"
+	CapabilityParallelToolCalls = "parallel_tool_calls"
+	CapabilityJSONSchema        = "json_schema" // response_format json_schema
+	CapabilityJSONObject        = "json_object" // response_format json_object
+	CapabilityReasoning         = "reasoning"   // reasoning_effort
+	CapabilityLogprobs          = "logprobs"
+	CapabilitySeed              = "seed"
+	CapabilityMultipleChoices   = "n" // n greater than 1
+)
+
+var capabilities = []string{
+	CapabilityTools, CapabilityParallelToolCalls, CapabilityJSONSchema, CapabilityJSONObject,
+	CapabilityReasoning, CapabilityLogprobs, CapabilitySeed, CapabilityMultipleChoices,
+}
+
+// SupportsCapabilities reports whether the model declares every one of the
+// capabilities. A model declaring none is assumed to support them all, so
+// configurations from before capabilities existed keep working.
+func (llm *LLM) SupportsCapabilities(capabilities []string) bool {
+	if len(llm.Capabilities) == 0 {
+		return true
+	}
+	for _, capability := range capabilities {
+		if !slices.Contains(llm.Capabilities, capability) {
+			return false
+		}
+	}
+	return true
+}
+
+// GroupNames returns the groups the model belongs to: its provider, free
+// when it has no cost, and the groups it lists.
+func (llm *LLM) GroupNames() []string {
+	groups := []string{llm.Provider}
+	if llm.CostInput+llm.CostOutput == 0 {
+		groups = append(groups, "free")
+	}
+	for _, g := range llm.Groups {
+		if !slices.Contains(groups, g) {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// Cost returns the price in dollars of the tokens a request consumed.
+func (llm *LLM) Cost(usage *openai.Usage) float64 {
+	if usage == nil {
+		return 0
+	}
+	return float64(usage.PromptTokens)*llm.CostInput + float64(usage.CompletionTokens)*llm.CostOutput
+}
+
 func (llm *LLM) Validate() bool {
 	// Check if all required fields are set
 	if llm.Provider == "" || llm.Model == "" || llm.BaseURL == "" || llm.RequestsPerMin <= 0 || llm.TokensPerMin <= 0 {
@@ -39,14 +140,27 @@ func (llm *LLM) Validate() bool {
 	}
 
 	if len(llm.Modalities) == 0 {
-		llm.Modalities = []string{"text"} // default to text mode if none specified
+		llm.Modalities = []string{ModalityText} // default to text mode if none specified
 	}
 
 	if llm.ContextLength <= 0 {
 		llm.ContextLength = 4096 * 8 // default context length
 	}
 
-	if llm.APIKey == "" {
+	for _, capability := range llm.Capabilities {
+		if !slices.Contains(capabilities, capability) {
+			log.Error().Str("model", llm.String()).Str("capability", capability).Msg("Unknown capability")
+			return false
+		}
+	}
+
+	if err := llm.CheckBaseURL(); err != nil {
+		log.Error().Err(err).Str("model", llm.String()).Msg("Invalid base URL")
+		return false
+	}
+
+	// a local Ollama server needs no key
+	if llm.APIKey == "" && !(llm.Provider == "ollama" && llm.APIKeyName == "") {
 		apiKey := os.Getenv(llm.APIKeyName) // use environment variable if API key is not provided
 		if apiKey == "" {
 			log.Warn().Msgf("API key for %s is not set and not provided in environment variable %s\n", llm.Provider, llm.APIKeyName)
@@ -61,19 +175,56 @@ func (llm *LLM) Validate() bool {
 	return true
 }
 
+// endpointSuffixes are endpoint paths the clients append themselves, a base
+// URL ending in one of them would have it twice.
+var endpointSuffixes = []string{"/chat/completions", "/completions", "/models", ":generateContent", ":streamGenerateContent", "/messages", "/api/chat"}
+
+// CheckBaseURL reports base URLs that cannot work: unparsable ones, ones
+// without an http(s) scheme and host, and ones that already include the
+// endpoint path the client appends.
+func (llm *LLM) CheckBaseURL() error {
+	u, err := url.Parse(llm.BaseURL)
+	if err != nil {
+		return fmt.Errorf("base_url %q: %w", llm.BaseURL, err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("base_url %q must be an absolute http(s) URL", llm.BaseURL)
+	}
+	path := strings.TrimSuffix(u.Path, "/")
+	for _, suffix := range endpointSuffixes {
+		if strings.HasSuffix(path, suffix) {
+			return fmt.Errorf("base_url %q must not include the %s endpoint, it is added by the client", llm.BaseURL, suffix)
+		}
+	}
+	return nil
+}
+
+// host returns the host name of the base URL, empty when it has none.
+func (llm *LLM) host() string {
+	u, err := url.Parse(llm.BaseURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
+
 func (llm *LLM) SetClient() error {
 	// Initialize API client based on API provider
 	switch llm.Provider {
-	case "openai":
-		llm.Client = api.NewOpenAIClient(llm.BaseURL, llm.APIKey)
+	case "openai", "openrouter", "groq":
+		client := api.NewOpenAIClient(llm.BaseURL, llm.APIKey)
+		// Groq's request headers count requests per day
+		client.DailyRequests = llm.Provider == "groq" || llm.host() == "api.groq.com"
+		llm.Client = client
 	case "ollama":
-		llm.Client = api.NewOpenAIClient(llm.BaseURL, llm.APIKey) // should be ollama client
-	case "groq":
-		llm.Client = api.NewOpenAIClient(llm.BaseURL, llm.APIKey)
+		client := api.NewOllamaClient(llm.BaseURL, llm.APIKey)
+		client.Options = maps.Clone(llm.Options)
+		client.KeepAlive = llm.KeepAlive
+		llm.Client = client
 	case "google":
 		llm.Client = api.NewGoogleClient(llm.BaseURL, llm.APIKey)
-	case "openrouter":
-		llm.Client = api.NewOpenAIClient(llm.BaseURL, llm.APIKey)
+	case "anthropic":
+		llm.Client = api.NewAnthropicClient(llm.BaseURL, llm.APIKey)
 	default:
 		return fmt.Errorf("unsupported provider: %s", llm.Provider)
 	}
@@ -1,25 +1,35 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 
+	"llm-balancer/auth"
 	"llm-balancer/balancer"
+	"llm-balancer/capture"
 	"llm-balancer/config"
 	"llm-balancer/handlers"
-)
-
-// BytesPerToken remains here or move to a utility package? Keep simple for MVP.
-const (
-	BytesPerToken = 16 // Approximately 16 bytes per token
+	"llm-balancer/usage"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		if err := replay(os.Args[2:]); err != nil {
+			log.Fatal().Err(err).Msg("Replay failed")
+		}
+		return
+	}
+
 	// Parse command line flags
 	configPath := flag.String("config", "config.yaml", "path to config file")
 	flag.Parse()
@@ -30,40 +40,126 @@ func main() {
 		log.Fatal().Err(err).Msg("Failed to load config")
 	}
 
-	// Set log level
-	switch cfg.General.LogLevel {
-	case "debug":
-		zerolog.SetGlobalLevel(zerolog.DebugLevel)
-	case "info":
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	case "warn":
-		zerolog.SetGlobalLevel(zerolog.WarnLevel)
-	case "error":
-		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
-	default:
-		zerolog.SetGlobalLevel(zerolog.InfoLevel)
-	}
+	setLogLevel(cfg.General.LogLevel)
 
 	if len(cfg.LLMAPIs) == 0 {
 		log.Fatal().Msg("No LLM APIs configured")
 	}
 
-	balancer, err := balancer.NewPool(balancer.Config{
-		Models:         cfg.LLMAPIs,
-		SortStrategy:   &balancer.QualitySortStrategy{},
-		ContextTimeout: time.Duration(cfg.General.ContextTimeout) * time.Second,
-	})
+	poolCfg, err := poolConfig(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid selection strategy")
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	poolCfg.Metrics = registry
+	balancer, err := balancer.NewPool(poolCfg)
 	if err != nil {
 		log.Fatal().Err(err).Msg("Failed to create balancer pool")
 	}
 
-	handler := handlers.NewHandler(balancer, cfg.LLMAPIs) // Use handlers package
+	keys, err := auth.NewStore(cfg.Auth.Enabled, cfg.Auth.Keys)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid API keys")
+	}
+	if !cfg.Auth.Enabled {
+		log.Warn().Msg("Authentication is disabled, any client can use the balancer")
+	}
+
+	var ledger *usage.Ledger
+	if cfg.Usage.Path != "" {
+		if ledger, err = usage.Open(cfg.Usage.Path); err != nil {
+			log.Fatal().Err(err).Msg("Failed to open the usage ledger")
+		}
+		defer ledger.Close()
+		// budgets pick up where they were before the restart; a month covers every period
+		now := time.Now().UTC()
+		monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		err := ledger.Records(monthStart, func(rec usage.Record) {
+			if rec.Key != "" {
+				keys.Charge(rec.Key, rec.Cost, rec.Time)
+			}
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to read the usage ledger")
+		}
+	}
+
+	// the listen addresses, health checks and admin key need a restart to change
+	go config.Watch(context.Background(), *configPath, time.Duration(cfg.General.ReloadInterval)*time.Second, func(cfg *config.Config) error {
+		poolCfg, err := poolConfig(cfg)
+		if err != nil {
+			return err
+		}
+		// validated first so a bad key does not leave the pool half applied
+		if err := auth.ValidateKeys(cfg.Auth.Keys); err != nil {
+			return err
+		}
+		if err := balancer.Apply(poolCfg); err != nil {
+			return err
+		}
+		if err := keys.Replace(cfg.Auth.Enabled, cfg.Auth.Keys); err != nil {
+			return err
+		}
+		setLogLevel(cfg.General.LogLevel)
+		return nil
+	})
+
+	if cfg.Health.CheckOnStartup {
+		failures := balancer.CheckAll(context.Background(), cfg.Health)
+		for model, err := range failures {
+			log.Error().Err(err).Str("model", model).Msg("Startup health check failed")
+		}
+		if len(failures) > 0 {
+			log.Fatal().Int("failed", len(failures)).Msg("Models failed their startup health check")
+		}
+	}
+	if cfg.Health.Enabled {
+		balancer.StartHealthChecks(context.Background(), cfg.Health)
+	}
+
+	var sink *capture.Sink
+	if cfg.Capture.Path != "" {
+		if sink, err = capture.Open(cfg.Capture); err != nil {
+			log.Fatal().Err(err).Msg("Failed to open the capture file")
+		}
+		defer sink.Close()
+		sink.Secrets = func() []string {
+			var secrets []string
+			for _, l := range balancer.LLMs() {
+				secrets = append(secrets, l.APIKey)
+			}
+			for _, k := range keys.Keys() {
+				secrets = append(secrets, k.APIKey)
+			}
+			return secrets
+		}
+		log.Warn().Str("path", cfg.Capture.Path).Msg("Capturing requests and responses")
+	}
+
+	handler := handlers.NewHandler(balancer, keys, ledger, sink) // Use handlers package
 
 	// Make 2 groups /llm/v1 or /v1/llm and /api/v1 etc
-	http.HandleFunc("/v1/chat/completions", handler.HandleChatCompletion) // Use handler's method
-	http.HandleFunc("/v1/models", handler.HandleModels)                   // Use handler's method
+	http.Handle("/v1/chat/completions", keys.Middleware(http.HandlerFunc(handler.HandleChatCompletion)))
+	http.Handle("POST /v1/messages", keys.Middleware(http.HandlerFunc(handler.HandleMessages)))
+	http.Handle("/v1/models", keys.Middleware(http.HandlerFunc(handler.HandleModels)))
+	http.Handle("GET /v1/usage", keys.Middleware(http.HandlerFunc(handler.HandleUsage)))
 	// TODO: Add handler for groups (how to balance, i.e. free, fast, task, local, provider, etc.)
-	// TODO: Add handler for new llm like `add this llm to the list of available ones`
+	metricsHandler := promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+	adminKey := cfg.Admin.Key()
+	if adminKey != "" {
+		http.Handle("/admin/", handlers.NewAdminHandler(balancer, keys, ledger, adminKey))
+	} else {
+		log.Info().Msg("No admin key configured, the admin API is disabled")
+	}
+	if addr := cfg.Metrics.ListenAddress; addr != "" {
+		go serveMetrics(addr, metricsHandler)
+	} else if adminKey != "" {
+		// metrics name the models, providers and spend, like the admin API
+		http.Handle("GET /metrics", handlers.RequireAdminKey(adminKey, metricsHandler))
+	} else {
+		log.Info().Msg("No admin key or metrics listen address configured, the metrics are not served")
+	}
 	// TODO: Add a catch all the rest and give a 404
 
 	// Start server
@@ -75,3 +171,61 @@ func main() {
 		log.Fatal().Err(err).Msg("Server failed")
 	}
 }
+
+// serveMetrics serves the metrics at /metrics of their own listen address,
+// which is meant to be reachable by the Prometheus server only.
+func serveMetrics(addr string, handler http.Handler) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", handler)
+	log.Info().Str("address", addr).Msg("Serving metrics")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal().Err(err).Msg("Metrics server failed")
+	}
+}
+
+// poolConfig builds the balancer configuration, including the selection
+// strategies, from the loaded config.
+func poolConfig(cfg *config.Config) (balancer.Config, error) {
+	sorter, err := balancer.NewSortStrategy(balancer.StrategyConfig{
+		Strategy: cfg.General.Strategy,
+		Weights:  cfg.General.OptimizationWeights,
+	})
+	if err != nil {
+		return balancer.Config{}, err
+	}
+	groupSorters := make(map[string]balancer.SortStrategy)
+	for group, strategy := range cfg.GroupStrategies {
+		if groupSorters[group], err = balancer.NewSortStrategy(strategy); err != nil {
+			return balancer.Config{}, fmt.Errorf("group %s: %w", group, err)
+		}
+	}
+
+	return balancer.Config{
+		Models:         cfg.LLMAPIs,
+		Groups:         cfg.Groups,
+		SharedLimits:   cfg.SharedLimits,
+		SortStrategy:   sorter,
+		GroupSorters:   groupSorters,
+		ContextTimeout: time.Duration(cfg.General.ContextTimeout) * time.Second,
+		Retry:          cfg.Retry,
+		Breaker:        cfg.Breaker,
+		Cache:          cfg.Cache,
+	}, nil
+}
+
+func setLogLevel(level string) {
+	switch level {
+	case "trace":
+		zerolog.SetGlobalLevel(zerolog.TraceLevel)
+	case "debug":
+		zerolog.SetGlobalLevel(zerolog.DebugLevel)
+	case "info":
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	case "warn":
+		zerolog.SetGlobalLevel(zerolog.WarnLevel)
+	case "error":
+		zerolog.SetGlobalLevel(zerolog.ErrorLevel)
+	default:
+		zerolog.SetGlobalLevel(zerolog.InfoLevel)
+	}
+}
@@ -13,6 +13,7 @@ type ChatCompletionRequest struct {
 	LogitBias           map[string]int    `json:"logit_bias,omitempty"`
 	LogProbs            *bool             `json:"logprobs,omitempty"`
 	MaxCompletionTokens *int              `json:"max_completion_tokens,omitempty"`
+	MaxTokens           *int              `json:"max_tokens,omitempty"` // deprecated alias of max_completion_tokens still sent by most clients
 	Metadata            map[string]string `json:"metadata,omitempty"`
 	Modalities          []string          `json:"modalities,omitempty"`
 	N                   *int              `json:"n,omitempty"`
@@ -40,16 +41,68 @@ type ChatCompletionRequest struct {
 // TODO: This will also imply I need to create a custom marshaller for the message
 
 type Message struct {
-	Role       string `json:"role"`
-	Content    any    `json:"content"` // string or []ContentPart
-	Name       string `json:"name,omitempty"`
-	ToolCallID string `json:"tool_call_id,omitempty"`
+	Role       string     `json:"role"`
+	Content    any        `json:"content"` // string or []ContentPart
+	Name       string     `json:"name,omitempty"`
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty"` // Tool calls made by an assistant message
+	ToolCallID string     `json:"tool_call_id,omitempty"`
 }
 
 type ContentPart struct {
-	Type    string `json:"type"`
-	Text    string `json:"text,omitempty"`
-	Refusal string `json:"refusal,omitempty"`
+	Type       string      `json:"type"` // text, refusal, image_url, input_audio or file
+	Text       string      `json:"text,omitempty"`
+	Refusal    string      `json:"refusal,omitempty"`
+	ImageURL   *ImageURL   `json:"image_url,omitempty"`
+	InputAudio *InputAudio `json:"input_audio,omitempty"`
+	File       *File       `json:"file,omitempty"`
+}
+
+type ImageURL struct {
+	URL    string `json:"url"`              // Remote URL or base64 data URL
+	Detail string `json:"detail,omitempty"` // auto, low or high
+}
+
+type InputAudio struct {
+	Data   string `json:"data"`   // Base64 encoded audio
+	Format string `json:"format"` // wav or mp3
+}
+
+type File struct {
+	FileData string `json:"file_data,omitempty"` // Base64 encoded file, usually as a data URL
+	FileID   string `json:"file_id,omitempty"`   // ID of a file uploaded to the provider
+	Filename string `json:"filename,omitempty"`
+}
+
+// MaxOutputTokens returns max_completion_tokens, or the legacy max_tokens
+// when only that is set, nil when neither is.
+func (r *ChatCompletionRequest) MaxOutputTokens() *int {
+	if r.MaxCompletionTokens != nil {
+		return r.MaxCompletionTokens
+	}
+	return r.MaxTokens
+}
+
+// ContentParts returns the content of the message as parts, a string
+// content is a single text part. Decoded requests hold the parts as generic
+// JSON values, they are converted through a JSON round trip.
+func (m Message) ContentParts() ([]ContentPart, error) {
+	switch content := m.Content.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []ContentPart{{Type: "text", Text: content}}, nil
+	case []ContentPart:
+		return content, nil
+	}
+	data, err := json.Marshal(m.Content)
+	if err != nil {
+		return nil, err
+	}
+	var parts []ContentPart
+	if err := json.Unmarshal(data, &parts); err != nil {
+		return nil, fmt.Errorf("content must be a string or an array of content parts: %w", err)
+	}
+	return parts, nil
 }
 
 type AudioOptions struct {
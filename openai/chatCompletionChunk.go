@@ -0,0 +1,118 @@
+package openai
+
+import "fmt"
+
+// ChatCompletionChunk represents a single streamed chat completion event
+type ChatCompletionChunk struct {
+	Choices           []ChunkChoice `json:"choices"`                // Delta choices, empty on the final usage chunk
+	Created           int           `json:"created"`                // Unix timestamp of creation
+	ID                string        `json:"id"`                     // Unique identifier, shared by every chunk of a completion
+	Model             string        `json:"model"`                  // Model used for completion
+	Object            string        `json:"object"`                 // Always "chat.completion.chunk"
+	ServiceTier       *string       `json:"service_tier,omitempty"` // Service tier used for processing
+	SystemFingerprint string        `json:"system_fingerprint,omitempty"`
+	Usage             *Usage        `json:"usage,omitempty"` // Only set on the last chunk when stream_options.include_usage is true
+}
+
+type ChunkChoice struct {
+	Delta        Delta     `json:"delta"`         // Incremental message content
+	FinishReason *string   `json:"finish_reason"` // Set on the last chunk of the choice
+	Index        int       `json:"index"`         // Index of the choice
+	Logprobs     *LogProbs `json:"logprobs,omitempty"`
+}
+
+type Delta struct {
+	Content   *string         `json:"content,omitempty"`    // Content fragment
+	Refusal   *string         `json:"refusal,omitempty"`    // Refusal fragment
+	Role      string          `json:"role,omitempty"`       // Only set on the first chunk
+	ToolCalls []ToolCallDelta `json:"tool_calls,omitempty"` // Tool call fragments
+}
+
+type ToolCallDelta struct {
+	Function FunctionCallDelta `json:"function"`       // Function fragment
+	ID       string            `json:"id,omitempty"`   // Only set on the first fragment of a tool call
+	Index    int               `json:"index"`          // Index of the tool call being built
+	Type     string            `json:"type,omitempty"` // Only set on the first fragment of a tool call
+}
+
+type FunctionCallDelta struct {
+	Arguments string `json:"arguments,omitempty"` // JSON encoded arguments fragment
+	Name      string `json:"name,omitempty"`      // Only set on the first fragment of a tool call
+}
+
+// MaxToolCalls bounds the tool call index a streamed chunk may refer to, the
+// most tools a request may declare.
+const MaxToolCalls = 128
+
+// Add merges a streamed chunk into the response the stream adds up to, so
+// a stream can be kept as a single ChatCompletionResponse. A chunk with a
+// tool call index out of range is rejected without merging any of it.
+func (c *ChatCompletionResponse) Add(chunk *ChatCompletionChunk) error {
+	for _, delta := range chunk.Choices {
+		for _, fragment := range delta.Delta.ToolCalls {
+			if fragment.Index < 0 || fragment.Index >= MaxToolCalls {
+				return fmt.Errorf("tool call index %d out of range", fragment.Index)
+			}
+		}
+	}
+	if c.ID == "" {
+		c.ID, c.Created, c.Model = chunk.ID, chunk.Created, chunk.Model
+		c.ServiceTier, c.SystemFingerprint = chunk.ServiceTier, chunk.SystemFingerprint
+		c.Object = "chat.completion"
+	}
+	if chunk.Usage != nil {
+		c.Usage = *chunk.Usage
+	}
+	for _, delta := range chunk.Choices {
+		choice := c.choice(delta.Index)
+		if delta.Delta.Role != "" {
+			choice.Message.Role = delta.Delta.Role
+		}
+		if delta.Delta.Content != nil {
+			choice.Message.Content = concat(choice.Message.Content, *delta.Delta.Content)
+		}
+		if delta.Delta.Refusal != nil {
+			choice.Message.Refusal = concat(choice.Message.Refusal, *delta.Delta.Refusal)
+		}
+		for _, fragment := range delta.Delta.ToolCalls {
+			for len(choice.Message.ToolCalls) <= fragment.Index {
+				choice.Message.ToolCalls = append(choice.Message.ToolCalls, ToolCall{})
+			}
+			call := &choice.Message.ToolCalls[fragment.Index]
+			if fragment.ID != "" {
+				call.ID = fragment.ID
+			}
+			if fragment.Type != "" {
+				call.Type = fragment.Type
+			}
+			if fragment.Function.Name != "" {
+				call.Function.Name = fragment.Function.Name
+			}
+			args, _ := call.Function.Arguments.(string)
+			call.Function.Arguments = args + fragment.Function.Arguments
+		}
+		if delta.FinishReason != nil {
+			choice.FinishReason = *delta.FinishReason
+		}
+	}
+	return nil
+}
+
+// choice returns the choice with the given index, adding it if needed.
+func (c *ChatCompletionResponse) choice(index int) *Choice {
+	for i := range c.Choices {
+		if c.Choices[i].Index == index {
+			return &c.Choices[i]
+		}
+	}
+	c.Choices = append(c.Choices, Choice{Index: index})
+	return &c.Choices[len(c.Choices)-1]
+}
+
+func concat(s *string, fragment string) *string {
+	if s == nil {
+		return &fragment
+	}
+	joined := *s + fragment
+	return &joined
+}
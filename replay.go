@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"llm-balancer/api"
+	"llm-balancer/balancer"
+	"llm-balancer/capture"
+	"llm-balancer/config"
+	"llm-balancer/handlers"
+	"llm-balancer/openai"
+)
+
+// replay re-sends the requests of a capture file through the balancer, or
+// to one model or group, and prints how the responses differ from the
+// captured ones. With -url the requests go to the chat completions endpoint
+// of a running server, so its API keys, budgets, cache and rate limiter state
+// apply. Without it the requests go through a pool built from the config
+// file, where none of these do.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	configPath := flags.String("config", "config.yaml", "path to config file, unused with -url")
+	serverURL := flags.String("url", "", "base URL of a running server to send the requests to, e.g. http://localhost:8080")
+	apiKey := flags.String("key", os.Getenv("LLM_BALANCER_API_KEY"), "API key sent to the server with -url")
+	model := flags.String("model", "", "send every request to this model or group instead of the one it asked for")
+	timeout := flags.Duration("timeout", 2*time.Minute, "timeout of each request")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [flags] capture.jsonl\n", os.Args[0])
+		fmt.Fprintln(flags.Output(), "With -url requests are sent to a running server. Otherwise an in-process balancer built from the config file sends them:")
+		fmt.Fprintln(flags.Output(), "API keys, model restrictions, budgets, the response cache and the server's rate limiter state do not apply then.")
+		flags.PrintDefaults()
+	}
+	_ = flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected one capture file")
+	}
+
+	var send replaySender
+	if *serverURL != "" {
+		send = serverSender(*serverURL, *apiKey)
+	} else {
+		cfg, err := config.LoadConfig(*configPath)
+		if err != nil {
+			return err
+		}
+		setLogLevel(cfg.General.LogLevel)
+		poolCfg, err := poolConfig(cfg)
+		if err != nil {
+			return err
+		}
+		pool, err := balancer.NewPool(poolCfg)
+		if err != nil {
+			return err
+		}
+		send = poolSender(pool)
+	}
+
+	var identical, different, failed int
+	err := capture.Read(flags.Arg(0), func(line int, e *capture.Entry) error {
+		var req openai.ChatCompletionRequest
+		if err := json.Unmarshal(e.Request, &req); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if *model != "" {
+			req.Model = *model
+		}
+		// responses are compared whole, streams were captured assembled
+		req.Stream, req.StreamOptions = nil, nil
+
+		fmt.Printf("=== line %d, %s, requested %s, captured from %s/%s\n",
+			line, e.Time.Format(time.RFC3339), req.Model, e.Provider, e.Model)
+		if e.Error != "" {
+			fmt.Printf("captured error: %s\n", e.Error)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		resp, routed, err := send(ctx, &req)
+		cancel()
+		if err != nil {
+			failed++
+			fmt.Printf("replay failed: %v\n", err)
+			return nil
+		}
+
+		fmt.Printf("replayed on %s\n", routed)
+		if diff := capture.Diff(capture.Text(e.Response), capture.Text(resp)); diff != "" {
+			different++
+			fmt.Print(diff)
+		} else {
+			identical++
+			fmt.Println("identical")
+		}
+		return nil
+	})
+	fmt.Printf("\n%d identical, %d different, %d failed\n", identical, different, failed)
+	return err
+}
+
+// replaySender sends a replayed request and returns the response and where
+// it was routed.
+type replaySender func(ctx context.Context, req *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, string, error)
+
+// poolSender sends requests through an in-process pool, estimating their
+// tokens the way the server does.
+func poolSender(pool *balancer.Pool) replaySender {
+	return func(ctx context.Context, req *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, string, error) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, "", err
+		}
+		resp, ml, err := pool.Do(ctx, &api.Request{Request: req, TokensNeeded: handlers.EstimateTokens(body)})
+		if err != nil {
+			return nil, "", err
+		}
+		if resp.Error != nil {
+			return nil, "", resp.Error
+		}
+		return resp.Response, ml.LLM.Provider + "/" + ml.LLM.Model, nil
+	}
+}
+
+// serverSender posts requests to the chat completions endpoint of the server
+// at baseURL.
+func serverSender(baseURL, apiKey string) replaySender {
+	endpoint := strings.TrimSuffix(baseURL, "/") + "/v1/chat/completions"
+	return func(ctx context.Context, req *openai.ChatCompletionRequest) (*openai.ChatCompletionResponse, string, error) {
+		body, err := json.Marshal(req)
+		if err != nil {
+			return nil, "", err
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, "", err
+		}
+		httpReq.Header.Set("Content-Type", "application/json")
+		if apiKey != "" {
+			httpReq.Header.Set("Authorization", "Bearer "+apiKey)
+		}
+		httpResp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			return nil, "", err
+		}
+		defer func() { _ = httpResp.Body.Close() }()
+		respBody, err := io.ReadAll(httpResp.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		if httpResp.StatusCode != http.StatusOK {
+			return nil, "", fmt.Errorf("status code %d: %s", httpResp.StatusCode, strings.TrimSpace(string(respBody)))
+		}
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(respBody, &resp); err != nil {
+			return nil, "", fmt.Errorf("error unmarshaling response: %w", err)
+		}
+		return &resp, baseURL + " as " + resp.Model, nil
+	}
+}
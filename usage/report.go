@@ -0,0 +1,145 @@
+package usage
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Dimensions records can be grouped by.
+const (
+	ByModel    = "model"
+	ByProvider = "provider"
+	ByKey      = "key"
+	ByDay      = "day" // UTC, as 2006-01-02
+)
+
+// Aggregate sums the records sharing the values of the grouped dimensions.
+// Dimensions that were not grouped by are empty.
+type Aggregate struct {
+	Model            string  `json:"model,omitempty"`
+	Provider         string  `json:"provider,omitempty"`
+	Key              string  `json:"key,omitempty"`
+	Day              string  `json:"day,omitempty"`
+	Requests         int     `json:"requests"`
+	Failed           int     `json:"failed"` // requests with any outcome but success or cached
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Cost             float64 `json:"cost"`
+	AvgLatencyMS     int64   `json:"avg_latency_ms"`
+	AvgQueueMS       int64   `json:"avg_queue_ms"`
+
+	latency, queue int64
+}
+
+// Report aggregates records by a set of dimensions.
+type Report struct {
+	groupBy []string
+	groups  map[[4]string]*Aggregate
+}
+
+// NewReport returns an empty report grouping by the given dimensions.
+func NewReport(groupBy []string) (*Report, error) {
+	for _, dim := range groupBy {
+		switch dim {
+		case ByModel, ByProvider, ByKey, ByDay:
+		default:
+			return nil, fmt.Errorf("unknown group_by %q, want model, provider, key or day", dim)
+		}
+	}
+	return &Report{groupBy: groupBy, groups: make(map[[4]string]*Aggregate)}, nil
+}
+
+// Add counts a record into its group.
+func (rep *Report) Add(r Record) {
+	var id [4]string
+	for _, dim := range rep.groupBy {
+		switch dim {
+		case ByModel:
+			id[0] = r.Model
+		case ByProvider:
+			id[1] = r.Provider
+		case ByKey:
+			id[2] = r.Key
+		case ByDay:
+			id[3] = r.Time.UTC().Format(time.DateOnly)
+		}
+	}
+	agg, ok := rep.groups[id]
+	if !ok {
+		agg = &Aggregate{Model: id[0], Provider: id[1], Key: id[2], Day: id[3]}
+		rep.groups[id] = agg
+	}
+	agg.Requests++
+	if r.Outcome != "success" && r.Outcome != "cached" { // balancer.OutcomeSuccess and OutcomeCached
+		agg.Failed++
+	}
+	agg.PromptTokens += r.PromptTokens
+	agg.CompletionTokens += r.CompletionTokens
+	agg.Cost += r.Cost
+	agg.latency += r.LatencyMS
+	agg.queue += r.QueueMS
+}
+
+// Aggregates returns the groups ordered by their dimensions.
+func (rep *Report) Aggregates() []*Aggregate {
+	aggs := make([]*Aggregate, 0, len(rep.groups))
+	for _, agg := range rep.groups {
+		agg.AvgLatencyMS = agg.latency / int64(agg.Requests)
+		agg.AvgQueueMS = agg.queue / int64(agg.Requests)
+		aggs = append(aggs, agg)
+	}
+	slices.SortFunc(aggs, func(a, b *Aggregate) int {
+		return cmp.Or(
+			cmp.Compare(a.Day, b.Day),
+			cmp.Compare(a.Key, b.Key),
+			cmp.Compare(a.Provider, b.Provider),
+			cmp.Compare(a.Model, b.Model),
+		)
+	})
+	return aggs
+}
+
+// WriteCSV writes the aggregates as CSV with a header, one column per
+// grouped dimension followed by the totals.
+func (rep *Report) WriteCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	header := append(slices.Clone(rep.groupBy),
+		"requests", "failed", "prompt_tokens", "completion_tokens", "cost", "avg_latency_ms", "avg_queue_ms")
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+	for _, agg := range rep.Aggregates() {
+		row := make([]string, 0, len(header))
+		for _, dim := range rep.groupBy {
+			switch dim {
+			case ByModel:
+				row = append(row, agg.Model)
+			case ByProvider:
+				row = append(row, agg.Provider)
+			case ByKey:
+				row = append(row, agg.Key)
+			case ByDay:
+				row = append(row, agg.Day)
+			}
+		}
+		row = append(row,
+			strconv.Itoa(agg.Requests),
+			strconv.Itoa(agg.Failed),
+			strconv.Itoa(agg.PromptTokens),
+			strconv.Itoa(agg.CompletionTokens),
+			strconv.FormatFloat(agg.Cost, 'f', -1, 64),
+			strconv.FormatInt(agg.AvgLatencyMS, 10),
+			strconv.FormatInt(agg.AvgQueueMS, 10),
+		)
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,108 @@
+// Package usage keeps a ledger of completed requests on disk and reports
+// on it.
+package usage
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Config holds where the ledger is stored.
+type Config struct {
+	Path string `yaml:"path"` // JSON Lines file, no ledger is kept when empty
+}
+
+// Record is a request the balancer served or failed to serve.
+type Record struct {
+	Time             time.Time `json:"time"`
+	Key              string    `json:"key,omitempty"`   // name of the client key, empty without one
+	Requested        string    `json:"requested"`       // model or group the client asked for
+	Name             string    `json:"name,omitempty"`  // llm.LLM.Name of the model that served it
+	Model            string    `json:"model,omitempty"` // empty when no model was tried
+	Provider         string    `json:"provider,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             float64   `json:"cost"`       // in dollars
+	LatencyMS        int64     `json:"latency_ms"` // until the response was sent, queueing included
+	QueueMS          int64     `json:"queue_ms"`   // waiting for cooldowns and rate limiters
+	Outcome          string    `json:"outcome"`    // see balancer.Outcome
+}
+
+// Ledger appends records to a JSON Lines file. Every record is written with
+// a single append, so a crash loses at most the record being written.
+type Ledger struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// Open opens the ledger at path, creating it and its directory if needed.
+func Open(path string) (*Ledger, error) {
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Ledger{path: path, file: file}, nil
+}
+
+// Append writes a record to the end of the ledger.
+func (l *Ledger) Append(r Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err = l.file.Write(line)
+	return err
+}
+
+// Records calls fn for every record from since on, oldest first. Lines that
+// cannot be parsed, such as one cut short by a crash, are skipped.
+func (l *Ledger) Records(since time.Time, fn func(Record)) error {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			log.Warn().Err(err).Str("path", l.path).Int("line", line).Msg("Skipping unreadable usage record")
+			continue
+		}
+		if !r.Time.Before(since) {
+			fn(r)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading %s: %w", l.path, err)
+	}
+	return nil
+}
+
+// Close closes the ledger file.
+func (l *Ledger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.file.Close()
+}
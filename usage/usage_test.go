@@ -0,0 +1,92 @@
+package usage_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"llm-balancer/usage"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+)
+
+var _ = Describe("Ledger", func() {
+	var (
+		path   string
+		ledger *usage.Ledger
+	)
+	day := time.Date(2025, 5, 11, 12, 0, 0, 0, time.UTC)
+
+	records := func(since time.Time) []usage.Record {
+		var out []usage.Record
+		Expect(ledger.Records(since, func(r usage.Record) { out = append(out, r) })).To(Succeed())
+		return out
+	}
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "data", "usage.jsonl")
+		var err error
+		ledger, err = usage.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		DeferCleanup(ledger.Close)
+
+		for i, r := range []usage.Record{
+			{Key: "a", Model: "m1", Provider: "groq", PromptTokens: 10, CompletionTokens: 5, Cost: 0.5, LatencyMS: 100, Outcome: "success"},
+			{Key: "b", Model: "m1", Provider: "groq", PromptTokens: 20, Cost: 1, LatencyMS: 300, QueueMS: 50, Outcome: "server_error"},
+			{Key: "a", Model: "m2", Provider: "google", PromptTokens: 30, CompletionTokens: 10, Cost: 2, LatencyMS: 200, Outcome: "success"},
+		} {
+			r.Time = day.Add(time.Duration(i) * 6 * time.Hour)
+			Expect(ledger.Append(r)).To(Succeed())
+		}
+	})
+
+	It("reads back the records appended from a time on", func() {
+		Expect(records(time.Time{})).To(HaveLen(3))
+		recent := records(day.Add(time.Hour))
+		Expect(recent).To(HaveLen(2))
+		Expect(recent[0].Key).To(Equal("b"))
+		Expect(recent[1].Time).To(BeTemporally("==", day.Add(12*time.Hour)))
+	})
+
+	It("skips lines cut short by a crash", func() {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = f.WriteString(`{"time":"2025-05-1`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(f.Close()).To(Succeed())
+
+		Expect(records(time.Time{})).To(HaveLen(3))
+	})
+
+	It("aggregates records by the grouped dimensions", func() {
+		report, err := usage.NewReport([]string{usage.ByProvider, usage.ByDay})
+		Expect(err).NotTo(HaveOccurred())
+		for _, r := range records(time.Time{}) {
+			report.Add(r)
+		}
+
+		aggs := report.Aggregates()
+		Expect(aggs).To(HaveLen(2))
+		Expect(*aggs[0]).To(MatchFields(IgnoreExtras, Fields{
+			"Provider": Equal("groq"), "Day": Equal("2025-05-11"), "Model": BeEmpty(),
+			"Requests": Equal(2), "Failed": Equal(1), "PromptTokens": Equal(30), "CompletionTokens": Equal(5),
+			"Cost": BeNumerically("~", 1.5), "AvgLatencyMS": Equal(int64(200)), "AvgQueueMS": Equal(int64(25)),
+		}))
+		Expect(aggs[1].Provider).To(Equal("google"))
+		Expect(aggs[1].Day).To(Equal("2025-05-12"))
+
+		var csv strings.Builder
+		Expect(report.WriteCSV(&csv)).To(Succeed())
+		Expect(csv.String()).To(Equal("provider,day,requests,failed,prompt_tokens,completion_tokens,cost,avg_latency_ms,avg_queue_ms\n" +
+			"groq,2025-05-11,2,1,30,5,1.5,200,25\n" +
+			"google,2025-05-12,1,0,30,10,2,200,0\n"))
+	})
+
+	It("rejects unknown dimensions", func() {
+		_, err := usage.NewReport([]string{"color"})
+		Expect(err).To(HaveOccurred())
+	})
+})